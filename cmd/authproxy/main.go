@@ -2,13 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"strings"
 
-	"authproxy/internal/config"
-	"authproxy/internal/server"
 	"github.com/joho/godotenv"
+	"github.com/nais/authproxy/internal/config"
+	"github.com/nais/authproxy/internal/server"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
@@ -16,24 +17,78 @@ import (
 var cfg = config.DefaultConfig()
 
 func init() {
+	flag.Usage = printUsage
 	flag.StringVar(&cfg.BindAddress, "bind-address", cfg.BindAddress, "Bind address for the authproxy, default 127.0.0.1:8080")
 	flag.StringVar(&cfg.MetricsBindAddress, "metrics-bind-address", cfg.MetricsBindAddress, "Bind address for metrics only, default 127.0.0.1:8081")
 	flag.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "which log level to use, default 'info'")
 	flag.StringVar(&cfg.UpstreamHost, "upstream-host", cfg.UpstreamHost, "Upstream host, i.e. which host to proxy requests to")
-	flag.StringVar(&cfg.AuthProvider, "auth-provider", cfg.AuthProvider, "Auth provider, a string of either 'iap', 'key', or 'no-op'")
-	flag.StringVar(&cfg.AuthAudience, "auth-audience", cfg.AuthAudience, "Auth audience, the 'aud' claim to expect in the JWT, required for --auth-provider 'iap'")
-	flag.StringVar(&cfg.AuthJwksUrl, "auth-jwks-url", cfg.AuthJwksUrl, "The URL to fetch the JWKS from, required for --auth-provider 'jwt'")
-	flag.StringVar(&cfg.AuthRequiredClaims, "auth-required-claims", cfg.AuthRequiredClaims, "Comma separated list of required JWT claims as key/value pairs, i.e. 'key1=value1,key2=value2'. Used for auth-provider 'jwt'")
-	flag.StringVar(&cfg.AuthTokenHeader, "auth-token-header", cfg.AuthTokenHeader, "Auth token header, which header to check for token, required for --auth-provider 'key'")
-	flag.StringVar(&cfg.AuthPreSharedKey, "auth-pre-shared-key", cfg.AuthPreSharedKey, "Auth pre shared key, the pre shared key to check against, required for --auth-provider 'key'")
+	authFlags("", cfg, nil)
+	authFlags("shadow-", cfg.Shadow, config.Shadowable)
+	flag.StringVar(&cfg.AuthRealm, "auth-realm", cfg.AuthRealm, "Realm used in WWW-Authenticate challenges, default 'authproxy'")
+	flag.BoolVar(&cfg.AuthOptional, "auth-optional", cfg.AuthOptional, "Pass requests without credentials upstream with 'X-Auth-Status: anonymous' instead of rejecting them. Invalid credentials are still rejected")
+	flag.StringVar(&cfg.AuthCredentialPolicy, "auth-credential-policy", cfg.AuthCredentialPolicy, "What happens to the credential of an authenticated request, 'keep', 'remove' or 'replace' (with --upstream-credential). Defaults to 'remove' for 'key' and 'keep' for tokens")
+	flag.StringVar(&cfg.ErrorTemplateDir, "error-template-dir", cfg.ErrorTemplateDir, "Directory with HTML templates for error pages, i.e. '401.html' or the catch-all 'error.html'")
+	flag.StringVar(&cfg.IdentityHeaders, "identity-headers", cfg.IdentityHeaders, "Comma separated list of upstream headers to set from verified claims, i.e. 'X-Auth-Request-User=sub,X-Auth-Request-Groups=groups'")
 	flag.StringVar(&cfg.UpstreamScheme, "upstream-scheme", cfg.UpstreamScheme, "Upstream scheme, the scheme to use when proxying requests, i.e. http or https")
+	flag.StringVar(&cfg.UpstreamCredential, "upstream-credential", cfg.UpstreamCredential, "Credential set on every upstream request in place of the caller's, i.e. 'Bearer <token>'")
+	flag.StringVar(&cfg.UpstreamCredentialHeader, "upstream-credential-header", cfg.UpstreamCredentialHeader, "Header for --upstream-credential, default 'Authorization'")
+	flag.StringVar(&cfg.UpstreamTokenUrl, "upstream-token-url", cfg.UpstreamTokenUrl, "Token endpoint to get an access token for the upstream from with the OAuth2 client credentials grant, set as 'Authorization' in place of the caller's credential")
+	flag.StringVar(&cfg.UpstreamClientId, "upstream-client-id", cfg.UpstreamClientId, "OAuth2 client ID. Required with --upstream-token-url")
+	flag.StringVar(&cfg.UpstreamClientSecret, "upstream-client-secret", cfg.UpstreamClientSecret, "OAuth2 client secret. Used with --upstream-token-url")
+	flag.StringVar(&cfg.UpstreamClientKeyFile, "upstream-client-key-file", cfg.UpstreamClientKeyFile, "Path to a JWK or PEM private key for 'private_key_jwt' client authentication instead of a secret. Used with --upstream-token-url")
+	flag.StringVar(&cfg.UpstreamScopes, "upstream-scopes", cfg.UpstreamScopes, "Space or comma separated list of scopes to request. Used with --upstream-token-url")
+	flag.StringVar(&cfg.UpstreamGrant, "upstream-grant", cfg.UpstreamGrant, "How to get the upstream token, 'client_credentials' (default) or 'token_exchange' to exchange the caller's token (RFC 8693). Used with --upstream-token-url")
+	flag.StringVar(&cfg.UpstreamAudience, "upstream-audience", cfg.UpstreamAudience, "Audience of the exchanged token, i.e. 'cluster:namespace:app'. Required for --upstream-grant 'token_exchange'")
+	flag.StringVar(&cfg.UpstreamGoogleAudience, "upstream-google-audience", cfg.UpstreamGoogleAudience, "Audience of a Google-signed ID token set as 'Authorization' on upstream requests, i.e. the URL of a Cloud Run service or the OAuth client ID of IAP")
+	flag.StringVar(&cfg.UpstreamGoogleCredentialsFile, "upstream-google-credentials-file", cfg.UpstreamGoogleCredentialsFile, "Service account key file to sign the ID tokens with, the metadata server is used if not set. Used with --upstream-google-audience")
+	flag.StringVar(&cfg.UpstreamJwtKeyFiles, "upstream-jwt-key-files", cfg.UpstreamJwtKeyFiles, "Comma separated list of JWK or PEM private keys to sign identity tokens for the upstream with. The first key signs, the others are only published at /.well-known/jwks.json for rotation")
+	flag.StringVar(&cfg.UpstreamJwtHeader, "upstream-jwt-header", cfg.UpstreamJwtHeader, "Header for the identity token, default 'X-Auth-Identity'. Used with --upstream-jwt-key-files")
+	flag.StringVar(&cfg.UpstreamJwtIssuer, "upstream-jwt-issuer", cfg.UpstreamJwtIssuer, "Issuer of the identity token, default 'authproxy'. Used with --upstream-jwt-key-files")
+	flag.StringVar(&cfg.UpstreamJwtAudience, "upstream-jwt-audience", cfg.UpstreamJwtAudience, "Audience of the identity token. Used with --upstream-jwt-key-files")
+	flag.StringVar(&cfg.UpstreamJwtLifetime, "upstream-jwt-lifetime", cfg.UpstreamJwtLifetime, "Lifetime of the identity token, default '5m'. Used with --upstream-jwt-key-files")
+}
+
+// authFlags registers the flags that configure an auth provider, from the
+// settings of the registered providers. They are registered twice, for the
+// enforcing provider and for the shadow provider, which can't be a preset.
+func authFlags(prefix string, c *config.Config, filter func(config.ProviderSpec) bool) {
+	usage := func(s string) string {
+		if prefix == "" {
+			return s
+		}
+		return "Shadow provider: " + s
+	}
+	flag.StringVar(&c.AuthProvider, prefix+"auth-provider", c.AuthProvider, usage("Auth provider, a string of either "+config.ProviderNames(filter)))
+	for _, s := range config.ProviderSettings(filter) {
+		switch v := s.Value(c).(type) {
+		case *string:
+			flag.StringVar(v, prefix+s.Name, *v, usage(s.Usage))
+		case *bool:
+			flag.BoolVar(v, prefix+s.Name, *v, usage(s.Usage))
+		default:
+			panic("unsupported setting " + s.Name)
+		}
+	}
+}
+
+// printUsage prints the flags followed by the auth providers and the flags
+// each of them reads.
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(out)
+	config.WriteProviderHelp(out)
 }
 
 func main() {
 	parseFlags()
 	setupLogger()
 
-	r := server.Router(cfg)
+	r, err := server.Router(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	go func() {
 		err := handleMetrics(cfg.MetricsBindAddress)
@@ -1,47 +1,244 @@
 package auth
 
 import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 )
 
+const (
+	// AuthStatusHeader is set on every request passed upstream, it is either
+	// StatusAuthenticated or StatusAnonymous.
+	AuthStatusHeader = "X-Auth-Status"
+	// AuthSubjectHeader is the verified subject of an authenticated request.
+	AuthSubjectHeader = "X-Auth-Subject"
+
+	StatusAuthenticated = "authenticated"
+	StatusAnonymous     = "anonymous"
+)
+
 type Handler func(h http.Handler) http.Handler
 
 type Provider interface {
 	Handler() (Handler, error)
 }
 
-var _ Provider = &PSK{}
+// Authenticator verifies the credentials of a request without writing a
+// response. Requests without credentials return an error wrapping
+// ErrMissingToken.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
 
-type PSK struct {
-	authHeader string
-	apiKey     string
+// CredentialPolicySetter is implemented by providers that can pass the
+// credential of the caller upstream, so --auth-credential-policy can be
+// applied to them.
+type CredentialPolicySetter interface {
+	SetCredentialPolicy(policy CredentialPolicy)
 }
 
-func PreSharedKey(authHeader, apiKey string) *PSK {
-	return &PSK{
-		authHeader: authHeader,
-		apiKey:     apiKey,
-	}
+var (
+	_ CredentialPolicySetter = &PSK{}
+	_ CredentialPolicySetter = &JWTAuth{}
+	_ CredentialPolicySetter = &GoogleIAP{}
+	_ CredentialPolicySetter = &PasetoAuth{}
+)
+
+// authenticator is implemented by the providers in this package.
+type authenticator interface {
+	Provider
+	Authenticator
+	// setup prepares the provider for use and returns the denier used for
+	// rejected requests.
+	setup() (denier, error)
+	// sources are where the provider reads credentials from.
+	sources() []TokenSource
+	// credentials is what happens to the credential of an authenticated
+	// request.
+	credentials() CredentialPolicy
 }
 
-func (p *PSK) Handler() (Handler, error) {
-	return func(handler http.Handler) http.Handler {
+// Verifies reports whether the provider verifies credentials without writing
+// a response, which optional authentication and shadow evaluation require.
+// Providers that take over the response, like a login flow, don't.
+func Verifies(p Provider) bool {
+	_, ok := p.(authenticator)
+	return ok
+}
+
+// authHandler authenticates every request. Requests without valid credentials
+// are rejected, unless optional is set and the request has no credentials at
+// all, in which case it passes through as anonymous.
+func authHandler(a authenticator, optional bool) (Handler, error) {
+	d, err := a.setup()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			header := r.Header.Get(p.authHeader)
+			removeIdentity(r)
 
-			token := strings.ReplaceAll(header, "Bearer ", "")
-			token = strings.TrimSpace(token)
-			if token != strings.TrimSpace(p.apiKey) {
-				http.Error(w, "invalid token", http.StatusUnauthorized)
+			principal, err := a.Authenticate(r)
+			switch {
+			case err == nil:
+				if a.credentials() == CredentialsRemove {
+					removeCredentials(r, a.sources())
+				}
+				r = authenticated(r, principal)
+			case optional && errors.Is(err, ErrMissingToken):
+				r.Header.Set(AuthStatusHeader, StatusAnonymous)
+			default:
+				d.deny(w, r, err)
 				return
 			}
 
-			handler.ServeHTTP(w, r)
+			h.ServeHTTP(w, r)
 		})
 	}, nil
 }
 
+// removeIdentity removes the identity headers, these are never passed
+// upstream from the client.
+func removeIdentity(r *http.Request) {
+	r.Header.Del(AuthStatusHeader)
+	r.Header.Del(AuthSubjectHeader)
+}
+
+// authenticated sets the identity headers and the principal for a verified
+// request.
+func authenticated(r *http.Request, principal *Principal) *http.Request {
+	r.Header.Set(AuthStatusHeader, StatusAuthenticated)
+	if principal.Subject != "" {
+		r.Header.Set(AuthSubjectHeader, principal.Subject)
+	}
+	return r.WithContext(WithPrincipal(r.Context(), principal))
+}
+
+var (
+	_ authenticator = &PSK{}
+	_ Provider      = &OptionalAuth{}
+)
+
+type PSK struct {
+	authHeader   string
+	keys         []namedKey
+	realm        string
+	tokenSources []TokenSource
+	policy       CredentialPolicy
+}
+
+// namedKey is a pre shared key, the name is the subject of requests using
+// it.
+type namedKey struct {
+	name string
+	key  string
+}
+
+func PreSharedKey(authHeader, apiKey string) *PSK {
+	p := &PSK{authHeader: authHeader}
+	if key := strings.TrimSpace(apiKey); key != "" {
+		p.keys = append(p.keys, namedKey{key: key})
+	}
+	return p
+}
+
+// WithNamedKey accepts another key, requests using it get the name as
+// subject so the upstream can tell the callers apart.
+func (p *PSK) WithNamedKey(name, apiKey string) *PSK {
+	p.keys = append(p.keys, namedKey{name: name, key: strings.TrimSpace(apiKey)})
+	return p
+}
+
+// WithTokenSources sets where to look for the key, in order. Defaults to
+// the configured header, see DefaultTokenSource: Authorization requires the
+// "Bearer" scheme, any other header holds the bare key.
+func (p *PSK) WithTokenSources(sources ...TokenSource) *PSK {
+	p.tokenSources = sources
+	return p
+}
+
+// WithRealm sets the realm used in WWW-Authenticate challenges.
+func (p *PSK) WithRealm(realm string) *PSK {
+	p.realm = realm
+	return p
+}
+
+// WithCredentialPolicy sets whether the key is passed upstream, it is removed
+// by default.
+func (p *PSK) WithCredentialPolicy(policy CredentialPolicy) *PSK {
+	p.policy = policy
+	return p
+}
+
+func (p *PSK) SetCredentialPolicy(policy CredentialPolicy) {
+	p.policy = policy
+}
+
+func (p *PSK) Handler() (Handler, error) {
+	return authHandler(p, false)
+}
+
+func (p *PSK) Authenticate(r *http.Request) (*Principal, error) {
+	token, err := extractToken(r, p.sources())
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range p.keys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(k.key)) == 1 {
+			return &Principal{Provider: "key", Subject: k.name}, nil
+		}
+	}
+	return nil, ErrInvalidToken
+}
+
+func (p *PSK) setup() (denier, error) {
+	if len(p.keys) == 0 {
+		return denier{}, errors.New("no pre shared keys configured")
+	}
+	for _, k := range p.keys {
+		if k.key == "" {
+			return denier{}, fmt.Errorf("pre shared key %q is empty", k.name)
+		}
+	}
+	return newDenier("key", p.realm, p.sources()), nil
+}
+
+func (p *PSK) credentials() CredentialPolicy {
+	if p.policy == CredentialsDefault {
+		return CredentialsRemove
+	}
+	return p.policy
+}
+
+func (p *PSK) sources() []TokenSource {
+	if len(p.tokenSources) == 0 {
+		return []TokenSource{DefaultTokenSource(p.authHeader)}
+	}
+	return p.tokenSources
+}
+
+// OptionalAuth wraps a provider so that requests without credentials are
+// passed upstream as anonymous instead of being rejected. Requests with
+// invalid credentials are still rejected.
+type OptionalAuth struct {
+	provider Provider
+}
+
+func Optional(p Provider) *OptionalAuth {
+	return &OptionalAuth{provider: p}
+}
+
+func (o *OptionalAuth) Handler() (Handler, error) {
+	a, ok := o.provider.(authenticator)
+	if !ok {
+		return nil, fmt.Errorf("auth provider %T does not support optional authentication", o.provider)
+	}
+	return authHandler(a, true)
+}
+
 var _ Provider = &NoAuth{}
 
 type NoAuth struct{}
@@ -50,8 +247,14 @@ func NoOp() *NoAuth {
 	return &NoAuth{}
 }
 
+// Handler passes every request upstream as anonymous. The identity headers
+// are removed like for any other provider, so they can't be spoofed.
 func (n NoAuth) Handler() (Handler, error) {
 	return func(h http.Handler) http.Handler {
-		return h
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			removeIdentity(r)
+			r.Header.Set(AuthStatusHeader, StatusAnonymous)
+			h.ServeHTTP(w, r)
+		})
 	}, nil
 }
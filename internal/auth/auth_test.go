@@ -2,37 +2,124 @@ package auth
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestPreSharedKeyAuthorized(t *testing.T) {
-	provider, err := testProvider(PreSharedKey("Authorization", "FooBar123_%"))
-
-	// correct header name and value
+	provider, err := testProvider(PreSharedKey("Authorization", "FooBar123_-"))
 	assert.NoError(t, err)
-	r1, err := provider.withRequest("Authorization", "FooBar123_%")
+
+	// the Authorization header requires the "Bearer" scheme, in any case
+	r1, err := provider.withRequest("Authorization", "Bearer FooBar123_-")
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, r1.Code)
 
-	// correct header name and value, allow prefix with "Bearer "
-	r2, err := provider.withRequest("Authorization", "Bearer FooBar123_%")
+	r2, err := provider.withRequest("Authorization", "bearer FooBar123_-")
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, r2.Code)
+
+	// any other header holds the bare key
+	provider, err = testProvider(PreSharedKey("X-Api-Key", "FooBar123_%"))
+	assert.NoError(t, err)
+	r3, err := provider.withRequest("X-Api-Key", "FooBar123_%")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r3.Code)
+
+	// a bare key in the Authorization header has to be asked for
+	provider, err = testProvider(PreSharedKey("Authorization", "FooBar123_%").
+		WithTokenSources(&HeaderTokenSource{Name: "Authorization", Scheme: "Bearer", SchemeOptional: true}))
+	assert.NoError(t, err)
+	r4, err := provider.withRequest("Authorization", "FooBar123_%")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r4.Code)
 }
 
 func TestPreSharedKeyUnauthorized(t *testing.T) {
-	provider, err := testProvider(PreSharedKey("Authorization", "FooBar123_%"))
+	provider, err := testProvider(PreSharedKey("Authorization", "FooBar123_-"))
 
 	// wrong header name
 	assert.NoError(t, err)
-	r1, err := provider.withRequest("Not-Authorization", "FooBar123_%")
+	r1, err := provider.withRequest("Not-Authorization", "Bearer FooBar123_-")
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusUnauthorized, r1.Code)
 
 	// mismatched header value
-	r2, err := provider.withRequest("Authorization", "Not-FooBar123_%")
+	r2, err := provider.withRequest("Authorization", "Bearer Not-FooBar123_-")
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusUnauthorized, r2.Code)
+
+	// malformed credentials: no scheme, another scheme or not a token68
+	for _, value := range []string{"FooBar123_-", "Basic FooBar123_-", "Bearer FooBar123_%"} {
+		r, err := provider.withRequest("Authorization", value)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, r.Code, value)
+	}
+}
+
+func TestPreSharedKeyTokenSources(t *testing.T) {
+	provider, err := testProvider(PreSharedKey("Authorization", "FooBar123").WithTokenSources(Cookie("key"), Query("key")))
+	assert.NoError(t, err)
+
+	r1, err := provider.withRequest("Cookie", "key=FooBar123")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r1.Code)
+
+	// the configured header is not used when token sources are set
+	r2, err := provider.withRequest("Authorization", "Bearer FooBar123")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r2.Code)
+}
+
+func TestPreSharedKeyNamed(t *testing.T) {
+	var subject string
+	h, err := PreSharedKey("Authorization", "").
+		WithNamedKey("billing", "FooBar123").
+		WithNamedKey("reports", "BarFoo321").
+		Handler()
+	assert.NoError(t, err)
+	server := h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject = r.Header.Get(AuthSubjectHeader)
+	}))
+
+	for key, name := range map[string]string{"FooBar123": "billing", "BarFoo321": "reports"} {
+		r, err := req("Authorization", "Bearer "+key)
+		assert.NoError(t, err)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, name, subject)
+	}
+
+	r, err := req("Authorization", "Bearer FooBar")
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	_, err = PreSharedKey("Authorization", "").Handler()
+	assert.Error(t, err)
+	_, err = PreSharedKey("Authorization", "").WithNamedKey("billing", " ").Handler()
+	assert.Error(t, err)
+}
+
+func TestNoOpRemovesIdentity(t *testing.T) {
+	h, err := NoOp().Handler()
+	assert.NoError(t, err)
+
+	var status, subject string
+	server := h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status = r.Header.Get(AuthStatusHeader)
+		subject = r.Header.Get(AuthSubjectHeader)
+	}))
+
+	r, err := req(AuthStatusHeader, StatusAuthenticated, AuthSubjectHeader, "admin")
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, StatusAnonymous, status)
+	assert.Empty(t, subject)
 }
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// AzureApp is an application pre-authorized to call the app in Entra ID, as
+// listed in AZURE_APP_PRE_AUTHORIZED_APPS.
+type AzureApp struct {
+	Name     string `json:"name"`
+	ClientID string `json:"clientId"`
+}
+
+// ParseAzureApps parses the JSON list of pre-authorized applications.
+func ParseAzureApps(s string) ([]AzureApp, error) {
+	var apps []AzureApp
+	if err := json.Unmarshal([]byte(s), &apps); err != nil {
+		return nil, fmt.Errorf("parsing pre-authorized apps: %w", err)
+	}
+	return apps, nil
+}
+
+// Azure returns a JWT provider for access tokens issued by Entra ID (Azure
+// AD) to the application with the client ID. The issuer and the keys come
+// from the discovery document of the tenant, tokens for another audience,
+// issuer or tenant are invalid.
+func Azure(wellKnownURL, clientID, tenantID string) (*JWTAuth, error) {
+	p, err := JWT("Authorization", "", map[string]any{"aud": clientID})
+	if err != nil {
+		return nil, err
+	}
+	p.ValidClaims = map[string]any{"tid": tenantID}
+	return p.WithDiscovery(wellKnownURL), nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAzure(t *testing.T) {
+	// Entra ID serves the tenant under '/<tenant>/v2.0'
+	f := newFakeIssuer(t, "/tenant/v2.0/.well-known/openid-configuration", "/tenant/v2.0")
+
+	p, err := Azure(f.wellKnownURL, "client", "tenant")
+	assert.NoError(t, err)
+	p.Allowed = []ClaimRule{
+		{Claim: "roles", Values: []string{"access_as_application", "admin"}},
+		{Claim: "azp", Values: []string{"caller"}},
+	}
+
+	valid := func() *Token {
+		return token(time.Now(), time.Hour).
+			with("iss", f.issuer).
+			with("aud", "client").
+			with("tid", "tenant").
+			with("azp", "caller").
+			with("roles", []string{"access_as_application"})
+	}
+	f.run(t, p, nil, []issuerTest{
+		{
+			name:       "valid",
+			token:      valid(),
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "other audience",
+			token:      valid().with("aud", "other"),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "other issuer",
+			token:      valid().with("iss", f.URL+"/other/v2.0"),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "other tenant",
+			token:      valid().with("tid", "other"),
+			statusCode: http.StatusUnauthorized,
+			challenge:  `error="invalid_token"`,
+		},
+		{
+			name:       "role not allowed",
+			token:      valid().with("roles", []string{"reader"}),
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "no roles",
+			token:      valid().with("roles", nil),
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "app not allowed",
+			token:      valid().with("azp", "other"),
+			statusCode: http.StatusForbidden,
+		},
+	})
+}
+
+func TestAzureDiscoveryFails(t *testing.T) {
+	f := newFakeIssuer(t, "/tenant/v2.0/.well-known/openid-configuration", "/tenant/v2.0")
+
+	p, err := Azure(f.URL+"/other/v2.0/.well-known/openid-configuration", "client", "tenant")
+	assert.NoError(t, err)
+	_, err = p.Handler()
+	assert.Error(t, err)
+}
+
+func TestParseAzureApps(t *testing.T) {
+	apps, err := ParseAzureApps(`[{"name":"dev-gcp:team:app","clientId":"1234"}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, []AzureApp{{Name: "dev-gcp:team:app", ClientID: "1234"}}, apps)
+
+	_, err = ParseAzureApps("dev-gcp:team:app")
+	assert.Error(t, err)
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nais/authproxy/internal/problem"
+)
+
+const DefaultRealm = "authproxy"
+
+// ErrForbidden is wrapped by errors for requests that are authenticated, but
+// not allowed.
+var ErrForbidden = errors.New("forbidden")
+
+// Error codes from RFC 6750 section 3.1.
+const (
+	ErrorCodeInvalidRequest    = "invalid_request"
+	ErrorCodeInvalidToken      = "invalid_token"
+	ErrorCodeInsufficientScope = "insufficient_scope"
+	// ErrorCodeInsufficientUserAuthentication is from RFC 9470.
+	ErrorCodeInsufficientUserAuthentication = "insufficient_user_authentication"
+)
+
+// Challenge is a WWW-Authenticate challenge as described in RFC 6750
+// section 3.
+type Challenge struct {
+	Scheme      string
+	Realm       string
+	Error       string
+	Description string
+	Params      []Param
+}
+
+type Param struct {
+	Key   string
+	Value string
+}
+
+func (c Challenge) String() string {
+	params := []Param{{"realm", c.Realm}}
+	// error codes are only defined for bearer tokens
+	if strings.EqualFold(c.Scheme, "Bearer") {
+		if c.Error != "" {
+			params = append(params, Param{"error", c.Error})
+		}
+		if c.Description != "" {
+			params = append(params, Param{"error_description", c.Description})
+		}
+		params = append(params, c.Params...)
+	}
+
+	s := make([]string, len(params))
+	for i, p := range params {
+		s[i] = fmt.Sprintf("%s=%s", p.Key, quote(p.Value))
+	}
+	return c.Scheme + " " + strings.Join(s, ", ")
+}
+
+// quote returns v as a quoted-string (RFC 9110 section 5.6.4).
+func quote(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(v) + `"`
+}
+
+// denier writes the response for rejected requests. Requests without
+// credentials get a bare challenge, malformed credentials are a bad request,
+// authenticated requests that aren't allowed are forbidden and logins that
+// are too weak must step up. Everything else is an invalid token.
+type denier struct {
+	provider string
+	scheme   string
+	realm    string
+}
+
+func newDenier(provider, realm string, sources []TokenSource) denier {
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	return denier{
+		provider: provider,
+		scheme:   challengeScheme(sources),
+		realm:    realm,
+	}
+}
+
+func (d denier) deny(w http.ResponseWriter, r *http.Request, err error) {
+	rejected(r.Context(), d.provider, err)
+
+	status, ch := d.challenge(err)
+	w.Header().Set("WWW-Authenticate", ch.String())
+	problem.Write(w, r, status, reasonOf(err), descriptionOf(err))
+}
+
+func (d denier) challenge(err error) (int, Challenge) {
+	ch := Challenge{
+		Scheme: d.scheme,
+		Realm:  d.realm,
+	}
+
+	var stepUp *StepUpError
+	switch {
+	case errors.Is(err, ErrMissingToken):
+		return http.StatusUnauthorized, ch
+	case errors.Is(err, ErrMalformedToken):
+		ch.Error = ErrorCodeInvalidRequest
+		ch.Description = descriptionOf(err)
+		return http.StatusBadRequest, ch
+	case errors.As(err, &stepUp):
+		ch.Error = ErrorCodeInsufficientUserAuthentication
+		ch.Description = descriptionOf(err)
+		ch.Params = stepUp.params()
+		return http.StatusUnauthorized, ch
+	case errors.Is(err, ErrForbidden):
+		ch.Error = ErrorCodeInsufficientScope
+		ch.Description = descriptionOf(err)
+		return http.StatusForbidden, ch
+	default:
+		ch.Error = ErrorCodeInvalidToken
+		ch.Description = descriptionOf(err)
+		return http.StatusUnauthorized, ch
+	}
+}
+
+// descriptionOf returns a short description of err that is safe to return
+// to clients, without details about the token or the keys.
+func descriptionOf(err error) string {
+	for _, r := range reasons {
+		if errors.Is(err, r.err) {
+			return r.err.Error()
+		}
+	}
+	return ErrInvalidToken.Error()
+}
+
+// challengeScheme is the scheme of the first header token source, "Bearer"
+// unless it is "Basic".
+func challengeScheme(sources []TokenSource) string {
+	for _, source := range sources {
+		if h, ok := source.(*HeaderTokenSource); ok && h.Scheme != "" {
+			if strings.EqualFold(h.Scheme, "Basic") {
+				return "Basic"
+			}
+			break
+		}
+	}
+	return "Bearer"
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChallengeString(t *testing.T) {
+	ch := Challenge{
+		Scheme:      "Bearer",
+		Realm:       "example",
+		Error:       ErrorCodeInvalidToken,
+		Description: `token "expired"`,
+	}
+	assert.Equal(t, `Bearer realm="example", error="invalid_token", error_description="token \"expired\""`, ch.String())
+
+	// error codes are not defined for basic auth
+	ch.Scheme = "Basic"
+	assert.Equal(t, `Basic realm="example"`, ch.String())
+}
+
+func TestDenier(t *testing.T) {
+	d := newDenier("test", "", []TokenSource{Header("Authorization", "Bearer")})
+
+	tests := []struct {
+		name      string
+		err       error
+		status    int
+		challenge string
+	}{
+		{
+			name:      "missing token",
+			err:       ErrMissingToken,
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="authproxy"`,
+		},
+		{
+			name:      "malformed token",
+			err:       fmt.Errorf("%w: details", ErrMalformedToken),
+			status:    http.StatusBadRequest,
+			challenge: `Bearer realm="authproxy", error="invalid_request", error_description="malformed token"`,
+		},
+		{
+			name:      "expired token",
+			err:       fmt.Errorf("%w: details", ErrTokenExpired),
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="authproxy", error="invalid_token", error_description="token expired"`,
+		},
+		{
+			name:      "details are not exposed",
+			err:       errors.New("signature verification failed for key 1234"),
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="authproxy", error="invalid_token", error_description="invalid token"`,
+		},
+		{
+			name:      "authenticated but not allowed",
+			err:       fmt.Errorf("%w: details", ErrForbidden),
+			status:    http.StatusForbidden,
+			challenge: `Bearer realm="authproxy", error="insufficient_scope", error_description="forbidden"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			d.deny(rr, httptest.NewRequest("GET", "/", nil), tt.err)
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Equal(t, tt.challenge, rr.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+func TestPreSharedKeyBasicChallenge(t *testing.T) {
+	provider, err := testProvider(PreSharedKey("Authorization", "FooBar123").WithRealm("api").WithTokenSources(Header("Authorization", "Basic")))
+	assert.NoError(t, err)
+
+	r1, err := provider.withRequest()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r1.Code)
+	assert.Equal(t, `Basic realm="api"`, r1.Header().Get("WWW-Authenticate"))
+}
+
+func TestJWTForbidden(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+
+	jwtProvider, err := JWT("Authorization", url, map[string]any{
+		"aud":   "yolo",
+		"group": "admins",
+	})
+	assert.NoError(t, err)
+	provider, err := testProvider(jwtProvider.WithJWKSCache(cache))
+	assert.NoError(t, err)
+
+	// valid token, but lacking the required claim value
+	t1, err := token(time.Now(), time.Hour).with("aud", "yolo").with("group", "users").sign(jwks)
+	assert.NoError(t, err)
+	r1, err := provider.withRequest("Authorization", "Bearer "+t1)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, r1.Code)
+	assert.Contains(t, r1.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+
+	// token for another audience is invalid
+	t2, err := token(time.Now(), time.Hour).with("aud", "other").with("group", "admins").sign(jwks)
+	assert.NoError(t, err)
+	r2, err := provider.withRequest("Authorization", "Bearer "+t2)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r2.Code)
+	assert.Contains(t, r2.Header().Get("WWW-Authenticate"), `error="invalid_token"`)
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ClaimRule allows a token if the claim, or any element of a list claim,
+// matches one of the values. A "*" in a value matches any characters, i.e.
+// "dev-gcp:team:*". Nested claims are given as a dotted path, i.e.
+// "consumer.ID".
+type ClaimRule struct {
+	Claim  string
+	Values []string
+}
+
+// Check returns an error wrapping ErrForbidden if the claims don't match.
+func (r ClaimRule) Check(claims map[string]any) error {
+	for _, v := range claimValues(claims, r.Claim) {
+		for _, pattern := range r.Values {
+			if matchPattern(pattern, v) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: claim %q not allowed", ErrForbidden, r.Claim)
+}
+
+// checkScopes returns an error wrapping ErrForbidden if any of the scopes
+// isn't granted.
+func checkScopes(claims map[string]any, scopes []string) error {
+	var granted []string
+	for _, claim := range []string{"scope", "scp"} {
+		for _, v := range claimValues(claims, claim) {
+			granted = append(granted, strings.Fields(v)...)
+		}
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			return fmt.Errorf("%w: scope %q not granted", ErrForbidden, scope)
+		}
+	}
+	return nil
+}
+
+// lookupClaim returns the claim at path. A claim named like the path wins,
+// claim names may contain dots.
+func lookupClaim(claims map[string]any, path string) (any, bool) {
+	if v, ok := claims[path]; ok {
+		return v, true
+	}
+	var v any = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// claimValues returns the claim as strings, one for each element of a list
+// claim. Values without a string representation are left out.
+func claimValues(claims map[string]any, path string) []string {
+	v, ok := lookupClaim(claims, path)
+	if !ok {
+		return nil
+	}
+	var values []string
+	switch v := v.(type) {
+	case []any:
+		for _, e := range v {
+			if s, ok := claimString(e); ok {
+				values = append(values, s)
+			}
+		}
+	case []string:
+		values = v
+	default:
+		if s, ok := claimString(v); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+func claimString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int, int64, uint, uint64:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
+
+// matchPattern matches s against a pattern where "*" matches any characters.
+func matchPattern(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimRule(t *testing.T) {
+	claims := map[string]any{
+		"groups":                          []any{"admins", "users"},
+		"azp":                             "dev-gcp:team:app",
+		"consumer":                        map[string]any{"ID": "0192:889640782"},
+		"level":                           float64(4),
+		"https://example.com/claims.role": "admin",
+	}
+
+	tests := []struct {
+		name    string
+		rule    ClaimRule
+		allowed bool
+	}{
+		{name: "value", rule: ClaimRule{Claim: "azp", Values: []string{"other", "dev-gcp:team:app"}}, allowed: true},
+		{name: "list element", rule: ClaimRule{Claim: "groups", Values: []string{"admins"}}, allowed: true},
+		{name: "wildcard", rule: ClaimRule{Claim: "azp", Values: []string{"dev-gcp:*:app"}}, allowed: true},
+		{name: "trailing wildcard", rule: ClaimRule{Claim: "azp", Values: []string{"dev-gcp:team:*"}}, allowed: true},
+		{name: "nested", rule: ClaimRule{Claim: "consumer.ID", Values: []string{"0192:889640782"}}, allowed: true},
+		{name: "dotted name", rule: ClaimRule{Claim: "https://example.com/claims.role", Values: []string{"admin"}}, allowed: true},
+		{name: "number", rule: ClaimRule{Claim: "level", Values: []string{"4"}}, allowed: true},
+		{name: "no match", rule: ClaimRule{Claim: "groups", Values: []string{"other"}}},
+		{name: "wildcard no match", rule: ClaimRule{Claim: "azp", Values: []string{"prod-gcp:*"}}},
+		{name: "partial", rule: ClaimRule{Claim: "azp", Values: []string{"dev-gcp:team"}}},
+		{name: "missing", rule: ClaimRule{Claim: "roles", Values: []string{"*"}}},
+		{name: "missing nested", rule: ClaimRule{Claim: "consumer.name", Values: []string{"*"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Check(claims)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, ErrForbidden), "expected forbidden, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckScopes(t *testing.T) {
+	assert.NoError(t, checkScopes(map[string]any{"scope": "read write"}, []string{"write", "read"}))
+	assert.NoError(t, checkScopes(map[string]any{"scp": []any{"read", "write"}}, []string{"write"}))
+	assert.NoError(t, checkScopes(map[string]any{}, nil))
+	assert.ErrorIs(t, checkScopes(map[string]any{"scope": "read"}, []string{"read", "write"}), ErrForbidden)
+	assert.ErrorIs(t, checkScopes(map[string]any{}, []string{"read"}), ErrForbidden)
+}
+
+func TestMatchPattern(t *testing.T) {
+	assert.True(t, matchPattern("*", ""))
+	assert.True(t, matchPattern("a*b*c", "abc"))
+	assert.True(t, matchPattern("a*b*c", "axxbyyc"))
+	assert.False(t, matchPattern("a*b*c", "axxc"))
+	assert.False(t, matchPattern("a*a", "a"))
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CredentialPolicy decides whether the credential of an authenticated request
+// is passed upstream.
+type CredentialPolicy string
+
+const (
+	// CredentialsDefault uses the default of the provider, pre shared keys
+	// are removed and tokens are kept.
+	CredentialsDefault CredentialPolicy = ""
+	CredentialsKeep    CredentialPolicy = "keep"
+	CredentialsRemove  CredentialPolicy = "remove"
+)
+
+func ParseCredentialPolicy(s string) (CredentialPolicy, error) {
+	switch p := CredentialPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case CredentialsDefault, CredentialsKeep, CredentialsRemove:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown credential policy %q, expected 'keep' or 'remove'", s)
+	}
+}
+
+// removeCredentials removes what the sources read a token from: headers,
+// cookies and the token subprotocol of Sec-WebSocket-Protocol. Query
+// parameters are already removed when the token is read.
+func removeCredentials(r *http.Request, sources []TokenSource) {
+	for _, source := range sources {
+		switch s := source.(type) {
+		case *HeaderTokenSource:
+			r.Header.Del(s.Name)
+		case *CookieTokenSource:
+			removeCookie(r, s.Name)
+		case *QueryTokenSource:
+			_, _ = s.Token(r)
+		case *WebSocketTokenSource:
+			removeWebSocketToken(r, s.Prefix)
+		}
+	}
+}
+
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// removeWebSocketToken keeps the other subprotocols, the upstream has to
+// echo one of them to complete the handshake.
+func removeWebSocketToken(r *http.Request, prefix string) {
+	var protocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if protocol != "" && !strings.HasPrefix(protocol, prefix) {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	r.Header.Del("Sec-WebSocket-Protocol")
+	if len(protocols) > 0 {
+		r.Header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+	}
+}
+
+// queryOnly returns the query parameter sources, those tokens never reach the
+// upstream whatever the policy.
+func queryOnly(sources []TokenSource) []TokenSource {
+	var query []TokenSource
+	for _, source := range sources {
+		if _, ok := source.(*QueryTokenSource); ok {
+			query = append(query, source)
+		}
+	}
+	return query
+}
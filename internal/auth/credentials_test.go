@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialPolicy(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+	valid, err := token(time.Now(), time.Hour).with("aud", "yolo").sign(jwks)
+	assert.NoError(t, err)
+
+	jwtProvider := func(policy CredentialPolicy) Provider {
+		p, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+		assert.NoError(t, err)
+		p.WithJWKSCache(cache).WithTokenSources(
+			Header("Authorization", "Bearer"),
+			Cookie("token"),
+			Query("access_token"),
+			WebSocketProtocol(""),
+		)
+		p.Credentials = policy
+		return p
+	}
+	protocol := KubernetesWebSocketPrefix + base64.RawURLEncoding.EncodeToString([]byte(valid))
+
+	tests := []struct {
+		name     string
+		provider Provider
+		target   string
+		headers  []string
+		want     http.Header
+	}{
+		{
+			name:     "pre shared key is removed by default",
+			provider: PreSharedKey("X-Api-Key", "FooBar123"),
+			headers:  []string{"X-Api-Key", "FooBar123"},
+			want:     http.Header{},
+		},
+		{
+			name:     "pre shared key can be kept",
+			provider: PreSharedKey("X-Api-Key", "FooBar123").WithCredentialPolicy(CredentialsKeep),
+			headers:  []string{"X-Api-Key", "FooBar123"},
+			want:     http.Header{"X-Api-Key": {"FooBar123"}},
+		},
+		{
+			name:     "token is kept by default",
+			provider: jwtProvider(CredentialsDefault),
+			headers:  []string{"Authorization", "Bearer " + valid},
+			want:     http.Header{"Authorization": {"Bearer " + valid}},
+		},
+		{
+			name:     "token header is removed",
+			provider: jwtProvider(CredentialsRemove),
+			headers:  []string{"Authorization", "Bearer " + valid},
+			want:     http.Header{},
+		},
+		{
+			name:     "token cookie is removed",
+			provider: jwtProvider(CredentialsRemove),
+			headers:  []string{"Cookie", "other=1; token=" + valid},
+			want:     http.Header{"Cookie": {"other=1"}},
+		},
+		{
+			name:     "websocket token is removed",
+			provider: jwtProvider(CredentialsRemove),
+			headers:  []string{"Sec-WebSocket-Protocol", "base64.channel.k8s.io, " + protocol},
+			want:     http.Header{"Sec-Websocket-Protocol": {"base64.channel.k8s.io"}},
+		},
+		{
+			name:     "query token never reaches the upstream",
+			provider: jwtProvider(CredentialsKeep),
+			target:   "/?access_token=" + valid + "&page=2",
+			want:     http.Header{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := tt.provider.Handler()
+			assert.NoError(t, err)
+
+			var upstream *http.Request
+			srv := h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r
+			}))
+			target := tt.target
+			if target == "" {
+				target = "/"
+			}
+			r := httptest.NewRequest("GET", target, nil)
+			for i := 0; i < len(tt.headers); i += 2 {
+				r.Header.Set(tt.headers[i], tt.headers[i+1])
+			}
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			upstream.Header.Del(AuthStatusHeader)
+			upstream.Header.Del(AuthSubjectHeader)
+			assert.Equal(t, tt.want, upstream.Header)
+			assert.NotContains(t, upstream.URL.RawQuery, "access_token")
+		})
+	}
+}
+
+func TestShadowRemovesQueryToken(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, _ := jwksCache(url)
+	jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+	jwtProvider.WithJWKSCache(cache).WithTokenSources(Query("access_token"))
+
+	h, err := Shadow(PreSharedKey("X-Api-Key", "FooBar123"), jwtProvider).Handler()
+	assert.NoError(t, err)
+
+	var query string
+	srv := h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+	}))
+	r := httptest.NewRequest("GET", "/?access_token=abc&page=2", nil)
+	r.Header.Set("X-Api-Key", "FooBar123")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "page=2", query)
+}
+
+func TestParseCredentialPolicy(t *testing.T) {
+	for s, want := range map[string]CredentialPolicy{"": CredentialsDefault, "Keep": CredentialsKeep, "remove": CredentialsRemove} {
+		got, err := ParseCredentialPolicy(s)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := ParseCredentialPolicy("replace")
+	assert.Error(t, err)
+}
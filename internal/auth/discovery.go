@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ProviderMetadata is the subset of the OpenID Connect discovery document
+// used by authproxy.
+type ProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint,omitempty"`
+}
+
+// Discover fetches the OpenID Connect discovery document of an issuer. As
+// required by the spec, the issuer in the document must match.
+func Discover(ctx context.Context, client *http.Client, issuer string) (*ProviderMetadata, error) {
+	m, err := fetchMetadata(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	if m.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", m.Issuer, issuer)
+	}
+	return m, nil
+}
+
+// DiscoverURL fetches a discovery document from its well-known URL, either
+// OpenID Connect discovery or RFC 8414 authorization server metadata. The
+// issuer isn't known up front, but the URL must be under the issuer.
+func DiscoverURL(ctx context.Context, client *http.Client, wellKnownURL string) (*ProviderMetadata, error) {
+	m, err := fetchMetadata(ctx, client, wellKnownURL)
+	if err != nil {
+		return nil, err
+	}
+	if m.Issuer == "" || !strings.HasPrefix(wellKnownURL, strings.TrimSuffix(m.Issuer, "/")+"/") {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", m.Issuer, wellKnownURL)
+	}
+	if m.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+	return m, nil
+}
+
+func fetchMetadata(ctx context.Context, client *http.Client, url string) (*ProviderMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching discovery document from %s: %s", url, resp.Status)
+	}
+
+	var m ProviderMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decoding discovery document: %w", err)
+	}
+	return &m, nil
+}
@@ -10,11 +10,14 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"testing"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/stretchr/testify/assert"
 )
 
 type TestProvider struct {
@@ -113,6 +116,48 @@ func (t *Token) sign(set jwk.Set) (string, error) {
 	return string(signedToken), nil
 }
 
+// signWithHeaders signs the token with the first key in the set, adding the
+// given protected headers. The "kid" header is taken from the key, so it is
+// replaced on a copy of the key instead, and a nil key ID removes it.
+func (t *Token) signWithHeaders(set jwk.Set, headers map[string]any) (string, error) {
+	signer, ok := set.Key(0)
+	if !ok {
+		return "", fmt.Errorf("could not get signer")
+	}
+	signer, err := signer.Clone()
+	if err != nil {
+		return "", err
+	}
+
+	hdrs := jws.NewHeaders()
+	for k, v := range headers {
+		if k == jws.KeyIDKey {
+			if v == nil {
+				err = signer.Remove(jwk.KeyIDKey)
+			} else {
+				err = signer.Set(jwk.KeyIDKey, v)
+			}
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err := hdrs.Set(k, v); err != nil {
+			return "", err
+		}
+	}
+
+	tok, err := t.Clone()
+	if err != nil {
+		return "", err
+	}
+	signedToken, err := jwt.Sign(tok, jwt.WithKey(jwa.ES256, signer, jws.WithProtectedHeaders(hdrs)))
+	if err != nil {
+		return "", err
+	}
+	return string(signedToken), nil
+}
+
 func (t *Token) with(key string, value any) *Token {
 	t.Set(key, value)
 	return t
@@ -136,3 +181,80 @@ func newJwkSet(kid string) (jwk.Set, error) {
 	privateKeys.AddKey(key)
 	return privateKeys, nil
 }
+
+// fakeIssuer serves the metadata document of an issuer at a well-known path
+// and its keys, the way the identity providers of the platform do.
+type fakeIssuer struct {
+	*httptest.Server
+	keys         jwk.Set
+	issuer       string
+	wellKnownURL string
+}
+
+func newFakeIssuer(t *testing.T, wellKnownPath, issuerPath string) *fakeIssuer {
+	keys, err := newJwkSet("issuer")
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	f := &fakeIssuer{Server: httptest.NewServer(mux), keys: keys}
+	t.Cleanup(f.Close)
+	f.issuer = f.URL + issuerPath
+	f.wellKnownURL = f.URL + wellKnownPath
+	mux.HandleFunc(wellKnownPath, func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(ProviderMetadata{Issuer: f.issuer, JWKSURI: f.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(jsonOf(t, keys))
+	})
+	return f
+}
+
+type issuerTest struct {
+	name       string
+	path       string
+	token      *Token
+	statusCode int
+	challenge  string
+	// upstream are the identity headers the upstream gets, an empty value
+	// for a header that must be missing
+	upstream map[string]string
+}
+
+// run sends the tokens signed by the issuer through the provider. Every
+// identity header is also sent by the client, it must never reach the
+// upstream unless set from the token.
+func (f *fakeIssuer) run(t *testing.T, p Provider, identity IdentityHeaders, tests []issuerTest) {
+	provider, err := testProvider(p)
+	assert.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, err := tt.token.sign(f.keys)
+			assert.NoError(t, err)
+			r, err := req("Authorization", "Bearer "+signed)
+			assert.NoError(t, err)
+			if tt.path != "" {
+				r.URL.Path = tt.path
+			}
+			for _, h := range identity {
+				r.Header.Set(h.Name, "spoofed")
+			}
+
+			var upstream http.Header
+			rr := httptest.NewRecorder()
+			provider.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identity.Apply(r)
+				upstream = r.Header
+			})).ServeHTTP(rr, r)
+
+			assert.Equal(t, tt.statusCode, rr.Code)
+			assert.Contains(t, rr.Header().Get("WWW-Authenticate"), tt.challenge)
+			if tt.statusCode == http.StatusForbidden {
+				assert.Contains(t, rr.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+			}
+			for name, value := range tt.upstream {
+				assert.Equal(t, value, upstream.Get(name), name)
+			}
+		})
+	}
+}
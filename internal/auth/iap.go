@@ -2,71 +2,240 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	"google.golang.org/api/idtoken"
 )
 
-var _ Provider = &GoogleIAP{}
+var _ authenticator = &GoogleIAP{}
+
+const (
+	// IAPClockSkew is the default leeway for the "iat" and "nbf" claims of IAP
+	// tokens, "exp" is checked without leeway.
+	IAPClockSkew = 30 * time.Second
+	IAPHeader    = "X-Goog-IAP-JWT-Assertion"
+	IAPIssuer    = "https://cloud.google.com/iap"
+)
+
+// BackendServiceAudience is the IAP audience for a backend service, i.e.
+// behind a load balancer or in GKE.
+func BackendServiceAudience(projectNumber, backendServiceID string) string {
+	return fmt.Sprintf("/projects/%s/global/backendServices/%s", projectNumber, backendServiceID)
+}
+
+// AppEngineAudience is the IAP audience for an App Engine app.
+func AppEngineAudience(projectNumber, projectID string) string {
+	return fmt.Sprintf("/projects/%s/apps/%s", projectNumber, projectID)
+}
 
 type GoogleIAP struct {
-	aud       string
-	validator *idtoken.Validator
+	// Header is the header IAP passes the signed assertion in.
+	Header string
+	Issuer string
+	// Audiences are the accepted "aud" values, see BackendServiceAudience
+	// and AppEngineAudience.
+	Audiences []string
+	// AllowedEmails, if set, only allows these users.
+	AllowedEmails []string
+	// AllowedDomains, if set, only allows users of these Google Workspace
+	// domains, from the "hd" claim.
+	AllowedDomains []string
+	Policy         TokenPolicy
+	// Realm is used in WWW-Authenticate challenges.
+	Realm string
+	// Credentials is whether the token is passed upstream, it is kept by
+	// default.
+	Credentials CredentialPolicy
+	validator   *idtoken.Validator
+	keySources  []KeySource
+	keys        *keyRing
 }
 
-func IAP(aud string) *GoogleIAP {
+func IAP(audiences ...string) *GoogleIAP {
 	return &GoogleIAP{
-		aud: aud,
+		Header:    IAPHeader,
+		Issuer:    IAPIssuer,
+		Audiences: audiences,
+		Policy: TokenPolicy{
+			ClockSkew:    IAPClockSkew,
+			StrictExpiry: true,
+			RequireExp:   true,
+			RequireIat:   true,
+		},
 	}
 }
 
 func (p *GoogleIAP) Handler() (Handler, error) {
-	if p.validator == nil {
+	return authHandler(p, false)
+}
+
+func (p *GoogleIAP) Authenticate(r *http.Request) (*Principal, error) {
+	jwt, err := extractToken(r, p.sources())
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := p.verify(r.Context(), jwt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.Policy.Check(time.Now(), iapTimeClaims(payload)); err != nil {
+		return nil, err
+	}
+
+	if payload.Issuer != p.Issuer {
+		return nil, fmt.Errorf("invalid issuer %q", payload.Issuer)
+	}
+	if !slices.Contains(p.Audiences, payload.Audience) {
+		return nil, fmt.Errorf("invalid audience %q", payload.Audience)
+	}
+	if err := p.checkUser(payload.Claims); err != nil {
+		return nil, err
+	}
+
+	return &Principal{
+		Provider: "iap",
+		Subject:  payload.Subject,
+		Claims:   payload.Claims,
+	}, nil
+}
+
+func (p *GoogleIAP) setup() (denier, error) {
+	if len(p.Audiences) == 0 {
+		return denier{}, errors.New("no audiences configured for IAP auth provider")
+	}
+	if p.validator == nil && len(p.keySources) == 0 {
 		v, err := idtoken.NewValidator(context.Background())
 		if err != nil {
-			return nil, err
+			return denier{}, err
 		}
 		p.validator = v
 	}
+	p.keys = newKeyRing(p.keySources...)
+	return newDenier("iap", p.Realm, p.sources()), nil
+}
 
-	return func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			jwt := r.Header.Get("X-Goog-IAP-JWT-Assertion")
-
-			if jwt == "" {
-				log.Debugf("no JWT token found in request")
-				http.Error(w, fmt.Sprintf("missing token from header %s", "X-Goog-IAP-JWT-Assertion"), http.StatusUnauthorized)
-				return
-			}
-
-			payload, err := p.validator.Validate(r.Context(), jwt, p.aud)
-			if err != nil {
-				log.Debugf("invalid JWT token: %v", err)
-				http.Error(w, "invalid token", http.StatusUnauthorized)
-				return
-			}
-
-			if time.Unix(payload.IssuedAt, 0).After(time.Now().Add(30 * time.Second)) {
-				log.Debugf("JWT token is in the future")
-				http.Error(w, "JWT token is in the future", http.StatusUnauthorized)
-				return
-			}
-
-			if payload.Issuer != "https://cloud.google.com/iap" {
-				log.Debugf("invalid JWT token issuer")
-				http.Error(w, "Invalid JWT token issuer", http.StatusUnauthorized)
-				return
-			}
-
-			h.ServeHTTP(w, r)
-		})
-	}, nil
+func (p *GoogleIAP) credentials() CredentialPolicy {
+	return p.Credentials
+}
+
+func (p *GoogleIAP) SetCredentialPolicy(policy CredentialPolicy) {
+	p.Credentials = policy
+}
+
+func (p *GoogleIAP) sources() []TokenSource {
+	header := p.Header
+	if header == "" {
+		header = IAPHeader
+	}
+	return []TokenSource{Header(header, "")}
+}
+
+// verify checks the signature of the assertion, with Google's published
+// keys unless key sources are set. The audience is checked by the caller, as
+// several audiences may be accepted.
+func (p *GoogleIAP) verify(ctx context.Context, raw string) (*idtoken.Payload, error) {
+	if len(p.keySources) == 0 {
+		return p.validator.Validate(ctx, raw, "")
+	}
+
+	msg, err := jws.ParseString(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Signatures()) != 1 {
+		return nil, errors.New("expected exactly one signature")
+	}
+	// IAP only signs with ES256
+	if alg := msg.Signatures()[0].ProtectedHeaders().Algorithm(); alg != jwa.ES256 {
+		return nil, fmt.Errorf("signing algorithm %q not allowed", alg)
+	}
+
+	keys, err := p.keys.Keys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	t, err := jwt.ParseString(raw, jwt.WithKeyProvider(keysFor(keys)), jwt.WithValidate(false))
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	payload := &idtoken.Payload{
+		Issuer:  t.Issuer(),
+		Subject: t.Subject(),
+		Claims:  claims,
+	}
+	if aud := t.Audience(); len(aud) == 1 {
+		payload.Audience = aud[0]
+	}
+	if !t.Expiration().IsZero() {
+		payload.Expires = t.Expiration().Unix()
+	}
+	if !t.IssuedAt().IsZero() {
+		payload.IssuedAt = t.IssuedAt().Unix()
+	}
+	return payload, nil
+}
+
+// checkUser applies the email and hosted domain restrictions, a user that
+// isn't allowed is forbidden.
+func (p *GoogleIAP) checkUser(claims map[string]any) error {
+	if len(p.AllowedEmails) > 0 {
+		email, _ := claims["email"].(string)
+		if !slices.ContainsFunc(p.AllowedEmails, func(allowed string) bool { return strings.EqualFold(allowed, email) }) {
+			return fmt.Errorf("%w: email %q not allowed", ErrForbidden, email)
+		}
+	}
+	if len(p.AllowedDomains) > 0 {
+		hd, _ := claims["hd"].(string)
+		if !slices.ContainsFunc(p.AllowedDomains, func(allowed string) bool { return strings.EqualFold(allowed, hd) }) {
+			return fmt.Errorf("%w: hosted domain %q not allowed", ErrForbidden, hd)
+		}
+	}
+	return nil
+}
+
+func iapTimeClaims(payload *idtoken.Payload) TimeClaims {
+	var c TimeClaims
+	if payload.IssuedAt != 0 {
+		c.IssuedAt = time.Unix(payload.IssuedAt, 0)
+	}
+	if payload.Expires != 0 {
+		c.Expiration = time.Unix(payload.Expires, 0)
+	}
+	if nbf, ok := payload.Claims["nbf"].(float64); ok {
+		c.NotBefore = time.Unix(int64(nbf), 0)
+	}
+	return c
 }
 
 func (p *GoogleIAP) WithValidator(v *idtoken.Validator) *GoogleIAP {
 	p.validator = v
 	return p
 }
+
+// WithKeySources verifies assertions with the keys from the given sources
+// instead of fetching Google's published keys, e.g. a JWKS file for local
+// testing.
+func (p *GoogleIAP) WithKeySources(sources ...KeySource) *GoogleIAP {
+	p.keySources = append(p.keySources, sources...)
+	return p
+}
@@ -3,10 +3,12 @@ package auth
 import (
 	"context"
 	"net/http"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/api/idtoken"
 	"google.golang.org/api/option"
@@ -124,3 +126,143 @@ func iapToken(iat time.Time, exp time.Duration, aud string) *Token {
 	accessToken.Set("email", "user@nais.io")
 	return &Token{accessToken}
 }
+
+func TestIAPWithKeySources(t *testing.T) {
+	jwks, err := newJwkSet("1234")
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJwks(t, path, jwks)
+	source, err := FileKeys(path)
+	assert.NoError(t, err)
+
+	backend := BackendServiceAudience("123456", "987")
+	appEngine := AppEngineAudience("123456", "my-project")
+	assert.Equal(t, "/projects/123456/global/backendServices/987", backend)
+	assert.Equal(t, "/projects/123456/apps/my-project", appEngine)
+
+	iap := IAP(backend, appEngine).WithKeySources(source)
+	iap.Header = "X-Iap-Assertion"
+	provider, err := testProvider(iap)
+	assert.NoError(t, err)
+
+	other, err := newJwkSet("1234")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		header string
+		token  func() (string, error)
+		status int
+	}{
+		{
+			name:   "backend service audience",
+			header: "X-Iap-Assertion",
+			token:  defaultIapToken(backend).signer(jwks),
+			status: http.StatusOK,
+		},
+		{
+			name:   "app engine audience",
+			header: "X-Iap-Assertion",
+			token:  defaultIapToken(appEngine).signer(jwks),
+			status: http.StatusOK,
+		},
+		{
+			name:   "other audience",
+			header: "X-Iap-Assertion",
+			token:  defaultIapToken("/projects/123456/apps/other").signer(jwks),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "expired within clock skew",
+			header: "X-Iap-Assertion",
+			token:  iapToken(time.Now().Add(-time.Minute), 50*time.Second, backend).signer(jwks),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "unknown key",
+			header: "X-Iap-Assertion",
+			token:  defaultIapToken(backend).signer(other),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "default header is ignored",
+			header: IAPHeader,
+			token:  defaultIapToken(backend).signer(jwks),
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.token()
+			assert.NoError(t, err)
+			r, err := provider.withRequest(tt.header, token)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, r.Code)
+		})
+	}
+}
+
+func TestIAPAllowedUsers(t *testing.T) {
+	jwks, err := newJwkSet("1234")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		emails  []string
+		domains []string
+		status  int
+	}{
+		{
+			name:   "allowed email",
+			emails: []string{"someone@nais.io", "User@nais.io"},
+			status: http.StatusOK,
+		},
+		{
+			name:   "other email",
+			emails: []string{"someone@nais.io"},
+			status: http.StatusForbidden,
+		},
+		{
+			name:    "allowed domain",
+			domains: []string{"whatevs.com"},
+			status:  http.StatusOK,
+		},
+		{
+			name:    "other domain",
+			domains: []string{"nais.io"},
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "email and domain must both match",
+			emails:  []string{"user@nais.io"},
+			domains: []string{"nais.io"},
+			status:  http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iap := IAP("google_iap_audience").WithKeySources(StaticKeys(jwks))
+			iap.AllowedEmails = tt.emails
+			iap.AllowedDomains = tt.domains
+			provider, err := testProvider(iap)
+			assert.NoError(t, err)
+
+			token, err := defaultIapToken("google_iap_audience").sign(jwks)
+			assert.NoError(t, err)
+			r, err := provider.withRequest(IAPHeader, token)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, r.Code)
+		})
+	}
+}
+
+func TestIAPWithoutAudiences(t *testing.T) {
+	_, err := IAP().Handler()
+	assert.Error(t, err)
+}
+
+func (t *Token) signer(set jwk.Set) func() (string, error) {
+	return func() (string, error) { return t.sign(set) }
+}
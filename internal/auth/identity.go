@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+)
+
+// IdentityHeader sets an upstream request header from a claim of the
+// principal.
+type IdentityHeader struct {
+	Name  string
+	Claim string
+	// TrimPrefix is removed from the value, i.e. the ISO 6523 scheme of an
+	// organisation number.
+	TrimPrefix string
+}
+
+// IdentityHeaders forwards the verified identity to the upstream.
+type IdentityHeaders []IdentityHeader
+
+// Apply removes the headers from the request and sets them again from the
+// principal of an authenticated request, so clients can never set them
+// themselves. Claims that are missing or have no string representation are
+// left out, list claims are joined with commas.
+func (h IdentityHeaders) Apply(r *http.Request) {
+	for _, header := range h {
+		r.Header.Del(header.Name)
+	}
+
+	principal, ok := PrincipalFrom(r.Context())
+	if !ok {
+		return
+	}
+	for _, header := range h {
+		value, ok := principal.claim(header.Claim)
+		if !ok || strings.ContainsAny(value, "\r\n\x00") {
+			continue
+		}
+		r.Header.Set(header.Name, strings.TrimPrefix(value, header.TrimPrefix))
+	}
+}
+
+// claim returns the claim as a header value. The subject is used for "sub"
+// if the principal has no claims, i.e. the key name for pre shared keys.
+func (p *Principal) claim(name string) (string, bool) {
+	if _, ok := lookupClaim(p.Claims, name); !ok {
+		if name == "sub" && p.Subject != "" {
+			return p.Subject, true
+		}
+		return "", false
+	}
+	values := claimValues(p.Claims, name)
+	return strings.Join(values, ","), len(values) > 0
+}
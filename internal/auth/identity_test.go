@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityHeadersApply(t *testing.T) {
+	headers := IdentityHeaders{
+		{Name: "X-Auth-Request-User", Claim: "sub"},
+		{Name: "X-Auth-Request-Email", Claim: "email"},
+		{Name: "X-Auth-Request-Groups", Claim: "groups"},
+		{Name: "X-Auth-Request-Level", Claim: "level"},
+		{Name: "X-Auth-Consumer-Orgno", Claim: "consumer.ID", TrimPrefix: "0192:"},
+	}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		want      map[string]string
+	}{
+		{
+			name: "anonymous",
+			want: map[string]string{},
+		},
+		{
+			name: "claims",
+			principal: &Principal{
+				Subject: "alice",
+				Claims: map[string]any{
+					"sub":    "alice",
+					"email":  "alice@example.com",
+					"groups": []any{"admins", "users", map[string]any{"nested": true}},
+					"level":  float64(4),
+				},
+			},
+			want: map[string]string{
+				"X-Auth-Request-User":   "alice",
+				"X-Auth-Request-Email":  "alice@example.com",
+				"X-Auth-Request-Groups": "admins,users",
+				"X-Auth-Request-Level":  "4",
+			},
+		},
+		{
+			name: "nested claim",
+			principal: &Principal{
+				Claims: map[string]any{"consumer": map[string]any{"ID": "0192:889640782"}},
+			},
+			want: map[string]string{"X-Auth-Consumer-Orgno": "889640782"},
+		},
+		{
+			name:      "subject without claims",
+			principal: &Principal{Provider: "key", Subject: "billing"},
+			want:      map[string]string{"X-Auth-Request-User": "billing"},
+		},
+		{
+			name: "values that can't be headers are left out",
+			principal: &Principal{
+				Claims: map[string]any{"sub": "alice\r\nX-Injected: yes", "groups": []any{}},
+			},
+			want: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := req(
+				"X-Auth-Request-User", "mallory",
+				"X-Auth-Request-Email", "mallory@example.com",
+				"X-Auth-Request-Groups", "admins",
+			)
+			assert.NoError(t, err)
+			if tt.principal != nil {
+				r = r.WithContext(WithPrincipal(r.Context(), tt.principal))
+			}
+
+			headers.Apply(r)
+
+			got := map[string]string{}
+			for _, h := range headers {
+				if v := r.Header.Get(h.Name); v != "" {
+					got[h.Name] = v
+				}
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Empty(t, r.Header.Get("X-Injected"))
+		})
+	}
+}
+
+func TestIdentityHeadersApplyNone(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	assert.NoError(t, err)
+	r.Header.Set("X-Auth-Request-User", "mallory")
+	IdentityHeaders(nil).Apply(r)
+	assert.Equal(t, "mallory", r.Header.Get("X-Auth-Request-User"))
+}
@@ -0,0 +1,25 @@
+package auth
+
+// IDPortenLevels are the ID-porten levels of assurance in the "acr" claim,
+// from the weakest to the strongest.
+var IDPortenLevels = []string{"idporten-loa-substantial", "idporten-loa-high"}
+
+// DefaultIDPortenLevel is the level of assurance required unless configured.
+const DefaultIDPortenLevel = "idporten-loa-high"
+
+// IDPorten returns a JWT provider for ID-porten access tokens for the
+// audience, issued to the client. The issuer and the keys come from the
+// well-known URL, and every path requires at least the level of assurance,
+// a weaker login must step up.
+func IDPorten(wellKnownURL, audience, clientID, level string) (*JWTAuth, error) {
+	p, err := JWT("Authorization", "", map[string]any{"aud": audience})
+	if err != nil {
+		return nil, err
+	}
+	p.Allowed = []ClaimRule{{Claim: "client_id", Values: []string{clientID}}}
+	p.StepUp = &StepUpPolicy{
+		Levels: IDPortenLevels,
+		Rules:  []StepUpRule{{PathPrefix: "/", ACRValues: []string{level}}},
+	}
+	return p.WithDiscovery(wellKnownURL), nil
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDPorten(t *testing.T) {
+	f := newFakeIssuer(t, "/.well-known/openid-configuration", "/")
+
+	p, err := IDPorten(f.wellKnownURL, "https://app.example.com", "client", "idporten-loa-substantial")
+	assert.NoError(t, err)
+	p.StepUp.Rules = append(p.StepUp.Rules, StepUpRule{PathPrefix: "/payments", ACRValues: []string{"idporten-loa-high"}})
+
+	valid := func() *Token {
+		return token(time.Now(), time.Hour).
+			with("iss", f.issuer).
+			with("aud", "https://app.example.com").
+			with("client_id", "client").
+			with("acr", "idporten-loa-substantial").
+			with("pid", "12345678910")
+	}
+	identity := IdentityHeaders{{Name: "X-Auth-Pid", Claim: "pid"}}
+	f.run(t, p, identity, []issuerTest{
+		{
+			name:       "substantial",
+			token:      valid(),
+			statusCode: http.StatusOK,
+			upstream:   map[string]string{"X-Auth-Pid": "12345678910"},
+		},
+		{
+			name:       "high",
+			token:      valid().with("acr", "idporten-loa-high"),
+			statusCode: http.StatusOK,
+			upstream:   map[string]string{"X-Auth-Pid": "12345678910"},
+		},
+		{
+			name:       "no pid",
+			token:      valid().with("pid", nil),
+			statusCode: http.StatusOK,
+			upstream:   map[string]string{"X-Auth-Pid": ""},
+		},
+		{
+			name:       "too weak",
+			token:      valid().with("acr", "idporten-loa-low"),
+			statusCode: http.StatusUnauthorized,
+			challenge:  `acr_values="idporten-loa-substantial idporten-loa-high"`,
+		},
+		{
+			name:       "step up",
+			path:       "/payments/1",
+			token:      valid(),
+			statusCode: http.StatusUnauthorized,
+			challenge:  `acr_values="idporten-loa-high"`,
+		},
+		{
+			name:       "other audience",
+			token:      valid().with("aud", "https://other.example.com"),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "other issuer",
+			token:      valid().with("iss", "https://idporten.example.com/"),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "other client",
+			token:      valid().with("client_id", "other"),
+			statusCode: http.StatusForbidden,
+		},
+	})
+}
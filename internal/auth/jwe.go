@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwe"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// DefaultKeyEncryptionAlgorithms are the JWE key management algorithms
+// accepted for encrypted tokens.
+var DefaultKeyEncryptionAlgorithms = []jwa.KeyEncryptionAlgorithm{
+	jwa.RSA_OAEP, jwa.RSA_OAEP_256,
+	jwa.ECDH_ES, jwa.ECDH_ES_A128KW, jwa.ECDH_ES_A192KW, jwa.ECDH_ES_A256KW,
+}
+
+// isEncrypted reports whether a token is a compact JWE, which has five
+// parts, rather than a compact JWS with three.
+func isEncrypted(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// decrypt returns the signed JWT nested in an encrypted token.
+func (p *JWTAuth) decrypt(token string) (string, error) {
+	if p.decryptionKeys == nil {
+		return "", errors.New("encrypted tokens are not accepted")
+	}
+
+	msg, err := jwe.ParseString(token)
+	if err != nil {
+		return "", fmt.Errorf("parsing jwe: %w", err)
+	}
+	h := msg.ProtectedHeaders()
+	if !slices.Contains(p.KeyEncryptionAlgorithms, h.Algorithm()) {
+		return "", fmt.Errorf("key encryption algorithm %q not allowed", h.Algorithm())
+	}
+	// RFC 7519 section 5.2, nested tokens must have the content type "JWT"
+	if !strings.EqualFold(h.ContentType(), "JWT") {
+		return "", fmt.Errorf("encrypted token must contain a signed JWT, got content type %q", h.ContentType())
+	}
+
+	payload, err := jwe.Decrypt([]byte(token), jwe.WithKeyProvider(decryptionKeysFor(p.decryptionKeys)))
+	if err != nil {
+		return "", fmt.Errorf("decrypting jwe: %w", err)
+	}
+	return string(payload), nil
+}
+
+// decryptionKeysFor provides the keys matching the "kid" of the token, or
+// every key if the token has none. Keys restricted to another use or
+// algorithm are skipped.
+func decryptionKeysFor(set jwk.Set) jwe.KeyProviderFunc {
+	return func(_ context.Context, sink jwe.KeySink, r jwe.Recipient, _ *jwe.Message) error {
+		alg := r.Headers().Algorithm()
+		kid := r.Headers().KeyID()
+		for i := 0; i < set.Len(); i++ {
+			key, _ := set.Key(i)
+			if kid != "" && key.KeyID() != kid {
+				continue
+			}
+			if use := key.KeyUsage(); use != "" && use != jwk.ForEncryption.String() {
+				continue
+			}
+			if v := key.Algorithm().String(); v != "" && v != alg.String() {
+				continue
+			}
+			sink.Key(alg, key)
+		}
+		return nil
+	}
+}
+
+// ParseDecryptionKeys parses private keys used to decrypt tokens, either a
+// JWKS document or PEM encoded keys. Several keys can be given for rotation.
+// PEM keys get a key ID derived from the RFC 7638 thumbprint.
+func ParseDecryptionKeys(b []byte) (jwk.Set, error) {
+	b = bytes.TrimSpace(b)
+	isPEM := bytes.HasPrefix(b, []byte("-----BEGIN"))
+	set, err := jwk.Parse(b, jwk.WithPEM(isPEM))
+	if err != nil {
+		return nil, err
+	}
+	if set.Len() == 0 {
+		return nil, errors.New("no keys found")
+	}
+
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Key(i)
+		private, err := jwk.IsPrivateKey(key)
+		if err != nil || !private {
+			return nil, errors.New("decryption keys must be private keys")
+		}
+		if isPEM {
+			if err := jwk.AssignKeyID(key); err != nil {
+				return nil, fmt.Errorf("assigning key id: %w", err)
+			}
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwe"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTEncrypted(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+
+	rsaKey := decryptionKey(t, "rsa", mustRSAKey(t))
+	ecKey := decryptionKey(t, "ec", mustECKey(t))
+	keys := jwk.NewSet()
+	_ = keys.AddKey(rsaKey)
+	_ = keys.AddKey(ecKey)
+
+	jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+	provider, err := testProvider(jwtProvider.WithJWKSCache(cache).WithDecryptionKeys(keys))
+	assert.NoError(t, err)
+
+	signed, err := token(time.Now(), time.Hour).with("aud", "yolo").sign(jwks)
+	assert.NoError(t, err)
+	other, err := newJwkSet("other")
+	assert.NoError(t, err)
+	forged, err := token(time.Now(), time.Hour).with("aud", "yolo").sign(other)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"signed token", signed, http.StatusOK},
+		{"rsa-oaep", encrypt(t, signed, jwa.RSA_OAEP_256, rsaKey, "JWT"), http.StatusOK},
+		{"ecdh-es", encrypt(t, signed, jwa.ECDH_ES_A256KW, ecKey, "JWT"), http.StatusOK},
+		{"nested token with invalid signature", encrypt(t, forged, jwa.RSA_OAEP_256, rsaKey, "JWT"), http.StatusUnauthorized},
+		{"missing content type", encrypt(t, signed, jwa.RSA_OAEP_256, rsaKey, ""), http.StatusUnauthorized},
+		{"unknown key", encrypt(t, signed, jwa.RSA_OAEP_256, decryptionKey(t, "rsa", mustRSAKey(t)), "JWT"), http.StatusUnauthorized},
+		{"algorithm not allowed", encrypt(t, signed, jwa.RSA1_5, rsaKey, "JWT"), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := provider.withRequest("Authorization", "Bearer "+tt.token)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, rr.Code)
+		})
+	}
+}
+
+func TestJWTRequireEncryption(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+	key := decryptionKey(t, "rsa", mustRSAKey(t))
+	keys := jwk.NewSet()
+	_ = keys.AddKey(key)
+
+	jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+	jwtProvider.RequireEncryption = true
+	provider, err := testProvider(jwtProvider.WithJWKSCache(cache).WithDecryptionKeys(keys))
+	assert.NoError(t, err)
+
+	signed, err := token(time.Now(), time.Hour).with("aud", "yolo").sign(jwks)
+	assert.NoError(t, err)
+	r1, err := provider.withRequest("Authorization", "Bearer "+signed)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r1.Code)
+}
+
+func TestJWTEncryptedWithoutDecryptionKeys(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+	jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+	provider, err := testProvider(jwtProvider.WithJWKSCache(cache))
+	assert.NoError(t, err)
+
+	signed, err := token(time.Now(), time.Hour).with("aud", "yolo").sign(jwks)
+	assert.NoError(t, err)
+	encrypted := encrypt(t, signed, jwa.RSA_OAEP_256, decryptionKey(t, "rsa", mustRSAKey(t)), "JWT")
+	r1, err := provider.withRequest("Authorization", "Bearer "+encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r1.Code)
+}
+
+func TestParseDecryptionKeys(t *testing.T) {
+	der, err := x509.MarshalPKCS8PrivateKey(mustECKey(t))
+	assert.NoError(t, err)
+	set, err := ParseDecryptionKeys(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.NoError(t, err)
+	key, _ := set.Key(0)
+	assert.NotEmpty(t, key.KeyID())
+
+	// public keys can't decrypt anything
+	jwks, err := newJwkSet("public")
+	assert.NoError(t, err)
+	_, err = ParseDecryptionKeys(jsonOf(t, jwks))
+	assert.Error(t, err)
+}
+
+func encrypt(t *testing.T, payload string, alg jwa.KeyEncryptionAlgorithm, key jwk.Key, contentType string) string {
+	public, err := key.PublicKey()
+	assert.NoError(t, err)
+	headers := jwe.NewHeaders()
+	if contentType != "" {
+		assert.NoError(t, headers.Set(jwe.ContentTypeKey, contentType))
+	}
+	b, err := jwe.Encrypt([]byte(payload),
+		jwe.WithKey(alg, public),
+		jwe.WithContentEncryption(jwa.A256GCM),
+		jwe.WithProtectedHeaders(headers),
+	)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func decryptionKey(t *testing.T, kid string, raw any) jwk.Key {
+	key, err := jwk.FromRaw(raw)
+	assert.NoError(t, err)
+	assert.NoError(t, key.Set(jwk.KeyIDKey, kid))
+	return key
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	return key
+}
+
+func mustECKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return key
+}
@@ -2,66 +2,184 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/lestrrat-go/jwx/v2/jwt"
-	log "github.com/sirupsen/logrus"
 )
 
 const AcceptableClockSkew = 5 * time.Second
 
+// DefaultAlgorithms are the asymmetric signing algorithms accepted unless an
+// explicit allowlist is configured.
+var DefaultAlgorithms = []jwa.SignatureAlgorithm{
+	jwa.RS256, jwa.RS384, jwa.RS512,
+	jwa.PS256, jwa.PS384, jwa.PS512,
+	jwa.ES256, jwa.ES384, jwa.ES512,
+	jwa.EdDSA,
+}
+
 type JWTAuth struct {
 	AuthHeader     string
 	RequiredClaims map[string]any
-	jwksURL        string
-	jwksCache      *jwk.Cache
+	// ValidClaims are checked like "iss" and "aud", a token with another
+	// value is invalid rather than forbidden, i.e. the tenant of Entra ID.
+	ValidClaims map[string]any
+	// Algorithms is the allowlist of signing algorithms accepted in the JOSE
+	// "alg" header.
+	Algorithms []jwa.SignatureAlgorithm
+	// TokenType, if set, is the required JOSE "typ" header, e.g. "at+jwt" for
+	// RFC 9068 access tokens. The "application/" prefix is optional.
+	TokenType string
+	// AllowIDTokens accepts OpenID Connect ID tokens as access tokens. By
+	// default a token that looks like an ID token is invalid, see
+	// isIDToken.
+	AllowIDTokens bool
+	// AllowMissingKeyID allows tokens without a "kid" header, these are
+	// verified against every key allowed for the token's algorithm. Tokens
+	// with a "kid" are only verified against the key with the same ID.
+	AllowMissingKeyID bool
+	Policy            TokenPolicy
+	// KeyEncryptionAlgorithms is the allowlist of JWE "alg" headers accepted
+	// for encrypted tokens.
+	KeyEncryptionAlgorithms []jwa.KeyEncryptionAlgorithm
+	// RequireEncryption rejects tokens that aren't encrypted.
+	RequireEncryption bool
+	// StepUp, if set, requires a stronger or more recent login for some
+	// paths, based on the "acr" and "auth_time" claims.
+	StepUp *StepUpPolicy
+	// Allowed are claim allowlists, a token must match every rule or it's
+	// forbidden.
+	Allowed []ClaimRule
+	// Scopes must all be granted to the token, in the space separated
+	// "scope" claim or the "scp" claim.
+	Scopes []string
+	// Realm is used in WWW-Authenticate challenges.
+	Realm string
+	// Credentials is whether the token is passed upstream, it is kept by
+	// default.
+	Credentials  CredentialPolicy
+	tokenSources []TokenSource
+	jwksURL      string
+	wellKnownURL string
+	jwksCache    *jwk.Cache
+	keySources   []KeySource
+	keys         *keyRing
+	// decryptionKeys are the private keys for encrypted tokens, nil if
+	// encrypted tokens aren't accepted.
+	decryptionKeys jwk.Set
 }
 
-var _ Provider = &JWTAuth{}
+var _ authenticator = &JWTAuth{}
 
 func JWT(authHeader, jwksURL string, requiredClaims map[string]any) (*JWTAuth, error) {
 	return &JWTAuth{
-		jwksURL:        jwksURL,
-		AuthHeader:     authHeader,
-		RequiredClaims: requiredClaims,
+		jwksURL:                 jwksURL,
+		AuthHeader:              authHeader,
+		RequiredClaims:          requiredClaims,
+		Algorithms:              DefaultAlgorithms,
+		KeyEncryptionAlgorithms: DefaultKeyEncryptionAlgorithms,
+		Policy: TokenPolicy{
+			ClockSkew: AcceptableClockSkew,
+		},
 	}, nil
 }
 
 func (p *JWTAuth) Handler() (Handler, error) {
-	if p.jwksCache == nil {
+	return authHandler(p, false)
+}
+
+func (p *JWTAuth) Authenticate(r *http.Request) (*Principal, error) {
+	token, err := extractToken(r, p.sources())
+	if err != nil {
+		return nil, err
+	}
+	t, err := p.validate(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	if p.StepUp != nil {
+		acr, authTime := userAuthentication(t)
+		if err := p.StepUp.Check(time.Now(), p.Policy.ClockSkew, r.URL.Path, acr, authTime); err != nil {
+			return nil, err
+		}
+	}
+
+	claims, err := t.AsMap(r.Context())
+	if err != nil {
+		return nil, fmt.Errorf("reading claims: %w", err)
+	}
+	return &Principal{
+		Provider: "jwt",
+		Subject:  t.Subject(),
+		Claims:   claims,
+		Token:    token,
+	}, nil
+}
+
+func (p *JWTAuth) setup() (denier, error) {
+	if p.wellKnownURL != "" && p.jwksURL == "" {
+		if err := p.discover(); err != nil {
+			return denier{}, err
+		}
+	}
+	if p.jwksURL == "" && len(p.keySources) == 0 {
+		return denier{}, errors.New("no key sources configured for JWT auth provider")
+	}
+	if p.jwksURL != "" && p.jwksCache == nil {
 		c, err := p.cache()
 		if err != nil {
-			return nil, err
+			return denier{}, err
 		}
 		p.jwksCache = c
 	}
+	sources := p.keySources
+	if p.jwksURL != "" {
+		sources = append([]KeySource{URLKeys(p.jwksCache, p.jwksURL)}, sources...)
+	}
+	p.keys = newKeyRing(sources...)
+	return newDenier("jwt", p.Realm, p.sources()), nil
+}
 
-	return func(handler http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			header := r.Header.Get(p.AuthHeader)
+func (p *JWTAuth) credentials() CredentialPolicy {
+	return p.Credentials
+}
 
-			token := strings.ReplaceAll(header, "Bearer ", "")
-			token = strings.TrimSpace(token)
+func (p *JWTAuth) SetCredentialPolicy(policy CredentialPolicy) {
+	p.Credentials = policy
+}
 
-			if token == "" {
-				log.Debugf("no JWT token found in request")
-				http.Error(w, fmt.Sprintf("missing token from header %s", p.AuthHeader), http.StatusUnauthorized)
-				return
-			}
-			if err := p.validate(r.Context(), token); err != nil {
-				log.Debugf("invalid JWT token: %v", err)
-				http.Error(w, "invalid token", http.StatusUnauthorized)
-				return
-			}
+func (p *JWTAuth) sources() []TokenSource {
+	if len(p.tokenSources) == 0 {
+		return []TokenSource{DefaultTokenSource(p.AuthHeader)}
+	}
+	return p.tokenSources
+}
 
-			handler.ServeHTTP(w, r)
-		})
-	}, nil
+// discover sets the JWKS URL and, unless already required, the issuer from
+// the discovery document.
+func (p *JWTAuth) discover() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	m, err := DiscoverURL(ctx, http.DefaultClient, p.wellKnownURL)
+	if err != nil {
+		return err
+	}
+	p.jwksURL = m.JWKSURI
+	if p.RequiredClaims == nil {
+		p.RequiredClaims = map[string]any{}
+	}
+	if _, ok := p.RequiredClaims["iss"]; !ok {
+		p.RequiredClaims["iss"] = m.Issuer
+	}
+	return nil
 }
 
 func (p *JWTAuth) WithJWKSCache(cache *jwk.Cache) *JWTAuth {
@@ -69,49 +187,223 @@ func (p *JWTAuth) WithJWKSCache(cache *jwk.Cache) *JWTAuth {
 	return p
 }
 
-func (p *JWTAuth) validate(ctx context.Context, token string) error {
-	opts := []jwt.ValidateOption{
-		jwt.WithAcceptableSkew(AcceptableClockSkew),
+// WithTokenSources sets where to look for the token, in order. Defaults to
+// AuthHeader, see DefaultTokenSource: Authorization requires the "Bearer"
+// scheme, any other header holds the bare token.
+func (p *JWTAuth) WithTokenSources(sources ...TokenSource) *JWTAuth {
+	p.tokenSources = sources
+	return p
+}
+
+// WithDiscovery gets the JWKS URL and the issuer from a well-known discovery
+// URL when the handler is created, e.g. for the presets of identity providers
+// that only publish the discovery document.
+func (p *JWTAuth) WithDiscovery(wellKnownURL string) *JWTAuth {
+	p.wellKnownURL = wellKnownURL
+	return p
+}
+
+// WithKeySources adds key sources that are used together with the JWKS URL,
+// if any. Keys from all sources are accepted.
+func (p *JWTAuth) WithKeySources(sources ...KeySource) *JWTAuth {
+	p.keySources = append(p.keySources, sources...)
+	return p
+}
+
+// WithDecryptionKeys accepts encrypted tokens (JWE) that contain a signed
+// JWT, decrypting them with the given private keys. Keys from earlier calls
+// are kept, so several keys can be used during rotation.
+func (p *JWTAuth) WithDecryptionKeys(set jwk.Set) *JWTAuth {
+	if p.decryptionKeys == nil {
+		p.decryptionKeys = jwk.NewSet()
+	}
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Key(i)
+		_ = p.decryptionKeys.AddKey(key)
+	}
+	return p
+}
+
+func (p *JWTAuth) validate(ctx context.Context, token string) (jwt.Token, error) {
+	t, err := p.parseToken(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("parsing jwt: %w", err)
+	}
+
+	err = p.Policy.Check(time.Now(), TimeClaims{
+		IssuedAt:   t.IssuedAt(),
+		Expiration: t.Expiration(),
+		NotBefore:  t.NotBefore(),
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	// time claims are checked by the policy above, a token for another
+	// issuer or audience is invalid, while a token lacking any other required
+	// claim is valid but not allowed
+	tokenOpts := []jwt.ValidateOption{jwt.WithResetValidators(true)}
+	claimOpts := []jwt.ValidateOption{jwt.WithResetValidators(true)}
 	for k, v := range p.RequiredClaims {
 		switch k {
 		case "iss":
-			opts = append(opts, jwt.WithIssuer(v.(string)))
+			tokenOpts = append(tokenOpts, jwt.WithIssuer(v.(string)))
 		case "aud":
-			opts = append(opts, jwt.WithAudience(v.(string)))
+			tokenOpts = append(tokenOpts, jwt.WithAudience(v.(string)))
 		default:
-			opts = append(opts, jwt.WithClaimValue(k, v))
+			claimOpts = append(claimOpts, jwt.WithClaimValue(k, v))
 		}
 	}
-
-	t, err := p.parseToken(ctx, token)
-	if err != nil {
-		return fmt.Errorf("parsing jwt: %w", err)
+	for k, v := range p.ValidClaims {
+		tokenOpts = append(tokenOpts, jwt.WithClaimValue(k, v))
+	}
+	if len(tokenOpts) > 1 {
+		if err := jwt.Validate(t, tokenOpts...); err != nil {
+			return nil, err
+		}
+	}
+	if len(claimOpts) > 1 {
+		if err := jwt.Validate(t, claimOpts...); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrForbidden, err)
+		}
+	}
+	if len(p.Allowed) > 0 || len(p.Scopes) > 0 {
+		claims, err := t.AsMap(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reading claims: %w", err)
+		}
+		for _, rule := range p.Allowed {
+			if err := rule.Check(claims); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkScopes(claims, p.Scopes); err != nil {
+			return nil, err
+		}
 	}
-	return jwt.Validate(t, opts...)
+	return t, nil
 }
 
 func (p *JWTAuth) parseToken(ctx context.Context, raw string) (jwt.Token, error) {
+	if isEncrypted(raw) {
+		decrypted, err := p.decrypt(raw)
+		if err != nil {
+			return nil, err
+		}
+		raw = decrypted
+	} else if p.RequireEncryption {
+		return nil, errors.New("token must be encrypted")
+	}
+
+	msg, err := jws.ParseString(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Signatures()) != 1 {
+		return nil, errors.New("expected exactly one signature")
+	}
+	if err := p.checkHeaders(msg.Signatures()[0].ProtectedHeaders()); err != nil {
+		return nil, err
+	}
+
 	jwks, err := p.getJWKS(ctx)
 	if err != nil {
 		return nil, err
 	}
 	parseOpts := []jwt.ParseOption{
-		jwt.WithKeySet(*jwks,
-			jws.WithInferAlgorithmFromKey(true),
-		),
-		jwt.WithAcceptableSkew(AcceptableClockSkew),
+		jwt.WithKeyProvider(keysFor(jwks)),
+		jwt.WithValidate(false),
 	}
-	return jwt.ParseString(raw, parseOpts...)
+	t, err := jwt.ParseString(raw, parseOpts...)
+	if err != nil {
+		return nil, err
+	}
+	if !p.AllowIDTokens && isIDToken(msg.Signatures()[0].ProtectedHeaders().Type(), t) {
+		return nil, errors.New("ID tokens are not accepted as access tokens")
+	}
+	return t, nil
+}
+
+// isIDToken tells OpenID Connect ID tokens from access tokens, as both are
+// often signed by the same issuer. Tokens typed "at+jwt" are access tokens
+// and "id+jwt" are ID tokens. Other tokens are ID tokens if they carry the
+// "nonce" or "at_hash" claims, or if they are issued to the client itself,
+// i.e. "aud" is "azp", without any scope.
+func isIDToken(typ string, t jwt.Token) bool {
+	switch {
+	case sameMediaType(typ, "at+jwt"):
+		return false
+	case sameMediaType(typ, "id+jwt"):
+		return true
+	}
+	for _, claim := range []string{"nonce", "at_hash"} {
+		if _, ok := t.Get(claim); ok {
+			return true
+		}
+	}
+	azp, _ := t.Get("azp")
+	if aud := t.Audience(); len(aud) != 1 || azp != aud[0] {
+		return false
+	}
+	_, scope := t.Get("scope")
+	_, scp := t.Get("scp")
+	return !scope && !scp
 }
 
-func (p *JWTAuth) getJWKS(ctx context.Context) (*jwk.Set, error) {
-	set, err := p.jwksCache.Get(ctx, p.jwksURL)
+func (p *JWTAuth) checkHeaders(h jws.Headers) error {
+	if !slices.Contains(p.Algorithms, h.Algorithm()) {
+		return fmt.Errorf("signing algorithm %q not allowed", h.Algorithm())
+	}
+	if p.TokenType != "" && !sameMediaType(h.Type(), p.TokenType) {
+		return fmt.Errorf("token type %q not allowed, expected %q", h.Type(), p.TokenType)
+	}
+	if h.KeyID() == "" && !p.AllowMissingKeyID {
+		return errors.New("token has no key id")
+	}
+	return nil
+}
+
+// keysFor selects the verification keys for a signature: the key matching
+// the "kid" header, or every key if the header has none. Keys restricted to
+// another algorithm or to encryption are skipped.
+func keysFor(set jwk.Set) jws.KeyProviderFunc {
+	return func(_ context.Context, sink jws.KeySink, sig *jws.Signature, _ *jws.Message) error {
+		alg := sig.ProtectedHeaders().Algorithm()
+		kid := sig.ProtectedHeaders().KeyID()
+
+		for i := 0; i < set.Len(); i++ {
+			key, _ := set.Key(i)
+			if kid != "" && key.KeyID() != kid {
+				continue
+			}
+			if usage := key.KeyUsage(); usage != "" && usage != jwk.ForSignature.String() {
+				continue
+			}
+			if ka := key.Algorithm().String(); ka != "" && ka != alg.String() {
+				continue
+			}
+			sink.Key(alg, key)
+		}
+		return nil
+	}
+}
+
+// sameMediaType compares "typ" values as described in RFC 7515 section 4.1.9,
+// i.e. case-insensitive and with an optional "application/" prefix.
+func sameMediaType(a, b string) bool {
+	normalize := func(s string) string {
+		s = strings.ToLower(s)
+		return strings.TrimPrefix(s, "application/")
+	}
+	return normalize(a) == normalize(b)
+}
+
+func (p *JWTAuth) getJWKS(ctx context.Context) (jwk.Set, error) {
+	set, err := p.keys.Keys(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("provider: fetching jwks: %w", err)
 	}
-
-	return &set, nil
+	return set, nil
 }
 
 func (p *JWTAuth) cache() (*jwk.Cache, error) {
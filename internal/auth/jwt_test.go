@@ -7,7 +7,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -106,11 +108,14 @@ func TestJWTUnauthorized(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			t1 := tt.tokenFunc(t)
-			header := tt.headerName
+			header, value := tt.headerName, t1
 			if header == "" {
 				header = "Authorization"
+				if t1 != "" {
+					value = "Bearer " + t1
+				}
 			}
-			r1, err := provider.withRequest(header, t1)
+			r1, err := provider.withRequest(header, value)
 			assert.NoError(t, err)
 			assert.Equal(t, http.StatusUnauthorized, r1.Code)
 			println(r1.Body.String())
@@ -118,6 +123,181 @@ func TestJWTUnauthorized(t *testing.T) {
 	}
 }
 
+func TestJWTPolicy(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+
+	jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+	jwtProvider = jwtProvider.WithJWKSCache(cache)
+	jwtProvider.Policy.MaxAge = 10 * time.Minute
+	provider, err := testProvider(jwtProvider)
+	assert.NoError(t, err)
+
+	t1, err := token(time.Now().Add(-5*time.Minute), time.Hour).with("aud", "yolo").sign(jwks)
+	assert.NoError(t, err)
+	r1, err := provider.withRequest("Authorization", "Bearer "+t1)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r1.Code)
+
+	t2, err := token(time.Now().Add(-15*time.Minute), time.Hour).with("aud", "yolo").sign(jwks)
+	assert.NoError(t, err)
+	r2, err := provider.withRequest("Authorization", "Bearer "+t2)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r2.Code)
+}
+
+func TestJWTRequireExp(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+
+	noExp := token(time.Now(), time.Hour).with("aud", "yolo")
+	assert.NoError(t, noExp.Remove("exp"))
+	t1, err := noExp.sign(jwks)
+	assert.NoError(t, err)
+
+	for _, requireExp := range []bool{false, true} {
+		jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+		assert.NoError(t, err)
+		jwtProvider = jwtProvider.WithJWKSCache(cache)
+		jwtProvider.Policy.RequireExp = requireExp
+		provider, err := testProvider(jwtProvider)
+		assert.NoError(t, err)
+
+		r1, err := provider.withRequest("Authorization", "Bearer "+t1)
+		assert.NoError(t, err)
+		// tokens without "exp" are accepted by default, as before the token
+		// policy was configurable
+		if requireExp {
+			assert.Equal(t, http.StatusUnauthorized, r1.Code)
+		} else {
+			assert.Equal(t, http.StatusOK, r1.Code)
+		}
+	}
+}
+
+func TestJWTHeaders(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+
+	tests := []struct {
+		name       string
+		configure  func(p *JWTAuth)
+		headers    map[string]any
+		claims     map[string]any
+		statusCode int
+	}{
+		{
+			name:       "default algorithms",
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "algorithm not in allowlist",
+			configure: func(p *JWTAuth) {
+				p.Algorithms = []jwa.SignatureAlgorithm{jwa.RS256}
+			},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "required token type",
+			configure: func(p *JWTAuth) {
+				p.TokenType = "at+jwt"
+			},
+			headers:    map[string]any{jws.TypeKey: "application/at+jwt"},
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "id token used as access token",
+			configure: func(p *JWTAuth) {
+				p.TokenType = "at+jwt"
+			},
+			headers:    map[string]any{jws.TypeKey: "JWT"},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "id token with nonce",
+			headers:    map[string]any{jws.TypeKey: "JWT"},
+			claims:     map[string]any{"nonce": "abc"},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "id token with at_hash",
+			claims:     map[string]any{"at_hash": "abc"},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "id token issued to the client itself",
+			claims:     map[string]any{"azp": "yolo"},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "id token typed id+jwt",
+			headers:    map[string]any{jws.TypeKey: "id+jwt"},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "access token issued to the client itself",
+			claims:     map[string]any{"azp": "yolo", "scope": "read"},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "access token typed at+jwt with nonce",
+			headers:    map[string]any{jws.TypeKey: "at+jwt"},
+			claims:     map[string]any{"nonce": "abc"},
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "id tokens allowed",
+			configure: func(p *JWTAuth) {
+				p.AllowIDTokens = true
+			},
+			claims:     map[string]any{"nonce": "abc", "azp": "yolo"},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "missing key id",
+			headers:    map[string]any{jws.KeyIDKey: nil},
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "missing key id allowed",
+			configure: func(p *JWTAuth) {
+				p.AllowMissingKeyID = true
+			},
+			headers:    map[string]any{jws.KeyIDKey: nil},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "unknown key id",
+			headers:    map[string]any{jws.KeyIDKey: "unknown"},
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+			assert.NoError(t, err)
+			jwtProvider = jwtProvider.WithJWKSCache(cache)
+			if tt.configure != nil {
+				tt.configure(jwtProvider)
+			}
+			provider, err := testProvider(jwtProvider)
+			assert.NoError(t, err)
+
+			tok := token(time.Now(), time.Hour).with("aud", "yolo")
+			for k, v := range tt.claims {
+				tok = tok.with(k, v)
+			}
+			t1, err := tok.signWithHeaders(jwks, tt.headers)
+			assert.NoError(t, err)
+			r1, err := provider.withRequest("Authorization", "Bearer "+t1)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.statusCode, r1.Code)
+		})
+	}
+}
+
 func jwksCache(url string) (*jwk.Cache, jwk.Set) {
 	ctx := context.Background()
 	jwks, err := newJwkSet("1234")
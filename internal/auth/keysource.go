@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// KeySource provides the public keys used to verify token signatures.
+type KeySource interface {
+	Keys(ctx context.Context) (jwk.Set, error)
+}
+
+var (
+	_ KeySource = &URLKeySource{}
+	_ KeySource = &FileKeySource{}
+	_ KeySource = &StaticKeySource{}
+	_ KeySource = &keyRing{}
+)
+
+// URLKeySource fetches a JWKS from a remote URL through a jwk.Cache.
+type URLKeySource struct {
+	url   string
+	cache *jwk.Cache
+}
+
+func URLKeys(cache *jwk.Cache, url string) *URLKeySource {
+	return &URLKeySource{
+		url:   url,
+		cache: cache,
+	}
+}
+
+func (s *URLKeySource) Keys(ctx context.Context) (jwk.Set, error) {
+	set, err := s.cache.Get(ctx, s.url)
+	if err != nil {
+		return nil, fmt.Errorf("fetching jwks from %s: %w", s.url, err)
+	}
+	return set, nil
+}
+
+// FileKeysInterval is how often a key file is checked for changes by
+// default.
+const FileKeysInterval = 10 * time.Second
+
+// FileKeySource reads keys from a JWKS or PEM file on disk. The file is
+// checked at most once per Interval and reloaded whenever its modification
+// time or size changes. If a reload fails the previously loaded keys are kept.
+type FileKeySource struct {
+	// Interval is the minimum time between checks of the file, 0 checks it
+	// on every call.
+	Interval time.Duration
+	path     string
+
+	mu      sync.RWMutex
+	checked time.Time
+	modTime time.Time
+	size    int64
+	set     jwk.Set
+}
+
+func FileKeys(path string) (*FileKeySource, error) {
+	s := &FileKeySource{path: path, Interval: FileKeysInterval}
+	if _, err := s.Keys(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileKeySource) Keys(ctx context.Context) (jwk.Set, error) {
+	s.mu.RLock()
+	set, fresh := s.set, s.fresh()
+	s.mu.RUnlock()
+	if fresh {
+		return set, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// another call may have checked the file while we waited for the lock
+	if s.fresh() {
+		return s.set, nil
+	}
+	s.checked = time.Now()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return s.stale(ctx, fmt.Errorf("reading key file: %w", err))
+	}
+	if s.set != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.set, nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return s.stale(ctx, fmt.Errorf("reading key file: %w", err))
+	}
+	set, err = parseKeys(b)
+	if err != nil {
+		return s.stale(ctx, fmt.Errorf("parsing key file %s: %w", s.path, err))
+	}
+
+	if s.set != nil {
+		LoggerFrom(ctx).Infof("reloaded %d key(s) from %s", set.Len(), s.path)
+	}
+	s.set = set
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return s.set, nil
+}
+
+// fresh is whether the loaded keys can be used without checking the file.
+func (s *FileKeySource) fresh() bool {
+	return s.set != nil && time.Since(s.checked) < s.Interval
+}
+
+func (s *FileKeySource) stale(ctx context.Context, err error) (jwk.Set, error) {
+	if s.set == nil {
+		return nil, err
+	}
+	LoggerFrom(ctx).Warnf("keeping previously loaded keys: %v", err)
+	return s.set, nil
+}
+
+// StaticKeySource holds a fixed set of keys, e.g. an inline JWKS or PEM
+// encoded public keys from configuration.
+type StaticKeySource struct {
+	set jwk.Set
+}
+
+func StaticKeys(set jwk.Set) *StaticKeySource {
+	return &StaticKeySource{set: set}
+}
+
+// ParseStaticKeys parses either a JWKS document or one or more PEM encoded
+// public keys.
+func ParseStaticKeys(b []byte) (*StaticKeySource, error) {
+	set, err := parseKeys(b)
+	if err != nil {
+		return nil, err
+	}
+	return StaticKeys(set), nil
+}
+
+func (s *StaticKeySource) Keys(_ context.Context) (jwk.Set, error) {
+	return s.set, nil
+}
+
+// parseKeys accepts a JWKS document, a single JWK or PEM encoded keys. PEM
+// keys carry no key ID, so one is derived from the RFC 7638 thumbprint.
+func parseKeys(b []byte) (jwk.Set, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errors.New("no keys found")
+	}
+
+	var set jwk.Set
+	var err error
+	switch {
+	case bytes.HasPrefix(b, []byte("-----BEGIN")):
+		set, err = jwk.Parse(b, jwk.WithPEM(true))
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < set.Len(); i++ {
+			key, _ := set.Key(i)
+			if err := jwk.AssignKeyID(key); err != nil {
+				return nil, fmt.Errorf("assigning key id: %w", err)
+			}
+		}
+	default:
+		set, err = jwk.Parse(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if set.Len() == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return jwk.PublicSetOf(set)
+}
+
+// keyRing combines the keys from several sources into a single set. A source
+// that fails is logged and skipped so keys can roll over between sources; an
+// error is only returned if no source yields any keys. The combined set is
+// only rebuilt when a source returns a different set than on the last call.
+type keyRing struct {
+	sources []KeySource
+	last    atomic.Pointer[mergedKeys]
+}
+
+type mergedKeys struct {
+	sets []jwk.Set
+	set  jwk.Set
+}
+
+func newKeyRing(sources ...KeySource) *keyRing {
+	return &keyRing{sources: sources}
+}
+
+func (k *keyRing) Keys(ctx context.Context) (jwk.Set, error) {
+	sets := make([]jwk.Set, len(k.sources))
+	var errs []error
+	for i, source := range k.sources {
+		set, err := source.Keys(ctx)
+		if err != nil {
+			LoggerFrom(ctx).Warnf("key source unavailable: %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		sets[i] = set
+	}
+
+	if last := k.last.Load(); last != nil && slices.Equal(last.sets, sets) {
+		return last.set, nil
+	}
+
+	merged := jwk.NewSet()
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+		for i := 0; i < set.Len(); i++ {
+			key, _ := set.Key(i)
+			_ = merged.AddKey(key)
+		}
+	}
+
+	if merged.Len() == 0 {
+		errs = append(errs, errors.New("no keys available"))
+		return nil, errors.Join(errs...)
+	}
+	k.last.Store(&mergedKeys{sets: sets, set: merged})
+	return merged, nil
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileKeysReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	first, err := newJwkSet("first")
+	assert.NoError(t, err)
+	writeJwks(t, path, first)
+
+	source, err := FileKeys(path)
+	assert.NoError(t, err)
+	source.Interval = 0
+	set, err := source.Keys(context.Background())
+	assert.NoError(t, err)
+	_, ok := set.LookupKeyID("first")
+	assert.True(t, ok)
+
+	second, err := newJwkSet("second")
+	assert.NoError(t, err)
+	writeJwks(t, path, second)
+	// make sure the modification time differs on file systems with coarse timestamps
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+
+	set, err = source.Keys(context.Background())
+	assert.NoError(t, err)
+	_, ok = set.LookupKeyID("second")
+	assert.True(t, ok)
+
+	// a broken file keeps the previously loaded keys
+	assert.NoError(t, os.WriteFile(path, []byte("not a jwks"), 0o600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	set, err = source.Keys(context.Background())
+	assert.NoError(t, err)
+	_, ok = set.LookupKeyID("second")
+	assert.True(t, ok)
+}
+
+func TestFileKeysChecksOnInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	first, err := newJwkSet("first")
+	assert.NoError(t, err)
+	writeJwks(t, path, first)
+
+	source, err := FileKeys(path)
+	assert.NoError(t, err)
+	assert.Equal(t, FileKeysInterval, source.Interval)
+
+	// the file isn't checked again until the interval has passed
+	second, err := newJwkSet("second")
+	assert.NoError(t, err)
+	writeJwks(t, path, second)
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	set, err := source.Keys(context.Background())
+	assert.NoError(t, err)
+	_, ok := set.LookupKeyID("first")
+	assert.True(t, ok)
+
+	source.checked = time.Now().Add(-FileKeysInterval)
+	set, err = source.Keys(context.Background())
+	assert.NoError(t, err)
+	_, ok = set.LookupKeyID("second")
+	assert.True(t, ok)
+}
+
+func TestFileKeysMissingFile(t *testing.T) {
+	_, err := FileKeys(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestParseStaticKeysPEM(t *testing.T) {
+	jwks, err := newJwkSet("ignored")
+	assert.NoError(t, err)
+
+	source, err := ParseStaticKeys(pemOf(t, jwks))
+	assert.NoError(t, err)
+	set, err := source.Keys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, set.Len())
+
+	key, _ := set.Key(0)
+	assert.NotEmpty(t, key.KeyID())
+	isPrivate, err := jwk.IsPrivateKey(key)
+	assert.NoError(t, err)
+	assert.False(t, isPrivate)
+}
+
+func TestKeyRingSkipsFailingSource(t *testing.T) {
+	jwks, err := newJwkSet("1234")
+	assert.NoError(t, err)
+
+	set, err := newKeyRing(failingKeySource{}, StaticKeys(jwks)).Keys(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, set.Len())
+
+	_, err = newKeyRing(failingKeySource{}).Keys(context.Background())
+	assert.Error(t, err)
+}
+
+func TestKeyRingReusesMergedSet(t *testing.T) {
+	first, err := newJwkSet("first")
+	assert.NoError(t, err)
+	second, err := newJwkSet("second")
+	assert.NoError(t, err)
+	source := &swappableKeySource{set: first}
+	ring := newKeyRing(source, StaticKeys(second))
+
+	set, err := ring.Keys(context.Background())
+	assert.NoError(t, err)
+	again, err := ring.Keys(context.Background())
+	assert.NoError(t, err)
+	assert.Same(t, set, again)
+
+	third, err := newJwkSet("third")
+	assert.NoError(t, err)
+	source.set = third
+	set, err = ring.Keys(context.Background())
+	assert.NoError(t, err)
+	assert.NotSame(t, again, set)
+	_, ok := set.LookupKeyID("third")
+	assert.True(t, ok)
+	_, ok = set.LookupKeyID("first")
+	assert.False(t, ok)
+}
+
+func TestJWTWithStaticKeysAndURL(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, urlKeys := jwksCache(url)
+
+	staticKeys, err := newJwkSet("5678")
+	assert.NoError(t, err)
+	source, err := ParseStaticKeys(jsonOf(t, staticKeys))
+	assert.NoError(t, err)
+
+	jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+	provider, err := testProvider(jwtProvider.WithJWKSCache(cache).WithKeySources(source))
+	assert.NoError(t, err)
+
+	for _, jwks := range []jwk.Set{urlKeys, staticKeys} {
+		t1, err := token(time.Now(), time.Hour).with("aud", "yolo").sign(jwks)
+		assert.NoError(t, err)
+		r1, err := provider.withRequest("Authorization", "Bearer "+t1)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, r1.Code)
+	}
+}
+
+func TestJWTWithoutKeySources(t *testing.T) {
+	jwtProvider, err := JWT("Authorization", "", map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+	_, err = jwtProvider.Handler()
+	assert.Error(t, err)
+}
+
+type failingKeySource struct{}
+
+func (failingKeySource) Keys(context.Context) (jwk.Set, error) {
+	return nil, errors.New("unavailable")
+}
+
+type swappableKeySource struct {
+	set jwk.Set
+}
+
+func (s *swappableKeySource) Keys(context.Context) (jwk.Set, error) {
+	return s.set, nil
+}
+
+func writeJwks(t *testing.T, path string, set jwk.Set) {
+	assert.NoError(t, os.WriteFile(path, jsonOf(t, set), 0o600))
+}
+
+func jsonOf(t *testing.T, set jwk.Set) []byte {
+	public, err := jwk.PublicSetOf(set)
+	assert.NoError(t, err)
+	b, err := json.Marshal(public)
+	assert.NoError(t, err)
+	return b
+}
+
+func pemOf(t *testing.T, set jwk.Set) []byte {
+	key, _ := set.Key(0)
+	var raw ecdsa.PrivateKey
+	assert.NoError(t, key.Raw(&raw))
+	der, err := x509.MarshalPKIXPublicKey(&raw.PublicKey)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
@@ -0,0 +1,24 @@
+package auth
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying the logger the providers log to
+// while handling a request, i.e. one with the fields of the request.
+func WithLogger(ctx context.Context, l log.FieldLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the logger of a request, the standard logger if none
+// was set.
+func LoggerFrom(ctx context.Context) log.FieldLogger {
+	if l, ok := ctx.Value(loggerKey{}).(log.FieldLogger); ok && l != nil {
+		return l
+	}
+	return log.StandardLogger()
+}
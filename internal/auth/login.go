@@ -0,0 +1,538 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/munnerz/goautoneg"
+	"github.com/nais/authproxy/internal/problem"
+	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	DefaultSessionCookie = "authproxy_session"
+	DefaultSessionMaxAge = 12 * time.Hour
+	DefaultRefreshBefore = time.Minute
+	LogoutPath           = "/oauth2/logout"
+
+	// loginTimeout is how long a user has to complete the login at the
+	// identity provider.
+	loginTimeout = 10 * time.Minute
+)
+
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+// OIDCLogin logs in browser users with the OpenID Connect authorization code
+// flow with PKCE. The tokens are kept in an encrypted session cookie and
+// refreshed before they expire. Requests without a session are redirected to
+// the identity provider if they accept HTML, other requests are rejected.
+type OIDCLogin struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the absolute URL of the callback, its path is handled
+	// by the provider.
+	RedirectURL string
+	Scopes      []string
+	// CookieName is the name of the session cookie. Large sessions are split
+	// into several cookies with this name as prefix.
+	CookieName    string
+	SessionMaxAge time.Duration
+	// RefreshBefore is how long before the tokens expire they are refreshed.
+	RefreshBefore time.Duration
+	// PostLogoutRedirectURL is where the identity provider sends the user
+	// after logout.
+	PostLogoutRedirectURL string
+	Realm                 string
+
+	cookieSecret []byte
+	client       *http.Client
+	metadata     *ProviderMetadata
+	config       *oauth2.Config
+	idTokens     *JWTAuth
+	codec        *sessionCodec
+	jar          cookieJar
+	callbackPath string
+	refreshes    singleflight.Group
+}
+
+var (
+	_ Provider      = &OIDCLogin{}
+	_ Authenticator = &OIDCLogin{}
+)
+
+// session is stored encrypted in the session cookie.
+type session struct {
+	Subject      string    `json:"sub"`
+	IDToken      string    `json:"id_token"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// loginState is stored encrypted in a cookie while the user logs in.
+type loginState struct {
+	State      string    `json:"state"`
+	Nonce      string    `json:"nonce"`
+	Verifier   string    `json:"verifier"`
+	RedirectTo string    `json:"redirect_to"`
+	Expires    time.Time `json:"expires"`
+}
+
+func OIDC(issuer, clientID, clientSecret, redirectURL string, cookieSecret []byte) *OIDCLogin {
+	return &OIDCLogin{
+		Issuer:        issuer,
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		RedirectURL:   redirectURL,
+		Scopes:        DefaultScopes,
+		CookieName:    DefaultSessionCookie,
+		SessionMaxAge: DefaultSessionMaxAge,
+		RefreshBefore: DefaultRefreshBefore,
+		cookieSecret:  cookieSecret,
+	}
+}
+
+// WithHTTPClient sets the client used for discovery, keys and the token
+// endpoint.
+func (p *OIDCLogin) WithHTTPClient(client *http.Client) *OIDCLogin {
+	p.client = client
+	return p
+}
+
+// WithMetadata skips discovery and uses the given endpoints instead.
+func (p *OIDCLogin) WithMetadata(m *ProviderMetadata) *OIDCLogin {
+	p.metadata = m
+	return p
+}
+
+func (p *OIDCLogin) Handler() (Handler, error) {
+	d, err := p.configure()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case p.callbackPath:
+				p.callback(w, r, d)
+				return
+			case LogoutPath:
+				p.logout(w, r)
+				return
+			}
+
+			removeIdentity(r)
+			s, err := p.session(w, r)
+			if err != nil {
+				if isBrowser(r) {
+					p.login(w, r, d)
+					return
+				}
+				d.deny(w, r, err)
+				return
+			}
+
+			principal, err := s.principal()
+			if err != nil {
+				d.deny(w, r, err)
+				return
+			}
+			removeCookies(r, p.CookieName)
+			h.ServeHTTP(w, authenticated(r, principal))
+		})
+	}, nil
+}
+
+// Authenticate verifies the session cookie of a request. Unlike the handler
+// it does not refresh the tokens of a session.
+func (p *OIDCLogin) Authenticate(r *http.Request) (*Principal, error) {
+	s, err := p.readSession(r)
+	if err != nil {
+		return nil, err
+	}
+	if !s.Expiry.IsZero() && time.Now().After(s.Expiry) {
+		return nil, ErrTokenExpired
+	}
+	return s.principal()
+}
+
+func (p *OIDCLogin) configure() (denier, error) {
+	codec, err := newSessionCodec(p.cookieSecret)
+	if err != nil {
+		return denier{}, err
+	}
+	p.codec = codec
+
+	redirect, err := url.Parse(p.RedirectURL)
+	if err != nil || !redirect.IsAbs() {
+		return denier{}, fmt.Errorf("redirect url must be an absolute url: %q", p.RedirectURL)
+	}
+	p.callbackPath = redirect.Path
+	p.jar = cookieJar{secure: redirect.Scheme == "https"}
+
+	if p.client == nil {
+		p.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	ctx := context.Background()
+	if p.metadata == nil {
+		m, err := Discover(ctx, p.client, p.Issuer)
+		if err != nil {
+			return denier{}, err
+		}
+		p.metadata = m
+	}
+
+	scopes := p.Scopes
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	p.config = &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  p.RedirectURL,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.metadata.AuthorizationEndpoint,
+			TokenURL: p.metadata.TokenEndpoint,
+		},
+	}
+
+	cache := jwk.NewCache(ctx)
+	if err := cache.Register(p.metadata.JWKSURI, jwk.WithHTTPClient(p.client)); err != nil {
+		return denier{}, fmt.Errorf("registering jwks uri to cache: %w", err)
+	}
+	if _, err := cache.Refresh(ctx, p.metadata.JWKSURI); err != nil {
+		return denier{}, fmt.Errorf("initial fetch of jwks from provider: %w", err)
+	}
+	idTokens, err := JWT("", p.metadata.JWKSURI, map[string]any{
+		"iss": p.metadata.Issuer,
+		"aud": p.ClientID,
+	})
+	if err != nil {
+		return denier{}, err
+	}
+	idTokens.Policy.RequireIat = true
+	idTokens.AllowIDTokens = true
+	if _, err := idTokens.WithJWKSCache(cache).setup(); err != nil {
+		return denier{}, err
+	}
+	p.idTokens = idTokens
+
+	return newDenier("oidc-login", p.Realm, nil), nil
+}
+
+// login redirects the user to the identity provider, keeping state, nonce
+// and PKCE verifier in a cookie until the callback.
+func (p *OIDCLogin) login(w http.ResponseWriter, r *http.Request, d denier) {
+	state := loginState{
+		State:      randomString(),
+		Nonce:      randomString(),
+		Verifier:   oauth2.GenerateVerifier(),
+		RedirectTo: r.URL.RequestURI(),
+		Expires:    time.Now().Add(loginTimeout),
+	}
+	value, err := p.codec.seal(p.loginCookie(), state)
+	if err != nil {
+		d.deny(w, r, fmt.Errorf("%w: %w", ErrLoginFailed, err))
+		return
+	}
+	p.jar.write(w, r, p.loginCookie(), value, int(loginTimeout.Seconds()))
+
+	target := p.config.AuthCodeURL(state.State,
+		oauth2.S256ChallengeOption(state.Verifier),
+		oauth2.SetAuthURLParam("nonce", state.Nonce),
+	)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func (p *OIDCLogin) callback(w http.ResponseWriter, r *http.Request, d denier) {
+	state, err := p.loginState(r)
+	p.jar.clear(w, r, p.loginCookie())
+	if err != nil {
+		d.deny(w, r, fmt.Errorf("%w: %w", ErrLoginFailed, err))
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		d.deny(w, r, fmt.Errorf("%w: identity provider returned %s: %s", ErrLoginFailed, e, query.Get("error_description")))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state.State)) != 1 {
+		d.deny(w, r, fmt.Errorf("%w: state mismatch", ErrLoginFailed))
+		return
+	}
+
+	ctx := p.context(r.Context())
+	token, err := p.config.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		d.deny(w, r, fmt.Errorf("%w: exchanging code: %w", ErrLoginFailed, err))
+		return
+	}
+	s, err := p.newSession(ctx, token, state.Nonce)
+	if err != nil {
+		d.deny(w, r, fmt.Errorf("%w: %w", ErrLoginFailed, err))
+		return
+	}
+	if err := p.writeSession(w, r, s); err != nil {
+		d.deny(w, r, fmt.Errorf("%w: %w", ErrLoginFailed, err))
+		return
+	}
+
+	LoggerFrom(r.Context()).WithField("sub", s.Subject).Debug("oidc-login: user logged in")
+	http.Redirect(w, r, state.RedirectTo, http.StatusFound)
+}
+
+// logout removes the session and, if the identity provider supports it,
+// redirects to its end session endpoint for RP-initiated logout. Only a POST
+// from the same origin logs out, so another site can't end the session with
+// a link or an image.
+func (p *OIDCLogin) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		problem.Write(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "logout requires POST")
+		return
+	}
+	if !sameOrigin(r) {
+		problem.Write(w, r, http.StatusForbidden, "cross_site_request", "logout must come from the same origin")
+		return
+	}
+
+	s, _ := p.readSession(r)
+	p.jar.clear(w, r, p.CookieName)
+
+	target := p.PostLogoutRedirectURL
+	if target == "" {
+		target = "/"
+	}
+	if p.metadata.EndSessionEndpoint != "" {
+		u, err := url.Parse(p.metadata.EndSessionEndpoint)
+		if err == nil {
+			query := u.Query()
+			query.Set("client_id", p.ClientID)
+			if s != nil {
+				query.Set("id_token_hint", s.IDToken)
+			}
+			if p.PostLogoutRedirectURL != "" {
+				query.Set("post_logout_redirect_uri", p.PostLogoutRedirectURL)
+			}
+			u.RawQuery = query.Encode()
+			target = u.String()
+		}
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// sameOrigin is whether a request comes from a page of the same origin, by
+// the Sec-Fetch-Site header or, for browsers that don't send it, the Origin
+// header. Requests with neither aren't sent cross-site by browsers.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// session returns the session of the request, refreshing its tokens if they
+// are about to expire.
+func (p *OIDCLogin) session(w http.ResponseWriter, r *http.Request) (*session, error) {
+	s, err := p.readSession(r)
+	if err != nil {
+		return nil, err
+	}
+	if s.Expiry.IsZero() || time.Until(s.Expiry) > p.RefreshBefore {
+		return s, nil
+	}
+
+	expired := time.Now().After(s.Expiry)
+	if s.RefreshToken == "" {
+		if expired {
+			return nil, ErrTokenExpired
+		}
+		return s, nil
+	}
+
+	refreshed, err := p.refresh(r.Context(), s)
+	if err != nil {
+		LoggerFrom(r.Context()).Warnf("oidc-login: refreshing tokens: %v", err)
+		if expired {
+			return nil, ErrTokenExpired
+		}
+		return s, nil
+	}
+	if err := p.writeSession(w, r, refreshed); err != nil {
+		return nil, err
+	}
+	return refreshed, nil
+}
+
+// refresh uses the refresh token of a session. Concurrent requests with the
+// same session share a single refresh, as refresh tokens may be single use.
+func (p *OIDCLogin) refresh(ctx context.Context, s *session) (*session, error) {
+	v, err, _ := p.refreshes.Do(s.RefreshToken, func() (any, error) {
+		ctx := p.context(context.WithoutCancel(ctx))
+		token, err := p.config.TokenSource(ctx, &oauth2.Token{
+			RefreshToken: s.RefreshToken,
+			Expiry:       time.Now().Add(-time.Second),
+		}).Token()
+		if err != nil {
+			return nil, err
+		}
+
+		refreshed := *s
+		refreshed.AccessToken = token.AccessToken
+		refreshed.Expiry = token.Expiry
+		if token.RefreshToken != "" {
+			refreshed.RefreshToken = token.RefreshToken
+		}
+		if raw, ok := token.Extra("id_token").(string); ok && raw != "" {
+			t, err := p.idTokens.validate(ctx, raw)
+			if err != nil {
+				return nil, fmt.Errorf("validating refreshed id token: %w", err)
+			}
+			if t.Subject() != s.Subject {
+				return nil, errors.New("refreshed id token has a different subject")
+			}
+			refreshed.IDToken = raw
+		}
+		return &refreshed, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*session), nil
+}
+
+func (p *OIDCLogin) newSession(ctx context.Context, token *oauth2.Token, nonce string) (*session, error) {
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		return nil, errors.New("no id_token in token response")
+	}
+	t, err := p.idTokens.validate(ctx, raw)
+	if err != nil {
+		return nil, fmt.Errorf("validating id token: %w", err)
+	}
+	claim, _ := t.Get("nonce")
+	if n, _ := claim.(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	expiry := token.Expiry
+	if expiry.IsZero() {
+		expiry = t.Expiration()
+	}
+	return &session{
+		Subject:      t.Subject(),
+		IDToken:      raw,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       expiry,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+func (p *OIDCLogin) readSession(r *http.Request) (*session, error) {
+	value, ok := p.jar.read(r, p.CookieName)
+	if !ok {
+		return nil, fmt.Errorf("%w from cookie %s", ErrMissingToken, p.CookieName)
+	}
+	var s session
+	if err := p.codec.open(p.CookieName, value, &s); err != nil {
+		return nil, fmt.Errorf("%w: reading session: %w", ErrInvalidToken, err)
+	}
+	if time.Since(s.CreatedAt) > p.SessionMaxAge {
+		return nil, fmt.Errorf("%w: session expired", ErrTokenExpired)
+	}
+	return &s, nil
+}
+
+func (p *OIDCLogin) writeSession(w http.ResponseWriter, r *http.Request, s *session) error {
+	value, err := p.codec.seal(p.CookieName, s)
+	if err != nil {
+		return err
+	}
+	maxAge := time.Until(s.CreatedAt.Add(p.SessionMaxAge))
+	p.jar.write(w, r, p.CookieName, value, int(maxAge.Seconds()))
+	return nil
+}
+
+func (p *OIDCLogin) loginState(r *http.Request) (*loginState, error) {
+	value, ok := p.jar.read(r, p.loginCookie())
+	if !ok {
+		return nil, errors.New("no login in progress")
+	}
+	var state loginState
+	if err := p.codec.open(p.loginCookie(), value, &state); err != nil {
+		return nil, err
+	}
+	if time.Now().After(state.Expires) {
+		return nil, errors.New("login timed out")
+	}
+	// only redirect back to this host after login
+	if !strings.HasPrefix(state.RedirectTo, "/") || strings.HasPrefix(state.RedirectTo, "//") {
+		state.RedirectTo = "/"
+	}
+	return &state, nil
+}
+
+func (p *OIDCLogin) loginCookie() string {
+	return p.CookieName + "_login"
+}
+
+func (p *OIDCLogin) context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, p.client)
+}
+
+func (s *session) principal() (*Principal, error) {
+	t, err := jwt.ParseInsecure([]byte(s.IDToken))
+	if err != nil {
+		return nil, fmt.Errorf("reading session id token: %w", err)
+	}
+	claims, err := t.AsMap(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("reading claims: %w", err)
+	}
+	return &Principal{
+		Provider: "oidc-login",
+		Subject:  s.Subject,
+		Claims:   claims,
+	}, nil
+}
+
+// isBrowser reports whether a request should be redirected to log in rather
+// than be rejected, i.e. a navigation that prefers HTML over JSON.
+func isBrowser(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	offers := []string{"application/json", "text/html"}
+	return goautoneg.Negotiate(r.Header.Get("Accept"), offers) == "text/html"
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
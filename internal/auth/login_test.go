@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Close()
+
+	var upstream *http.Request
+	srv := oidcTestServer(t, idp, func(_ http.ResponseWriter, r *http.Request) {
+		upstream = r
+	})
+
+	// API requests without a session are rejected
+	rr := serve(srv, get("/data", "Accept", "application/json"))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// browsers are redirected to the identity provider
+	rr = serve(srv, get("/data?x=1", "Accept", "text/html"))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	location, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, idp.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	query := location.Query()
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.Equal(t, "client", query.Get("client_id"))
+	assert.Contains(t, query.Get("scope"), "openid")
+	idp.challenge = query.Get("code_challenge")
+	idp.nonce = query.Get("nonce")
+	login := rr.Result().Cookies()
+
+	// the state must match
+	rr = serve(srv, get("/oauth2/callback?code=code&state=wrong"), login...)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// the callback creates the session and redirects back
+	rr = serve(srv, get("/oauth2/callback?code=code&state="+query.Get("state")), login...)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "/data?x=1", rr.Header().Get("Location"))
+	session := sessionCookies(rr)
+	assert.NotEmpty(t, session)
+
+	// requests with a session pass, without the session cookie
+	rr = serve(srv, get("/data", "Accept", "application/json"), append(session, &http.Cookie{Name: "other", Value: "1"})...)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, StatusAuthenticated, upstream.Header.Get(AuthStatusHeader))
+	assert.Equal(t, "alice", upstream.Header.Get(AuthSubjectHeader))
+	_, err = upstream.Cookie(DefaultSessionCookie)
+	assert.Error(t, err)
+	_, err = upstream.Cookie("other")
+	assert.NoError(t, err)
+
+	// a tampered session is rejected
+	tampered := *session[0]
+	tampered.Value = strings.ToUpper(tampered.Value)
+	rr = serve(srv, get("/data", "Accept", "application/json"), &tampered)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// logout is only possible with a POST from the same origin
+	rr = serve(srv, get("/oauth2/logout"), session...)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+	rr = serve(srv, post("/oauth2/logout", "Sec-Fetch-Site", "cross-site"), session...)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Empty(t, rr.Result().Cookies())
+	rr = serve(srv, post("/oauth2/logout", "Origin", "https://evil.example.com"), session...)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// logout removes the session and redirects to the identity provider
+	rr = serve(srv, post("/oauth2/logout", "Sec-Fetch-Site", "same-origin", "Origin", "http://example.com"), session...)
+	assert.Equal(t, http.StatusSeeOther, rr.Code)
+	location, err = url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/logout", location.Path)
+	assert.NotEmpty(t, location.Query().Get("id_token_hint"))
+	for _, c := range rr.Result().Cookies() {
+		assert.Negative(t, c.MaxAge)
+	}
+}
+
+func TestOIDCLoginRefresh(t *testing.T) {
+	idp := newFakeIdP(t)
+	defer idp.Close()
+	// expires before the refresh margin
+	idp.expiresIn = 30
+
+	srv := oidcTestServer(t, idp, func(http.ResponseWriter, *http.Request) {})
+
+	rr := serve(srv, get("/", "Accept", "text/html"))
+	location, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	idp.challenge = location.Query().Get("code_challenge")
+	idp.nonce = location.Query().Get("nonce")
+
+	rr = serve(srv, get("/oauth2/callback?code=code&state="+location.Query().Get("state")), rr.Result().Cookies()...)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	rr = serve(srv, get("/"), sessionCookies(rr)...)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 1, idp.refreshes)
+	assert.NotEmpty(t, sessionCookies(rr))
+}
+
+func TestSameOrigin(t *testing.T) {
+	assert.True(t, sameOrigin(post("/oauth2/logout", "Sec-Fetch-Site", "same-origin")))
+	assert.False(t, sameOrigin(post("/oauth2/logout", "Sec-Fetch-Site", "same-site")))
+	assert.True(t, sameOrigin(post("/oauth2/logout", "Origin", "http://EXAMPLE.com")))
+	assert.False(t, sameOrigin(post("/oauth2/logout", "Origin", "null")))
+	assert.True(t, sameOrigin(post("/oauth2/logout")))
+}
+
+func TestIsBrowser(t *testing.T) {
+	assert.True(t, isBrowser(get("/", "Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")))
+	assert.False(t, isBrowser(get("/", "Accept", "*/*")))
+	assert.False(t, isBrowser(get("/", "Accept", "application/json")))
+	assert.False(t, isBrowser(get("/")))
+
+	post := get("/", "Accept", "text/html")
+	post.Method = http.MethodPost
+	assert.False(t, isBrowser(post))
+}
+
+func oidcTestServer(t *testing.T, idp *fakeIdP, upstream http.HandlerFunc) http.Handler {
+	p := OIDC(idp.URL, "client", "secret", "https://app.example.com/oauth2/callback", []byte(strings.Repeat("s", MinCookieSecretLength)))
+	h, err := p.WithHTTPClient(idp.Client()).Handler()
+	assert.NoError(t, err)
+	return h(upstream)
+}
+
+func get(target string, header ...string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	return r
+}
+
+func post(target string, header ...string) *http.Request {
+	r := get(target, header...)
+	r.Method = http.MethodPost
+	return r
+}
+
+func serve(h http.Handler, r *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	for _, c := range cookies {
+		r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return rr
+}
+
+func sessionCookies(rr *httptest.ResponseRecorder) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if strings.HasPrefix(c.Name, DefaultSessionCookie) && c.MaxAge > 0 {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+// fakeIdP is a minimal OpenID Connect provider that issues tokens for
+// "alice" to the client "client".
+type fakeIdP struct {
+	*httptest.Server
+	keys      jwk.Set
+	challenge string
+	nonce     string
+	expiresIn int
+	refreshes int
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	keys, err := newJwkSet("idp")
+	assert.NoError(t, err)
+	idp := &fakeIdP{keys: keys, expiresIn: 3600}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(ProviderMetadata{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/jwks",
+			EndSessionEndpoint:    idp.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(jsonOf(t, idp.keys))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+			if r.Form.Get("code") != "code" || base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+		case "refresh_token":
+			idp.refreshes++
+		}
+
+		idToken, err := token(time.Now(), time.Hour).
+			with("iss", idp.URL).
+			with("aud", "client").
+			with("sub", "alice").
+			with("nonce", idp.nonce).
+			sign(idp.keys)
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "access",
+			"token_type":    "Bearer",
+			"expires_in":    idp.expiresIn,
+			"refresh_token": "refresh",
+			"id_token":      idToken,
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
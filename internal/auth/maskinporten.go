@@ -0,0 +1,32 @@
+package auth
+
+import "strings"
+
+// MaskinportenOrgPrefix is the ISO 6523 scheme of Norwegian organisation
+// numbers in the "consumer.ID" claim, i.e. "0192:889640782".
+const MaskinportenOrgPrefix = "0192:"
+
+// Maskinporten returns a JWT provider for access tokens issued by
+// Maskinporten. The issuer and the keys come from the well-known URL, and
+// every scope must be granted to the token.
+func Maskinporten(wellKnownURL string, scopes ...string) (*JWTAuth, error) {
+	p, err := JWT("Authorization", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	p.Scopes = scopes
+	return p.WithDiscovery(wellKnownURL), nil
+}
+
+// MaskinportenConsumers allows only tokens issued to the organisations, given
+// as organisation numbers with or without the ISO 6523 scheme.
+func MaskinportenConsumers(orgs ...string) ClaimRule {
+	ids := make([]string, len(orgs))
+	for i, org := range orgs {
+		if !strings.Contains(org, ":") {
+			org = MaskinportenOrgPrefix + org
+		}
+		ids[i] = org
+	}
+	return ClaimRule{Claim: "consumer.ID", Values: ids}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskinporten(t *testing.T) {
+	// Maskinporten publishes RFC 8414 metadata, the issuer ends with a slash
+	f := newFakeIssuer(t, "/.well-known/oauth-authorization-server", "/")
+
+	p, err := Maskinporten(f.wellKnownURL, "nav:team/read", "nav:team/write")
+	assert.NoError(t, err)
+	p.Allowed = []ClaimRule{MaskinportenConsumers("889640782", "0192:974761076")}
+
+	valid := func() *Token {
+		return token(time.Now(), time.Hour).
+			with("iss", f.issuer).
+			with("scope", "nav:team/write nav:team/read").
+			with("consumer", map[string]any{"authority": "iso6523-actorid-upis", "ID": "0192:889640782"})
+	}
+	identity := IdentityHeaders{{Name: "X-Auth-Consumer-Orgno", Claim: "consumer.ID", TrimPrefix: MaskinportenOrgPrefix}}
+	f.run(t, p, identity, []issuerTest{
+		{
+			name:       "valid",
+			token:      valid(),
+			statusCode: http.StatusOK,
+			upstream:   map[string]string{"X-Auth-Consumer-Orgno": "889640782"},
+		},
+		{
+			name:       "consumer with scheme",
+			token:      valid().with("consumer", map[string]any{"ID": "0192:974761076"}),
+			statusCode: http.StatusOK,
+			upstream:   map[string]string{"X-Auth-Consumer-Orgno": "974761076"},
+		},
+		{
+			name:       "other issuer",
+			token:      valid().with("iss", "https://maskinporten.example.com/"),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing scope",
+			token:      valid().with("scope", "nav:team/read"),
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "scope prefix",
+			token:      valid().with("scope", "nav:team/read nav:team/writer"),
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "other consumer",
+			token:      valid().with("consumer", map[string]any{"ID": "0192:123456789"}),
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "no consumer",
+			token:      valid().with("consumer", nil),
+			statusCode: http.StatusForbidden,
+		},
+	})
+}
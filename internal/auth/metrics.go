@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ErrMissingToken = errors.New("missing token")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrLoginFailed  = errors.New("login failed")
+)
+
+// Metrics count the decisions of the providers. They are passed to the
+// providers with the request context, see WithMetrics.
+type Metrics struct {
+	rejections      *prometheus.CounterVec
+	shadowDecisions *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics and registers them with reg, if set. Metrics
+// already registered with reg are reused, so several handlers can share a
+// registry.
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_auth_rejections_total",
+			Help: "Number of requests rejected by the auth provider, by reason.",
+		}, []string{"provider", "reason"}),
+		shadowDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "authproxy_auth_shadow_decisions_total",
+			Help: "Number of requests the shadow auth provider would have allowed or denied, by reason.",
+		}, []string{"provider", "decision", "reason"}),
+	}
+	if reg == nil {
+		return m, nil
+	}
+	var err error
+	if m.rejections, err = register(reg, m.rejections); err != nil {
+		return nil, err
+	}
+	if m.shadowDecisions, err = register(reg, m.shadowDecisions); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func register(reg prometheus.Registerer, c *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	err := reg.Register(c)
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		if existing, ok := registered.ExistingCollector.(*prometheus.CounterVec); ok {
+			return existing, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("registering metrics: %w", err)
+	}
+	return c, nil
+}
+
+// unregistered are the metrics of requests without any, they are counted but
+// not exported.
+var unregistered, _ = NewMetrics(nil)
+
+type metricsKey struct{}
+
+// WithMetrics returns a copy of ctx carrying the metrics the providers count
+// their decisions in.
+func WithMetrics(ctx context.Context, m *Metrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+func metricsFrom(ctx context.Context) *Metrics {
+	if m, ok := ctx.Value(metricsKey{}).(*Metrics); ok && m != nil {
+		return m
+	}
+	return unregistered
+}
+
+// reasons maps errors to the reason label used in logs and metrics.
+var reasons = []struct {
+	err    error
+	reason string
+}{
+	{ErrMissingToken, "missing_token"},
+	{ErrMalformedToken, "malformed_token"},
+	{ErrTokenExpired, "token_expired"},
+	{ErrTokenNotYetValid, "token_not_yet_valid"},
+	{ErrTokenIssuedInFuture, "token_issued_in_future"},
+	{ErrTokenTooOld, "token_too_old"},
+	{ErrTokenLifetimeTooLong, "token_lifetime_too_long"},
+	{ErrMissingTimeClaim, "missing_time_claim"},
+	{ErrForbidden, "forbidden"},
+	{ErrInsufficientUserAuthentication, "insufficient_user_authentication"},
+	{ErrLoginFailed, "login_failed"},
+}
+
+func reasonOf(err error) string {
+	for _, r := range reasons {
+		if errors.Is(err, r.err) {
+			return r.reason
+		}
+	}
+	return "invalid_token"
+}
+
+// rejected logs and counts a rejected request.
+func rejected(ctx context.Context, provider string, err error) {
+	reason := reasonOf(err)
+	metricsFrom(ctx).rejections.WithLabelValues(provider, reason).Inc()
+	LoggerFrom(ctx).WithField("reason", reason).Debugf("%s: rejecting request: %v", provider, err)
+}
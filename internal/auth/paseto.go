@@ -0,0 +1,267 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	pasetoHeader        = "v4.public."
+	paserkPublic        = "k4.public."
+	paserkPublicID      = "k4.pid."
+	pasetoSignatureSize = ed25519.SignatureSize
+)
+
+// PasetoKey is an Ed25519 public key for PASETO v4.public tokens.
+type PasetoKey struct {
+	// ID is matched against the "kid" in the token footer. Defaults to the
+	// PASERK key ID, "k4.pid.<hash>".
+	ID  string
+	Key ed25519.PublicKey
+}
+
+// ParsePasetoKey parses a public key, either as hex or as PASERK
+// "k4.public.<base64url>", optionally prefixed with "<kid>=".
+func ParsePasetoKey(s string) (PasetoKey, error) {
+	id, encoded, found := strings.Cut(strings.TrimSpace(s), "=")
+	if !found {
+		id, encoded = "", id
+	}
+
+	var b []byte
+	var err error
+	if v, ok := strings.CutPrefix(encoded, paserkPublic); ok {
+		b, err = base64.RawURLEncoding.DecodeString(v)
+	} else {
+		b, err = hex.DecodeString(encoded)
+	}
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return PasetoKey{}, errors.New("expected a hex or PASERK k4.public Ed25519 public key")
+	}
+
+	key := PasetoKey{ID: id, Key: ed25519.PublicKey(b)}
+	if key.ID == "" {
+		key.ID = paserkID(key.Key)
+	}
+	return key, nil
+}
+
+// paserkID is the PASERK "k4.pid" of a public key.
+func paserkID(key ed25519.PublicKey) string {
+	h, _ := blake2b.New(33, nil)
+	h.Write([]byte(paserkPublicID))
+	h.Write([]byte(paserkPublic + base64.RawURLEncoding.EncodeToString(key)))
+	return paserkPublicID + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// PasetoAuth verifies PASETO v4.public tokens, which are signed with Ed25519
+// and carry no algorithm header that could be confused.
+type PasetoAuth struct {
+	AuthHeader     string
+	RequiredClaims map[string]any
+	Policy         TokenPolicy
+	// Realm is used in WWW-Authenticate challenges.
+	Realm string
+	// Credentials is whether the token is passed upstream, it is kept by
+	// default.
+	Credentials  CredentialPolicy
+	tokenSources []TokenSource
+	keys         []PasetoKey
+}
+
+var _ authenticator = &PasetoAuth{}
+
+func Paseto(authHeader string, requiredClaims map[string]any, keys ...PasetoKey) *PasetoAuth {
+	return &PasetoAuth{
+		AuthHeader:     authHeader,
+		RequiredClaims: requiredClaims,
+		Policy: TokenPolicy{
+			ClockSkew: AcceptableClockSkew,
+		},
+		keys: keys,
+	}
+}
+
+// WithTokenSources sets where to look for the token, in order. Defaults to
+// AuthHeader, see DefaultTokenSource: Authorization requires the "Bearer"
+// scheme, any other header holds the bare token.
+func (p *PasetoAuth) WithTokenSources(sources ...TokenSource) *PasetoAuth {
+	p.tokenSources = sources
+	return p
+}
+
+func (p *PasetoAuth) Handler() (Handler, error) {
+	return authHandler(p, false)
+}
+
+func (p *PasetoAuth) Authenticate(r *http.Request) (*Principal, error) {
+	token, err := extractToken(r, p.sources())
+	if err != nil {
+		return nil, err
+	}
+	claims, err := p.validate(token)
+	if err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	return &Principal{
+		Provider: "paseto",
+		Subject:  sub,
+		Claims:   claims,
+	}, nil
+}
+
+func (p *PasetoAuth) setup() (denier, error) {
+	if len(p.keys) == 0 {
+		return denier{}, errors.New("no keys configured for PASETO auth provider")
+	}
+	return newDenier("paseto", p.Realm, p.sources()), nil
+}
+
+func (p *PasetoAuth) credentials() CredentialPolicy {
+	return p.Credentials
+}
+
+func (p *PasetoAuth) SetCredentialPolicy(policy CredentialPolicy) {
+	p.Credentials = policy
+}
+
+func (p *PasetoAuth) sources() []TokenSource {
+	if len(p.tokenSources) == 0 {
+		return []TokenSource{DefaultTokenSource(p.AuthHeader)}
+	}
+	return p.tokenSources
+}
+
+func (p *PasetoAuth) validate(token string) (map[string]any, error) {
+	message, err := p.verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("verifying paseto: %w", err)
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(message, &claims); err != nil {
+		return nil, fmt.Errorf("parsing paseto claims: %w", err)
+	}
+
+	times, err := pasetoTimeClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Policy.Check(time.Now(), times); err != nil {
+		return nil, err
+	}
+
+	// as for JWTs, a token for another issuer or audience is invalid, while
+	// a token lacking any other required claim is valid but not allowed
+	for k, v := range p.RequiredClaims {
+		if claimMatches(claims[k], v) {
+			continue
+		}
+		if k == "iss" || k == "aud" {
+			return nil, fmt.Errorf("%q claim does not match", k)
+		}
+		return nil, fmt.Errorf("%w: %q claim does not match", ErrForbidden, k)
+	}
+	return claims, nil
+}
+
+// verify checks the signature of a v4.public token and returns its message.
+// If the footer has a key ID only the key with that ID is tried.
+func (p *PasetoAuth) verify(token string) ([]byte, error) {
+	body, ok := strings.CutPrefix(token, pasetoHeader)
+	if !ok {
+		return nil, errors.New("not a v4.public token")
+	}
+	payload, encodedFooter, _ := strings.Cut(body, ".")
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || len(b) < pasetoSignatureSize {
+		return nil, errors.New("invalid payload encoding")
+	}
+	footer, err := base64.RawURLEncoding.DecodeString(encodedFooter)
+	if err != nil {
+		return nil, errors.New("invalid footer encoding")
+	}
+	message, sig := b[:len(b)-pasetoSignatureSize], b[len(b)-pasetoSignatureSize:]
+
+	kid := footerKeyID(footer)
+	signed := pae([]byte(pasetoHeader), message, footer, nil)
+	for _, key := range p.keys {
+		if kid != "" && key.ID != kid {
+			continue
+		}
+		if ed25519.Verify(key.Key, signed, sig) {
+			return message, nil
+		}
+	}
+	if kid != "" {
+		return nil, fmt.Errorf("no valid signature for key %q", kid)
+	}
+	return nil, errors.New("no valid signature")
+}
+
+// footerKeyID returns the "kid" of a JSON footer, if any.
+func footerKeyID(footer []byte) string {
+	var f struct {
+		KeyID string `json:"kid"`
+	}
+	if len(footer) == 0 || footer[0] != '{' || json.Unmarshal(footer, &f) != nil {
+		return ""
+	}
+	return f.KeyID
+}
+
+// pae is the pre-authentication encoding from the PASETO spec, which
+// prefixes the number of pieces and each piece with its length as an
+// unsigned 64-bit little-endian integer.
+func pae(pieces ...[]byte) []byte {
+	b := binary.LittleEndian.AppendUint64(nil, uint64(len(pieces)))
+	for _, piece := range pieces {
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(piece))&^(1<<63))
+		b = append(b, piece...)
+	}
+	return b
+}
+
+// pasetoTimeClaims reads the RFC 3339 "iat", "exp" and "nbf" claims.
+func pasetoTimeClaims(claims map[string]any) (TimeClaims, error) {
+	var c TimeClaims
+	for name, dst := range map[string]*time.Time{"iat": &c.IssuedAt, "exp": &c.Expiration, "nbf": &c.NotBefore} {
+		v, ok := claims[name]
+		if !ok {
+			continue
+		}
+		s, _ := v.(string)
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return c, fmt.Errorf("invalid %q claim: %v", name, v)
+		}
+		*dst = t
+	}
+	return c, nil
+}
+
+// claimMatches compares a claim to an expected value. For arrays, such as
+// "aud", any element may match.
+func claimMatches(claim, expected any) bool {
+	if values, ok := claim.([]any); ok {
+		for _, v := range values {
+			if v == expected {
+				return true
+			}
+		}
+		return false
+	}
+	return claim == expected
+}
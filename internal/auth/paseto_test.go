@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPasetoVector verifies the official v4.public test vector 4-S-1.
+func TestPasetoVector(t *testing.T) {
+	key, err := ParsePasetoKey("1eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2")
+	assert.NoError(t, err)
+
+	message, err := Paseto("", nil, key).verify("v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`, string(message))
+}
+
+func TestPaseto(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	rotated, rotatedPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	_, unknown, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	key, err := ParsePasetoKey(hex.EncodeToString(public))
+	assert.NoError(t, err)
+	rotatedKey, err := ParsePasetoKey("second=k4.public." + base64.RawURLEncoding.EncodeToString(rotated))
+	assert.NoError(t, err)
+	assert.Equal(t, "second", rotatedKey.ID)
+
+	provider, err := testProvider(Paseto("Authorization", map[string]any{
+		"iss":   "issuer",
+		"aud":   "yolo",
+		"group": "admins",
+	}, key, rotatedKey))
+	assert.NoError(t, err)
+
+	now := time.Now()
+	claims := func(overrides ...any) map[string]any {
+		c := map[string]any{
+			"iss":   "issuer",
+			"aud":   "yolo",
+			"sub":   "alice",
+			"group": "admins",
+			"iat":   now.Format(time.RFC3339),
+			"exp":   now.Add(time.Hour).Format(time.RFC3339),
+		}
+		for i := 0; i < len(overrides); i += 2 {
+			c[overrides[i].(string)] = overrides[i+1]
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"valid", pasetoToken(t, private, claims(), ""), http.StatusOK},
+		{"footer with key id", pasetoToken(t, private, claims(), `{"kid":"`+key.ID+`"}`), http.StatusOK},
+		{"rotated key", pasetoToken(t, rotatedPrivate, claims(), `{"kid":"second"}`), http.StatusOK},
+		{"audience in array", pasetoToken(t, private, claims("aud", []string{"other", "yolo"}), ""), http.StatusOK},
+		{"wrong key id", pasetoToken(t, private, claims(), `{"kid":"second"}`), http.StatusUnauthorized},
+		{"unknown key", pasetoToken(t, unknown, claims(), ""), http.StatusUnauthorized},
+		{"expired", pasetoToken(t, private, claims("exp", now.Add(-time.Minute).Format(time.RFC3339)), ""), http.StatusUnauthorized},
+		{"not yet valid", pasetoToken(t, private, claims("nbf", now.Add(time.Hour).Format(time.RFC3339)), ""), http.StatusUnauthorized},
+		{"invalid time", pasetoToken(t, private, claims("exp", "tomorrow"), ""), http.StatusUnauthorized},
+		{"wrong issuer", pasetoToken(t, private, claims("iss", "other"), ""), http.StatusUnauthorized},
+		{"wrong audience", pasetoToken(t, private, claims("aud", "other"), ""), http.StatusUnauthorized},
+		{"lacking required claim", pasetoToken(t, private, claims("group", "users"), ""), http.StatusForbidden},
+		{"local token", "v4.local.abc", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := provider.withRequest("Authorization", "Bearer "+tt.token)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.status, rr.Code)
+		})
+	}
+}
+
+func TestParsePasetoKey(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	key, err := ParsePasetoKey(hex.EncodeToString(public))
+	assert.NoError(t, err)
+	assert.Regexp(t, `^k4\.pid\.[A-Za-z0-9_-]{44}$`, key.ID)
+
+	_, err = ParsePasetoKey("k4.public.short")
+	assert.Error(t, err)
+	_, err = ParsePasetoKey("not hex")
+	assert.Error(t, err)
+}
+
+func pasetoToken(t *testing.T, key ed25519.PrivateKey, claims map[string]any, footer string) string {
+	message, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	sig := ed25519.Sign(key, pae([]byte(pasetoHeader), message, []byte(footer), nil))
+	token := pasetoHeader + base64.RawURLEncoding.EncodeToString(append(message, sig...))
+	if footer != "" {
+		token += "." + base64.RawURLEncoding.EncodeToString([]byte(footer))
+	}
+	return token
+}
@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrTokenExpired         = errors.New("token expired")
+	ErrTokenNotYetValid     = errors.New("token not yet valid")
+	ErrTokenIssuedInFuture  = errors.New("token issued in the future")
+	ErrTokenTooOld          = errors.New("token too old")
+	ErrTokenLifetimeTooLong = errors.New("token lifetime too long")
+	ErrMissingTimeClaim     = errors.New("missing required time claim")
+)
+
+// TokenPolicy decides whether a token is acceptable based on its time claims.
+type TokenPolicy struct {
+	// ClockSkew is the leeway applied to all time comparisons.
+	ClockSkew time.Duration
+	// StrictExpiry applies ClockSkew to "nbf", "iat" and MaxAge only, so that
+	// a token is rejected as soon as it expires.
+	StrictExpiry bool
+	// MaxAge is the maximum time since the token was issued ("iat"), 0 means
+	// no limit.
+	MaxAge time.Duration
+	// MaxLifetime is the maximum total lifetime of the token ("exp" - "iat"),
+	// 0 means no limit.
+	MaxLifetime time.Duration
+	RequireExp  bool
+	RequireIat  bool
+	RequireNbf  bool
+}
+
+// TimeClaims are the registered time claims of a token. Absent claims are the
+// zero time.
+type TimeClaims struct {
+	IssuedAt   time.Time
+	Expiration time.Time
+	NotBefore  time.Time
+}
+
+func (p TokenPolicy) Check(now time.Time, c TimeClaims) error {
+	if err := p.checkRequired(c); err != nil {
+		return err
+	}
+
+	expirySkew := p.ClockSkew
+	if p.StrictExpiry {
+		expirySkew = 0
+	}
+	if !c.Expiration.IsZero() && !now.Before(c.Expiration.Add(expirySkew)) {
+		return fmt.Errorf("%w: expired at %s", ErrTokenExpired, c.Expiration.UTC().Format(time.RFC3339))
+	}
+	if !c.NotBefore.IsZero() && now.Add(p.ClockSkew).Before(c.NotBefore) {
+		return fmt.Errorf("%w: valid from %s", ErrTokenNotYetValid, c.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if !c.IssuedAt.IsZero() && c.IssuedAt.After(now.Add(p.ClockSkew)) {
+		return fmt.Errorf("%w: issued at %s", ErrTokenIssuedInFuture, c.IssuedAt.UTC().Format(time.RFC3339))
+	}
+
+	if p.MaxAge > 0 {
+		if c.IssuedAt.IsZero() {
+			return fmt.Errorf("%w: iat is required to check token age", ErrMissingTimeClaim)
+		}
+		if age := now.Sub(c.IssuedAt); age > p.MaxAge+p.ClockSkew {
+			return fmt.Errorf("%w: issued %s ago, max age is %s", ErrTokenTooOld, age.Round(time.Second), p.MaxAge)
+		}
+	}
+
+	if p.MaxLifetime > 0 {
+		if c.IssuedAt.IsZero() || c.Expiration.IsZero() {
+			return fmt.Errorf("%w: iat and exp are required to check token lifetime", ErrMissingTimeClaim)
+		}
+		if lifetime := c.Expiration.Sub(c.IssuedAt); lifetime > p.MaxLifetime {
+			return fmt.Errorf("%w: lifetime is %s, max lifetime is %s", ErrTokenLifetimeTooLong, lifetime, p.MaxLifetime)
+		}
+	}
+
+	return nil
+}
+
+func (p TokenPolicy) checkRequired(c TimeClaims) error {
+	switch {
+	case p.RequireExp && c.Expiration.IsZero():
+		return fmt.Errorf("%w: exp", ErrMissingTimeClaim)
+	case p.RequireIat && c.IssuedAt.IsZero():
+		return fmt.Errorf("%w: iat", ErrMissingTimeClaim)
+	case p.RequireNbf && c.NotBefore.IsZero():
+		return fmt.Errorf("%w: nbf", ErrMissingTimeClaim)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenPolicy(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		policy TokenPolicy
+		claims TimeClaims
+		err    error
+	}{
+		{
+			name:   "valid token",
+			policy: TokenPolicy{ClockSkew: 5 * time.Second, RequireExp: true},
+			claims: TimeClaims{IssuedAt: now, Expiration: now.Add(time.Hour)},
+		},
+		{
+			name:   "expired within skew",
+			policy: TokenPolicy{ClockSkew: 5 * time.Second},
+			claims: TimeClaims{Expiration: now.Add(-2 * time.Second)},
+		},
+		{
+			name:   "expired",
+			policy: TokenPolicy{ClockSkew: 5 * time.Second},
+			claims: TimeClaims{Expiration: now.Add(-10 * time.Second)},
+			err:    ErrTokenExpired,
+		},
+		{
+			name:   "expired within skew with strict expiry",
+			policy: TokenPolicy{ClockSkew: 5 * time.Second, StrictExpiry: true},
+			claims: TimeClaims{Expiration: now.Add(-2 * time.Second)},
+			err:    ErrTokenExpired,
+		},
+		{
+			name:   "issued in the future within skew with strict expiry",
+			policy: TokenPolicy{ClockSkew: 30 * time.Second, StrictExpiry: true},
+			claims: TimeClaims{IssuedAt: now.Add(20 * time.Second), Expiration: now.Add(time.Hour)},
+		},
+		{
+			name:   "not yet valid",
+			policy: TokenPolicy{ClockSkew: 5 * time.Second},
+			claims: TimeClaims{NotBefore: now.Add(time.Minute)},
+			err:    ErrTokenNotYetValid,
+		},
+		{
+			name:   "issued in the future",
+			policy: TokenPolicy{ClockSkew: 30 * time.Second},
+			claims: TimeClaims{IssuedAt: now.Add(40 * time.Second)},
+			err:    ErrTokenIssuedInFuture,
+		},
+		{
+			name:   "too old",
+			policy: TokenPolicy{MaxAge: time.Hour},
+			claims: TimeClaims{IssuedAt: now.Add(-2 * time.Hour), Expiration: now.Add(time.Hour)},
+			err:    ErrTokenTooOld,
+		},
+		{
+			name:   "max age without iat",
+			policy: TokenPolicy{MaxAge: time.Hour},
+			claims: TimeClaims{Expiration: now.Add(time.Hour)},
+			err:    ErrMissingTimeClaim,
+		},
+		{
+			name:   "lifetime too long",
+			policy: TokenPolicy{MaxLifetime: time.Hour},
+			claims: TimeClaims{IssuedAt: now, Expiration: now.Add(24 * time.Hour)},
+			err:    ErrTokenLifetimeTooLong,
+		},
+		{
+			name:   "missing exp",
+			policy: TokenPolicy{RequireExp: true},
+			claims: TimeClaims{IssuedAt: now},
+			err:    ErrMissingTimeClaim,
+		},
+		{
+			name:   "missing nbf",
+			policy: TokenPolicy{RequireNbf: true},
+			claims: TimeClaims{IssuedAt: now, Expiration: now.Add(time.Hour)},
+			err:    ErrMissingTimeClaim,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(now, tt.claims)
+			if tt.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestReasonOf(t *testing.T) {
+	assert.Equal(t, "token_too_old", reasonOf(ErrTokenTooOld))
+	assert.Equal(t, "missing_token", reasonOf(ErrMissingToken))
+	assert.Equal(t, "invalid_token", reasonOf(ErrInvalidToken))
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"context"
+)
+
+// Principal is the verified identity of an authenticated request.
+type Principal struct {
+	// Provider is the name of the auth provider that verified the request.
+	Provider string
+	// Subject identifies the caller, i.e. the "sub" claim of a token.
+	Subject string
+	// Claims are the verified claims of the token, if any.
+	Claims map[string]any
+	// Token is the verified token as received, for providers whose tokens
+	// can be exchanged for an upstream token. It must never be logged.
+	Token string
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal of an authenticated request.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptional(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+	jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+	h, err := Optional(jwtProvider.WithJWKSCache(cache)).Handler()
+	assert.NoError(t, err)
+
+	valid, err := token(time.Now(), time.Hour).with("aud", "yolo").with("sub", "alice").sign(jwks)
+	assert.NoError(t, err)
+	expired, err := token(time.Now().Add(-2*time.Hour), time.Hour).with("aud", "yolo").sign(jwks)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		headers []string
+		status  int
+		auth    string
+		subject string
+	}{
+		{
+			name:    "no credentials",
+			headers: nil,
+			status:  http.StatusOK,
+			auth:    StatusAnonymous,
+		},
+		{
+			name:    "spoofed identity headers are removed",
+			headers: []string{AuthStatusHeader, StatusAuthenticated, AuthSubjectHeader, "mallory"},
+			status:  http.StatusOK,
+			auth:    StatusAnonymous,
+		},
+		{
+			name:    "valid token",
+			headers: []string{"Authorization", "Bearer " + valid, AuthSubjectHeader, "mallory"},
+			status:  http.StatusOK,
+			auth:    StatusAuthenticated,
+			subject: "alice",
+		},
+		{
+			name:    "invalid token",
+			headers: []string{"Authorization", "Bearer " + expired},
+			status:  http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := req(tt.headers...)
+			assert.NoError(t, err)
+
+			var upstream *http.Request
+			rr := httptest.NewRecorder()
+			h(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r
+			})).ServeHTTP(rr, r)
+
+			assert.Equal(t, tt.status, rr.Code)
+			if tt.status != http.StatusOK {
+				assert.Nil(t, upstream)
+				return
+			}
+			assert.Equal(t, tt.auth, upstream.Header.Get(AuthStatusHeader))
+			assert.Equal(t, tt.subject, upstream.Header.Get(AuthSubjectHeader))
+
+			principal, ok := PrincipalFrom(upstream.Context())
+			assert.Equal(t, tt.auth == StatusAuthenticated, ok)
+			if ok {
+				assert.Equal(t, "jwt", principal.Provider)
+				assert.Equal(t, tt.subject, principal.Subject)
+			}
+		})
+	}
+}
+
+func TestOptionalUnsupportedProvider(t *testing.T) {
+	_, err := Optional(NoOp()).Handler()
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// MinCookieSecretLength is the minimum length of the secret used to protect
+// session cookies.
+const MinCookieSecretLength = 32
+
+// cookieChunkSize keeps each cookie below the 4096 byte limit of browsers,
+// leaving room for the name and attributes.
+const cookieChunkSize = 3800
+
+// sessionCodec encrypts and authenticates cookie values with AES-GCM, so
+// they can neither be read nor modified by the client. The cookie name is
+// used as additional data, so a value can't be moved to another cookie.
+type sessionCodec struct {
+	aead cipher.AEAD
+}
+
+func newSessionCodec(secret []byte) (*sessionCodec, error) {
+	if len(secret) < MinCookieSecretLength {
+		return nil, fmt.Errorf("cookie secret must be at least %d bytes", MinCookieSecretLength)
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionCodec{aead: aead}, nil
+}
+
+func (c *sessionCodec) seal(name string, v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, b, []byte(name))), nil
+}
+
+func (c *sessionCodec) open(name, value string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) < c.aead.NonceSize() {
+		return errors.New("invalid cookie encoding")
+	}
+	nonce, ciphertext := b[:c.aead.NonceSize()], b[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return errors.New("invalid cookie")
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// cookieJar reads and writes values that may be too large for a single
+// cookie by splitting them into "<name>", "<name>_1", "<name>_2" and so on.
+type cookieJar struct {
+	secure bool
+}
+
+func (j cookieJar) read(r *http.Request, name string) (string, bool) {
+	var sb strings.Builder
+	for i := 0; ; i++ {
+		c, err := r.Cookie(chunkName(name, i))
+		if err != nil {
+			break
+		}
+		sb.WriteString(c.Value)
+	}
+	return sb.String(), sb.Len() > 0
+}
+
+func (j cookieJar) write(w http.ResponseWriter, r *http.Request, name, value string, maxAge int) {
+	n := 0
+	for ; len(value) > 0; n++ {
+		size := min(cookieChunkSize, len(value))
+		http.SetCookie(w, j.cookie(chunkName(name, n), value[:size], maxAge))
+		value = value[size:]
+	}
+	// remove chunks left over from a larger value
+	for ; ; n++ {
+		if _, err := r.Cookie(chunkName(name, n)); err != nil {
+			return
+		}
+		http.SetCookie(w, j.cookie(chunkName(name, n), "", -1))
+	}
+}
+
+func (j cookieJar) clear(w http.ResponseWriter, r *http.Request, name string) {
+	j.write(w, r, name, "", -1)
+}
+
+func (j cookieJar) cookie(name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   j.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func chunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s_%d", name, i)
+}
+
+// removeCookies removes the cookies named prefix or prefixed with
+// "<prefix>_" from the request, so they aren't passed upstream.
+func removeCookies(r *http.Request, prefix string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name == prefix || strings.HasPrefix(c.Name, prefix+"_") {
+			continue
+		}
+		r.AddCookie(c)
+	}
+}
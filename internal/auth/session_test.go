@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionCodec(t *testing.T) {
+	_, err := newSessionCodec([]byte("too short"))
+	assert.Error(t, err)
+
+	codec, err := newSessionCodec([]byte(strings.Repeat("s", MinCookieSecretLength)))
+	assert.NoError(t, err)
+
+	value, err := codec.seal("session", session{Subject: "alice"})
+	assert.NoError(t, err)
+
+	var s session
+	assert.NoError(t, codec.open("session", value, &s))
+	assert.Equal(t, "alice", s.Subject)
+
+	// values are bound to the cookie name
+	assert.Error(t, codec.open("other", value, &s))
+	assert.Error(t, codec.open("session", value[:len(value)-2]+"AA", &s))
+}
+
+func TestCookieJarChunks(t *testing.T) {
+	jar := cookieJar{secure: true}
+	value := strings.Repeat("x", 2*cookieChunkSize+10)
+
+	rr := httptest.NewRecorder()
+	jar.write(rr, httptest.NewRequest(http.MethodGet, "/", nil), "session", value, 60)
+	cookies := rr.Result().Cookies()
+	assert.Len(t, cookies, 3)
+	assert.Equal(t, "session_2", cookies[2].Name)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	read, ok := jar.read(r, "session")
+	assert.True(t, ok)
+	assert.Equal(t, value, read)
+
+	// a smaller value removes the chunks that are no longer used
+	rr = httptest.NewRecorder()
+	jar.write(rr, r, "session", "small", 60)
+	cookies = rr.Result().Cookies()
+	assert.Len(t, cookies, 3)
+	assert.Equal(t, "small", cookies[0].Value)
+	assert.Negative(t, cookies[1].MaxAge)
+	assert.Negative(t, cookies[2].MaxAge)
+}
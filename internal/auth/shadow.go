@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DecisionAllow = "allow"
+	DecisionDeny  = "deny"
+)
+
+var _ Provider = &ShadowAuth{}
+
+// ShadowAuth evaluates a candidate provider on every request next to the
+// enforcing provider. The decision of the shadow provider is only logged and
+// counted, the response is always decided by the enforcing provider.
+type ShadowAuth struct {
+	enforcing Provider
+	shadow    Provider
+}
+
+func Shadow(enforcing, shadow Provider) *ShadowAuth {
+	return &ShadowAuth{
+		enforcing: enforcing,
+		shadow:    shadow,
+	}
+}
+
+func (s *ShadowAuth) Handler() (Handler, error) {
+	a, ok := s.shadow.(authenticator)
+	if !ok {
+		return nil, fmt.Errorf("auth provider %T can't be used as shadow provider", s.shadow)
+	}
+	d, err := a.setup()
+	if err != nil {
+		return nil, fmt.Errorf("shadow provider: %w", err)
+	}
+	enforce, err := s.enforcing.Handler()
+	if err != nil {
+		return nil, err
+	}
+
+	// query parameters the shadow provider reads are removed once the
+	// enforcing provider is done, tokens never reach the upstream
+	query := queryOnly(a.sources())
+
+	return func(h http.Handler) http.Handler {
+		next := enforce(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			removeCredentials(r, query)
+			h.ServeHTTP(w, r)
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			evaluate(a, d.provider, r)
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// evaluate authenticates a copy of the request, so the shadow provider can't
+// modify what the enforcing provider sees, e.g. by removing query parameters.
+func evaluate(a Authenticator, provider string, r *http.Request) {
+	_, err := a.Authenticate(r.Clone(r.Context()))
+
+	decision, reason := DecisionAllow, "ok"
+	if err != nil {
+		decision, reason = DecisionDeny, reasonOf(err)
+	}
+	metricsFrom(r.Context()).shadowDecisions.WithLabelValues(provider, decision, reason).Inc()
+
+	entry := LoggerFrom(r.Context()).WithFields(log.Fields{
+		"shadow_provider": provider,
+		"shadow_decision": decision,
+		"reason":          reason,
+	})
+	if err != nil {
+		entry.Infof("shadow: %s would deny request: %v", provider, err)
+		return
+	}
+	entry.Debugf("shadow: %s would allow request", provider)
+}
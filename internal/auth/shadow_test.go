@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadow(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+	jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+
+	provider, err := testProvider(Shadow(PreSharedKey("X-Api-Key", "FooBar123"), jwtProvider.WithJWKSCache(cache)))
+	assert.NoError(t, err)
+
+	valid, err := token(time.Now(), time.Hour).with("aud", "yolo").sign(jwks)
+	assert.NoError(t, err)
+
+	allowed := counterValue(unregistered.shadowDecisions.WithLabelValues("jwt", DecisionAllow, "ok"))
+	denied := counterValue(unregistered.shadowDecisions.WithLabelValues("jwt", DecisionDeny, "missing_token"))
+
+	// the enforcing provider decides, the shadow provider would deny
+	r1, err := provider.withRequest("X-Api-Key", "FooBar123")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r1.Code)
+	assert.Equal(t, denied+1, counterValue(unregistered.shadowDecisions.WithLabelValues("jwt", DecisionDeny, "missing_token")))
+
+	// the shadow provider would allow, the enforcing provider rejects
+	r2, err := provider.withRequest("Authorization", "Bearer "+valid)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r2.Code)
+	assert.Equal(t, allowed+1, counterValue(unregistered.shadowDecisions.WithLabelValues("jwt", DecisionAllow, "ok")))
+}
+
+func TestShadowUnsupportedProvider(t *testing.T) {
+	_, err := Shadow(PreSharedKey("X-Api-Key", "FooBar123"), NoOp()).Handler()
+	assert.Error(t, err)
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		panic(err)
+	}
+	return m.GetCounter().GetValue()
+}
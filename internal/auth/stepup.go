@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// ErrInsufficientUserAuthentication is wrapped by errors for tokens with a
+// valid signature, but from a login that is too weak or too old for the
+// requested path.
+var ErrInsufficientUserAuthentication = errors.New("insufficient user authentication")
+
+// StepUpError describes the authentication a client must step up to, as
+// described in RFC 9470.
+type StepUpError struct {
+	// ACRValues are the acceptable acr values, in order of preference.
+	ACRValues []string
+	MaxAge    time.Duration
+	reason    string
+}
+
+func (e *StepUpError) Error() string {
+	return ErrInsufficientUserAuthentication.Error() + ": " + e.reason
+}
+
+func (e *StepUpError) Is(target error) bool {
+	return target == ErrInsufficientUserAuthentication
+}
+
+// userAuthentication returns the "acr" and "auth_time" claims of a token.
+func userAuthentication(t jwt.Token) (string, time.Time) {
+	var acr string
+	if v, ok := t.Get("acr"); ok {
+		acr, _ = v.(string)
+	}
+
+	var authTime time.Time
+	if v, ok := t.Get("auth_time"); ok {
+		switch v := v.(type) {
+		case float64:
+			authTime = time.Unix(int64(v), 0)
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				authTime = time.Unix(i, 0)
+			}
+		}
+	}
+	return acr, authTime
+}
+
+// params are the RFC 9470 challenge parameters.
+func (e *StepUpError) params() []Param {
+	var params []Param
+	if len(e.ACRValues) > 0 {
+		params = append(params, Param{"acr_values", strings.Join(e.ACRValues, " ")})
+	}
+	if e.MaxAge > 0 {
+		params = append(params, Param{"max_age", strconv.Itoa(int(e.MaxAge.Seconds()))})
+	}
+	return params
+}
+
+// StepUpRule is the authentication required for paths with the given
+// prefix.
+type StepUpRule struct {
+	PathPrefix string
+	// ACRValues are the accepted "acr" values. If the policy has levels, the
+	// lowest of these is the minimum level and any stronger level is accepted
+	// as well.
+	ACRValues []string
+	// MaxAge is the maximum time since the user logged in, taken from the
+	// "auth_time" claim.
+	MaxAge time.Duration
+}
+
+// StepUpPolicy requires stronger or more recent logins for some paths. The
+// rule with the longest matching path prefix applies.
+type StepUpPolicy struct {
+	// Levels orders acr values from the weakest to the strongest.
+	Levels []string
+	Rules  []StepUpRule
+}
+
+// Check verifies the "acr" and "auth_time" of a token for a request path.
+func (p *StepUpPolicy) Check(now time.Time, skew time.Duration, path, acr string, authTime time.Time) error {
+	rule, ok := p.rule(path)
+	if !ok {
+		return nil
+	}
+
+	accepted := p.accepted(rule)
+	if len(accepted) > 0 && !slices.Contains(accepted, acr) {
+		return &StepUpError{ACRValues: accepted, MaxAge: rule.MaxAge, reason: "acr " + strconv.Quote(acr) + " not accepted"}
+	}
+	if rule.MaxAge > 0 {
+		if authTime.IsZero() {
+			return &StepUpError{ACRValues: accepted, MaxAge: rule.MaxAge, reason: "missing auth_time"}
+		}
+		if now.Sub(authTime) > rule.MaxAge+skew {
+			return &StepUpError{ACRValues: accepted, MaxAge: rule.MaxAge, reason: "authentication too old"}
+		}
+	}
+	return nil
+}
+
+func (p *StepUpPolicy) rule(path string) (StepUpRule, bool) {
+	var match StepUpRule
+	found := false
+	for _, r := range p.Rules {
+		if strings.HasPrefix(path, r.PathPrefix) && (!found || len(r.PathPrefix) > len(match.PathPrefix)) {
+			match, found = r, true
+		}
+	}
+	return match, found
+}
+
+// accepted returns the acr values accepted by a rule, strongest last if the
+// policy has levels.
+func (p *StepUpPolicy) accepted(rule StepUpRule) []string {
+	if len(p.Levels) == 0 || len(rule.ACRValues) == 0 {
+		return rule.ACRValues
+	}
+	minimum := -1
+	for _, acr := range rule.ACRValues {
+		if i := slices.Index(p.Levels, acr); i >= 0 && (minimum < 0 || i < minimum) {
+			minimum = i
+		}
+	}
+	if minimum < 0 {
+		return rule.ACRValues
+	}
+	return p.Levels[minimum:]
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStepUpPolicyCheck(t *testing.T) {
+	now := time.Now()
+	policy := &StepUpPolicy{
+		Levels: []string{"Level3", "Level4", "Level5"},
+		Rules: []StepUpRule{
+			{PathPrefix: "/payments", ACRValues: []string{"Level4"}},
+			{PathPrefix: "/payments/approve", ACRValues: []string{"Level4"}, MaxAge: 5 * time.Minute},
+			{PathPrefix: "/profile", MaxAge: time.Hour},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		acr      string
+		authTime time.Time
+		accepted []string
+		ok       bool
+	}{
+		{"no rule", "/", "Level3", time.Time{}, nil, true},
+		{"minimum level", "/payments", "Level4", time.Time{}, nil, true},
+		{"stronger level", "/payments", "Level5", time.Time{}, nil, true},
+		{"weaker level", "/payments", "Level3", time.Time{}, []string{"Level4", "Level5"}, false},
+		{"unknown level", "/payments", "other", time.Time{}, []string{"Level4", "Level5"}, false},
+		{"longest prefix wins", "/payments/approve", "Level4", now.Add(-time.Hour), []string{"Level4", "Level5"}, false},
+		{"recent login", "/payments/approve", "Level4", now.Add(-time.Minute), nil, true},
+		{"max age without acr", "/profile", "", now.Add(-time.Minute), nil, true},
+		{"missing auth_time", "/profile", "", time.Time{}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(now, 0, tt.path, tt.acr, tt.authTime)
+			if tt.ok {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInsufficientUserAuthentication)
+			var stepUp *StepUpError
+			assert.True(t, errors.As(err, &stepUp))
+			assert.Equal(t, tt.accepted, stepUp.ACRValues)
+		})
+	}
+}
+
+func TestStepUpPolicyWithoutLevels(t *testing.T) {
+	policy := &StepUpPolicy{
+		Rules: []StepUpRule{{PathPrefix: "/", ACRValues: []string{"mfa", "phr"}}},
+	}
+	assert.NoError(t, policy.Check(time.Now(), 0, "/", "phr", time.Time{}))
+	assert.Error(t, policy.Check(time.Now(), 0, "/", "pwd", time.Time{}))
+}
+
+func TestJWTStepUp(t *testing.T) {
+	url := "http://localhost:1234"
+	cache, jwks := jwksCache(url)
+	jwtProvider, err := JWT("Authorization", url, map[string]any{"aud": "yolo"})
+	assert.NoError(t, err)
+	jwtProvider.StepUp = &StepUpPolicy{
+		Rules: []StepUpRule{{PathPrefix: "/", ACRValues: []string{"mfa"}, MaxAge: 5 * time.Minute}},
+	}
+	provider, err := testProvider(jwtProvider.WithJWKSCache(cache))
+	assert.NoError(t, err)
+
+	weak, err := token(time.Now(), time.Hour).with("aud", "yolo").with("acr", "pwd").with("auth_time", time.Now().Unix()).sign(jwks)
+	assert.NoError(t, err)
+	r1, err := provider.withRequest("Authorization", "Bearer "+weak)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, r1.Code)
+	assert.Equal(t, `Bearer realm="authproxy", error="insufficient_user_authentication", error_description="insufficient user authentication", acr_values="mfa", max_age="300"`, r1.Header().Get("WWW-Authenticate"))
+
+	strong, err := token(time.Now(), time.Hour).with("aud", "yolo").with("acr", "mfa").with("auth_time", time.Now().Unix()).sign(jwks)
+	assert.NoError(t, err)
+	r2, err := provider.withRequest("Authorization", "Bearer "+strong)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r2.Code)
+}
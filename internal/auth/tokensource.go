@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ErrMalformedToken is returned when a credential is present but can't be
+// parsed, e.g. an Authorization header with the wrong scheme.
+var ErrMalformedToken = errors.New("malformed token")
+
+// KubernetesWebSocketPrefix is the Sec-WebSocket-Protocol prefix used by
+// Kubernetes to carry bearer tokens for WebSocket connections.
+const KubernetesWebSocketPrefix = "base64url.bearer.authorization.k8s.io."
+
+// b64token is the token68 syntax from RFC 6750 section 2.1.
+var b64token = regexp.MustCompile(`^[A-Za-z0-9\-._~+/]+=*$`)
+
+// TokenSource extracts a token from a request.
+type TokenSource interface {
+	// Token returns the token, "" if the request has none or an error
+	// wrapping ErrMalformedToken if the credential can't be parsed.
+	Token(r *http.Request) (string, error)
+	String() string
+}
+
+var (
+	_ TokenSource = &HeaderTokenSource{}
+	_ TokenSource = &CookieTokenSource{}
+	_ TokenSource = &QueryTokenSource{}
+	_ TokenSource = &WebSocketTokenSource{}
+)
+
+// HeaderTokenSource reads a token from a request header. If Scheme is set the
+// header must be "<scheme> <token>", with the scheme matched
+// case-insensitively. For the "Basic" scheme the token is the password, or
+// the username if the password is empty.
+type HeaderTokenSource struct {
+	Name   string
+	Scheme string
+	// SchemeOptional also accepts a bare token without the scheme. It is
+	// never set by default, bare tokens are taken as they are.
+	SchemeOptional bool
+}
+
+func Header(name, scheme string) *HeaderTokenSource {
+	return &HeaderTokenSource{
+		Name:   name,
+		Scheme: scheme,
+	}
+}
+
+// DefaultTokenSource is used when no token sources are configured. The
+// Authorization header requires the "Bearer" scheme (RFC 6750), any other
+// header holds the bare token.
+func DefaultTokenSource(header string) *HeaderTokenSource {
+	if !strings.EqualFold(header, "Authorization") {
+		return Header(header, "")
+	}
+	return Header(header, "Bearer")
+}
+
+func (s *HeaderTokenSource) Token(r *http.Request) (string, error) {
+	values := r.Header.Values(s.Name)
+	if len(values) == 0 {
+		return "", nil
+	}
+	if len(values) > 1 {
+		return "", fmt.Errorf("%w: multiple %s headers", ErrMalformedToken, s.Name)
+	}
+	value := strings.TrimSpace(values[0])
+	if value == "" || s.Scheme == "" {
+		return value, nil
+	}
+
+	scheme, token, found := strings.Cut(value, " ")
+	if !found || !strings.EqualFold(scheme, s.Scheme) {
+		if s.SchemeOptional {
+			return value, nil
+		}
+		return "", fmt.Errorf("%w: expected %s scheme in %s header", ErrMalformedToken, s.Scheme, s.Name)
+	}
+
+	token = strings.TrimLeft(token, " ")
+	if token == "" || strings.ContainsAny(token, " \t") {
+		return "", fmt.Errorf("%w: expected a single token in %s header", ErrMalformedToken, s.Name)
+	}
+
+	switch {
+	case strings.EqualFold(s.Scheme, "Basic"):
+		return basicToken(token)
+	case strings.EqualFold(s.Scheme, "Bearer") && !b64token.MatchString(token):
+		return "", fmt.Errorf("%w: invalid characters in bearer token", ErrMalformedToken)
+	}
+	return token, nil
+}
+
+func (s *HeaderTokenSource) String() string {
+	return "header " + s.Name
+}
+
+func basicToken(credentials string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid basic credentials", ErrMalformedToken)
+	}
+	username, password, found := strings.Cut(string(b), ":")
+	if !found {
+		return "", fmt.Errorf("%w: invalid basic credentials", ErrMalformedToken)
+	}
+	if password == "" {
+		return username, nil
+	}
+	return password, nil
+}
+
+// CookieTokenSource reads a token from a named cookie.
+type CookieTokenSource struct {
+	Name string
+}
+
+func Cookie(name string) *CookieTokenSource {
+	return &CookieTokenSource{Name: name}
+}
+
+func (s *CookieTokenSource) Token(r *http.Request) (string, error) {
+	c, err := r.Cookie(s.Name)
+	if err != nil {
+		return "", nil
+	}
+	return c.Value, nil
+}
+
+func (s *CookieTokenSource) String() string {
+	return "cookie " + s.Name
+}
+
+// QueryTokenSource reads a token from a query parameter. The parameter is
+// removed from the request so it is neither proxied nor logged.
+type QueryTokenSource struct {
+	Name string
+}
+
+func Query(name string) *QueryTokenSource {
+	return &QueryTokenSource{Name: name}
+}
+
+func (s *QueryTokenSource) Token(r *http.Request) (string, error) {
+	query := r.URL.Query()
+	if !query.Has(s.Name) {
+		return "", nil
+	}
+	values := query[s.Name]
+	query.Del(s.Name)
+	r.URL.RawQuery = query.Encode()
+	r.RequestURI = r.URL.RequestURI()
+
+	if len(values) > 1 {
+		return "", fmt.Errorf("%w: multiple %s query parameters", ErrMalformedToken, s.Name)
+	}
+	return values[0], nil
+}
+
+func (s *QueryTokenSource) String() string {
+	return "query parameter " + s.Name
+}
+
+// WebSocketTokenSource reads a base64url encoded token from the
+// Sec-WebSocket-Protocol header, as the subprotocol following Prefix.
+type WebSocketTokenSource struct {
+	Prefix string
+}
+
+func WebSocketProtocol(prefix string) *WebSocketTokenSource {
+	if prefix == "" {
+		prefix = KubernetesWebSocketPrefix
+	}
+	return &WebSocketTokenSource{Prefix: prefix}
+}
+
+func (s *WebSocketTokenSource) Token(r *http.Request) (string, error) {
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			encoded, found := strings.CutPrefix(strings.TrimSpace(protocol), s.Prefix)
+			if !found {
+				continue
+			}
+			token, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+			if err != nil || len(token) == 0 {
+				return "", fmt.Errorf("%w: invalid token in Sec-WebSocket-Protocol", ErrMalformedToken)
+			}
+			return string(token), nil
+		}
+	}
+	return "", nil
+}
+
+func (s *WebSocketTokenSource) String() string {
+	return "Sec-WebSocket-Protocol " + s.Prefix
+}
+
+// extractToken returns the token from the first source that has one. Every
+// source is consulted so that query parameters are always removed from the
+// request, but a malformed credential in an earlier source wins.
+func extractToken(r *http.Request, sources []TokenSource) (string, error) {
+	var token string
+	var err error
+
+	for _, source := range sources {
+		t, e := source.Token(r)
+		if token != "" || err != nil {
+			continue
+		}
+		token, err = t, e
+	}
+
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		return "", fmt.Errorf("%w from %s", ErrMissingToken, describe(sources))
+	}
+	return token, nil
+}
+
+func describe(sources []TokenSource) string {
+	s := make([]string, len(sources))
+	for i, source := range sources {
+		s[i] = source.String()
+	}
+	return strings.Join(s, ", ")
+}
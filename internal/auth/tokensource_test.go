@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderTokenSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		source *HeaderTokenSource
+		header []string
+		token  string
+		err    error
+	}{
+		{
+			name:   "bearer token",
+			source: Header("Authorization", "Bearer"),
+			header: []string{"Bearer abc.def-ghi_jkl~"},
+			token:  "abc.def-ghi_jkl~",
+		},
+		{
+			name:   "scheme is case-insensitive",
+			source: Header("Authorization", "Bearer"),
+			header: []string{"bEaReR abc"},
+			token:  "abc",
+		},
+		{
+			name:   "missing header",
+			source: Header("Authorization", "Bearer"),
+		},
+		{
+			name:   "missing scheme",
+			source: Header("Authorization", "Bearer"),
+			header: []string{"abc"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "wrong scheme",
+			source: Header("Authorization", "Bearer"),
+			header: []string{"Basic abc"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "bearer not at the start",
+			source: Header("Authorization", "Bearer"),
+			header: []string{"abcBearer def"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "more than one token",
+			source: Header("Authorization", "Bearer"),
+			header: []string{"Bearer abc def"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "scheme without token",
+			source: Header("Authorization", "Bearer"),
+			header: []string{"Bearer "},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "invalid characters",
+			source: Header("Authorization", "Bearer"),
+			header: []string{"Bearer abc%"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "multiple headers",
+			source: Header("Authorization", "Bearer"),
+			header: []string{"Bearer abc", "Bearer def"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "optional scheme without scheme",
+			source: &HeaderTokenSource{Name: "X-Api-Key", Scheme: "Bearer", SchemeOptional: true},
+			header: []string{"abc%"},
+			token:  "abc%",
+		},
+		{
+			name:   "optional scheme validates bearer tokens",
+			source: &HeaderTokenSource{Name: "Authorization", Scheme: "Bearer", SchemeOptional: true},
+			header: []string{"Bearer abc%"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "default requires bearer scheme",
+			source: DefaultTokenSource("Authorization"),
+			header: []string{"abc"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "default rejects other schemes",
+			source: DefaultTokenSource("Authorization"),
+			header: []string{"Basic YWxpY2U6c2VjcmV0"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "default validates token68",
+			source: DefaultTokenSource("Authorization"),
+			header: []string{"Bearer abc%"},
+			err:    ErrMalformedToken,
+		},
+		{
+			name:   "default bearer in any case",
+			source: DefaultTokenSource("Authorization"),
+			header: []string{"BEARER abc.def"},
+			token:  "abc.def",
+		},
+		{
+			name:   "default custom header",
+			source: DefaultTokenSource("X-Api-Key"),
+			header: []string{"abc%"},
+			token:  "abc%",
+		},
+		{
+			name:   "no scheme",
+			source: Header("X-Api-Key", ""),
+			header: []string{" abc "},
+			token:  "abc",
+		},
+		{
+			name:   "basic password",
+			source: Header("Authorization", "Basic"),
+			header: []string{"Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))},
+			token:  "secret",
+		},
+		{
+			name:   "basic username",
+			source: Header("Authorization", "Basic"),
+			header: []string{"Basic " + base64.StdEncoding.EncodeToString([]byte("secret:"))},
+			token:  "secret",
+		},
+		{
+			name:   "basic not base64",
+			source: Header("Authorization", "Basic"),
+			header: []string{"Basic !!!"},
+			err:    ErrMalformedToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest("GET", "/", nil)
+			assert.NoError(t, err)
+			for _, h := range tt.header {
+				r.Header.Add(tt.source.Name, h)
+			}
+
+			token, err := tt.source.Token(r)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.token, token)
+		})
+	}
+}
+
+func TestQueryTokenSourceRemovesParameter(t *testing.T) {
+	r, err := http.NewRequest("GET", "/path?access_token=abc&foo=bar", nil)
+	assert.NoError(t, err)
+
+	token, err := Query("access_token").Token(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", token)
+	assert.Equal(t, "foo=bar", r.URL.RawQuery)
+	assert.Equal(t, "/path?foo=bar", r.RequestURI)
+}
+
+func TestWebSocketTokenSource(t *testing.T) {
+	r, err := http.NewRequest("GET", "/", nil)
+	assert.NoError(t, err)
+	encoded := base64.RawURLEncoding.EncodeToString([]byte("abc.def"))
+	r.Header.Set("Sec-WebSocket-Protocol", "v4.channel.k8s.io, "+KubernetesWebSocketPrefix+encoded)
+
+	token, err := WebSocketProtocol("").Token(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc.def", token)
+}
+
+func TestExtractToken(t *testing.T) {
+	sources := []TokenSource{Header("Authorization", "Bearer"), Cookie("token"), Query("access_token")}
+
+	r, err := http.NewRequest("GET", "/?access_token=fromquery", nil)
+	assert.NoError(t, err)
+	r.AddCookie(&http.Cookie{Name: "token", Value: "fromcookie"})
+
+	// first source with a token wins, later query parameters are still removed
+	token, err := extractToken(r, sources)
+	assert.NoError(t, err)
+	assert.Equal(t, "fromcookie", token)
+	assert.Empty(t, r.URL.RawQuery)
+
+	r, err = http.NewRequest("GET", "/", nil)
+	assert.NoError(t, err)
+	_, err = extractToken(r, sources)
+	assert.ErrorIs(t, err, ErrMissingToken)
+}
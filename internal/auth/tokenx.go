@@ -0,0 +1,18 @@
+package auth
+
+// TokenX returns a JWT provider for tokens exchanged with TokenX for the
+// application with the client ID. The issuer and the keys come from the
+// well-known URL.
+func TokenX(wellKnownURL, clientID string) (*JWTAuth, error) {
+	p, err := JWT("Authorization", "", map[string]any{"aud": clientID})
+	if err != nil {
+		return nil, err
+	}
+	return p.WithDiscovery(wellKnownURL), nil
+}
+
+// TokenXApps allows only tokens exchanged by the applications, given as
+// 'cluster:namespace:app'. A "*" matches any part, i.e. 'dev-gcp:team:*'.
+func TokenXApps(apps ...string) ClaimRule {
+	return ClaimRule{Claim: "client_id", Values: apps}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenX(t *testing.T) {
+	f := newFakeIssuer(t, "/.well-known/oauth-authorization-server", "")
+
+	p, err := TokenX(f.wellKnownURL, "dev-gcp:team:api")
+	assert.NoError(t, err)
+	p.Allowed = []ClaimRule{TokenXApps("dev-gcp:team:*", "dev-gcp:other:frontend")}
+
+	valid := func() *Token {
+		return token(time.Now(), time.Hour).
+			with("iss", f.issuer).
+			with("aud", "dev-gcp:team:api").
+			with("client_id", "dev-gcp:team:frontend").
+			with("pid", "12345678910")
+	}
+	identity := IdentityHeaders{
+		{Name: "X-Auth-Pid", Claim: "pid"},
+		{Name: "X-Auth-Client-Id", Claim: "client_id"},
+	}
+	f.run(t, p, identity, []issuerTest{
+		{
+			name:       "app in allowed namespace",
+			token:      valid(),
+			statusCode: http.StatusOK,
+			upstream:   map[string]string{"X-Auth-Pid": "12345678910", "X-Auth-Client-Id": "dev-gcp:team:frontend"},
+		},
+		{
+			name:       "allowed app",
+			token:      valid().with("client_id", "dev-gcp:other:frontend"),
+			statusCode: http.StatusOK,
+			upstream:   map[string]string{"X-Auth-Client-Id": "dev-gcp:other:frontend"},
+		},
+		{
+			name:       "machine to machine",
+			token:      valid().with("pid", nil),
+			statusCode: http.StatusOK,
+			upstream:   map[string]string{"X-Auth-Pid": "", "X-Auth-Client-Id": "dev-gcp:team:frontend"},
+		},
+		{
+			name:       "other audience",
+			token:      valid().with("aud", "dev-gcp:team:other-api"),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "other issuer",
+			token:      valid().with("iss", "https://tokenx.example.com"),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "app not allowed",
+			token:      valid().with("client_id", "dev-gcp:other:backend"),
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "app in other cluster",
+			token:      valid().with("client_id", "prod-gcp:team:frontend"),
+			statusCode: http.StatusForbidden,
+		},
+	})
+}
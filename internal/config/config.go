@@ -1,25 +1,56 @@
 package config
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"slices"
 	"strings"
+	"time"
 
-	"authproxy/internal/auth"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/nais/authproxy/internal/auth"
+	"github.com/nais/authproxy/internal/proxy"
 )
 
 type Config struct {
-	BindAddress        string `json:"bind-address"`
-	MetricsBindAddress string `json:"metrics-bind-address"`
-	LogLevel           string `json:"log-level"`
-	UpstreamHost       string `json:"upstream-host"`
-	UpstreamScheme     string `json:"upstream-scheme"`
-	AuthProvider       string `json:"auth-provider"`
-	AuthAudience       string `json:"auth-audience"`
-	AuthJwksUrl        string `json:"auth-jwks-url"`
-	AuthRequiredClaims string `json:"auth-required-claims"`
-	AuthTokenHeader    string `json:"auth-token-header"`
-	AuthPreSharedKey   string `json:"auth-pre-shared-key"`
+	BindAddress                   string `json:"bind-address"`
+	MetricsBindAddress            string `json:"metrics-bind-address"`
+	LogLevel                      string `json:"log-level"`
+	UpstreamHost                  string `json:"upstream-host"`
+	UpstreamScheme                string `json:"upstream-scheme"`
+	UpstreamCredential            string `json:"upstream-credential"`
+	UpstreamCredentialHeader      string `json:"upstream-credential-header"`
+	UpstreamTokenUrl              string `json:"upstream-token-url"`
+	UpstreamClientId              string `json:"upstream-client-id"`
+	UpstreamClientSecret          string `json:"upstream-client-secret"`
+	UpstreamClientKeyFile         string `json:"upstream-client-key-file"`
+	UpstreamScopes                string `json:"upstream-scopes"`
+	UpstreamGrant                 string `json:"upstream-grant"`
+	UpstreamAudience              string `json:"upstream-audience"`
+	UpstreamGoogleAudience        string `json:"upstream-google-audience"`
+	UpstreamGoogleCredentialsFile string `json:"upstream-google-credentials-file"`
+	UpstreamJwtKeyFiles           string `json:"upstream-jwt-key-files"`
+	UpstreamJwtHeader             string `json:"upstream-jwt-header"`
+	UpstreamJwtIssuer             string `json:"upstream-jwt-issuer"`
+	UpstreamJwtAudience           string `json:"upstream-jwt-audience"`
+	UpstreamJwtLifetime           string `json:"upstream-jwt-lifetime"`
+	ErrorTemplateDir              string `json:"error-template-dir"`
+	IdentityHeaders               string `json:"identity-headers"`
+	AuthProvider                  string `json:"auth-provider"`
+	AuthRealm                     string `json:"auth-realm"`
+	AuthOptional                  bool   `json:"auth-optional"`
+	AuthCredentialPolicy          string `json:"auth-credential-policy"`
+	// Settings and BoolSettings hold the settings of the auth providers by
+	// name, see Extra and ExtraBool.
+	Settings     map[string]*string `json:"settings,omitempty"`
+	BoolSettings map[string]*bool   `json:"bool-settings,omitempty"`
+	// Shadow configures a provider that is evaluated next to the enforcing
+	// one, its decisions are only logged and counted.
+	Shadow *Config `json:"shadow,omitempty"`
 }
 
 func DefaultConfig() *Config {
@@ -28,57 +59,802 @@ func DefaultConfig() *Config {
 		MetricsBindAddress: "127.0.0.1:8081",
 		LogLevel:           "info",
 		UpstreamScheme:     "https",
+		Shadow:             &Config{},
 	}
 }
 
 func (c *Config) Auth() (auth.Provider, error) {
-	var p auth.Provider
-	var err error
+	spec, ok := LookupProvider(c.AuthProvider)
+	if !ok {
+		return nil, errors.New("unknown auth-provider:" + strings.ToLower(c.AuthProvider))
+	}
+	p, err := spec.New(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.applyCredentialPolicy(p); err != nil {
+		return nil, err
+	}
+	// no-op passes everything through anyway
+	if _, noop := p.(*auth.NoAuth); c.AuthOptional && !noop {
+		if !auth.Verifies(p) {
+			return nil, fmt.Errorf("auth-optional is not supported for auth-provider '%s'", spec.Name)
+		}
+		p = auth.Optional(p)
+	}
+	if c.Shadow != nil && c.Shadow.AuthProvider != "" {
+		if spec, ok := LookupProvider(c.Shadow.AuthProvider); ok && !Shadowable(spec) {
+			return nil, fmt.Errorf("shadow-auth-provider '%s' is not supported, it is configured from the app's platform variables, use 'jwt' with the shadow flags instead", spec.Name)
+		}
+		shadow, err := c.Shadow.Auth()
+		if err != nil {
+			return nil, fmt.Errorf("shadow provider: %w", err)
+		}
+		if !auth.Verifies(shadow) {
+			return nil, fmt.Errorf("shadow-auth-provider '%s' is not supported, it doesn't verify credentials", strings.ToLower(c.Shadow.AuthProvider))
+		}
+		p = auth.Shadow(p, shadow)
+	}
+	return p, nil
+}
 
-	switch strings.ToLower(c.AuthProvider) {
-	case "iap":
-		if c.AuthAudience == "" {
-			return nil, errors.New("auth-audience must be set")
+func (c *Config) jwt() (*auth.JWTAuth, error) {
+	if c.get("auth-jwks-url") == "" && c.get("auth-jwks-file") == "" && c.get("auth-jwks") == "" && c.get("auth-public-key-file") == "" {
+		return nil, errors.New("one of auth-jwks-url, auth-jwks-file, auth-jwks or auth-public-key-file must be set")
+	}
+	header := c.get("auth-token-header")
+	if header == "" {
+		header = "Authorization"
+	}
+	if c.get("auth-required-claims") == "" {
+		return nil, errors.New("auth-required-claims must be set")
+	}
+	claims, err := toClaimMap(c.get("auth-required-claims"))
+	if err != nil {
+		return nil, fmt.Errorf("auth-required-claims invalid format: %w", err)
+	}
+	sources, err := c.keySources()
+	if err != nil {
+		return nil, err
+	}
+	jwtAuth, err := auth.JWT(header, c.get("auth-jwks-url"), claims)
+	if err != nil {
+		return nil, fmt.Errorf("creating JWT auth provider: %w", err)
+	}
+	if c.get("auth-jwt-algorithms") != "" {
+		algs, err := toAlgorithms(c.get("auth-jwt-algorithms"))
+		if err != nil {
+			return nil, fmt.Errorf("auth-jwt-algorithms invalid: %w", err)
 		}
-		p = auth.IAP(c.AuthAudience)
-	case "jwt":
-		if c.AuthJwksUrl == "" {
-			return nil, errors.New("auth-jwks-url must be set")
+		jwtAuth.Algorithms = algs
+	}
+	tokenSources, err := toTokenSources(c.get("auth-token-sources"))
+	if err != nil {
+		return nil, fmt.Errorf("auth-token-sources invalid format: %w", err)
+	}
+	jwtAuth.WithTokenSources(tokenSources...)
+	jwtAuth.TokenType = c.get("auth-jwt-type")
+	jwtAuth.Realm = c.AuthRealm
+	jwtAuth.Policy, err = c.tokenPolicy(jwtAuth.Policy)
+	if err != nil {
+		return nil, err
+	}
+	jwtAuth.AllowMissingKeyID = c.enabled("auth-jwt-allow-no-kid")
+	jwtAuth.AllowIDTokens = c.enabled("auth-jwt-allow-id-tokens")
+	if c.get("auth-jwe-key-files") != "" {
+		keys, err := decryptionKeys(c.get("auth-jwe-key-files"))
+		if err != nil {
+			return nil, fmt.Errorf("auth-jwe-key-files: %w", err)
 		}
-		if c.AuthTokenHeader == "" {
-			c.AuthTokenHeader = "Authorization"
+		jwtAuth.WithDecryptionKeys(keys)
+	} else if c.enabled("auth-jwe-required") {
+		return nil, errors.New("auth-jwe-key-files must be set when auth-jwe-required is set")
+	}
+	jwtAuth.RequireEncryption = c.enabled("auth-jwe-required")
+	jwtAuth.StepUp, err = toStepUpPolicy(c.get("auth-acr-levels"), c.get("auth-step-up"))
+	if err != nil {
+		return nil, fmt.Errorf("auth-step-up invalid format: %w", err)
+	}
+	return jwtAuth.WithKeySources(sources...), nil
+}
+
+func (c *Config) preSharedKey() (*auth.PSK, error) {
+	if c.get("auth-pre-shared-key") == "" && c.get("auth-pre-shared-keys") == "" {
+		return nil, errors.New("auth-pre-shared-key or auth-pre-shared-keys must be set")
+	}
+	if c.get("auth-token-header") == "" && c.get("auth-token-sources") == "" {
+		return nil, errors.New("auth-token-header or auth-token-sources must be set")
+	}
+	tokenSources, err := toTokenSources(c.get("auth-token-sources"))
+	if err != nil {
+		return nil, fmt.Errorf("auth-token-sources invalid format: %w", err)
+	}
+	psk := auth.PreSharedKey(c.get("auth-token-header"), c.get("auth-pre-shared-key")).
+		WithTokenSources(tokenSources...).
+		WithRealm(c.AuthRealm)
+	for i, entry := range toList(c.get("auth-pre-shared-keys")) {
+		name, key, found := strings.Cut(entry, "=")
+		// the entry isn't part of the error, it may be a key
+		if !found || strings.TrimSpace(name) == "" || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("auth-pre-shared-keys invalid format: expected '<name>=<key>' in entry %d", i+1)
+		}
+		psk.WithNamedKey(strings.TrimSpace(name), key)
+	}
+	return psk, nil
+}
+
+// applyCredentialPolicy sets what happens to the credential of the caller.
+// Replacing it removes it here, the proxy sets the upstream credential.
+func (c *Config) applyCredentialPolicy(p auth.Provider) error {
+	policy := c.AuthCredentialPolicy
+	if strings.EqualFold(strings.TrimSpace(policy), "replace") {
+		if !c.replacesCredential() {
+			return errors.New("auth-credential-policy 'replace' requires upstream-credential, upstream-token-url or upstream-google-audience")
 		}
-		if c.AuthRequiredClaims == "" {
-			return nil, errors.New("auth-required-claims must be set")
+		policy = string(auth.CredentialsRemove)
+	}
+	credentials, err := auth.ParseCredentialPolicy(policy)
+	if err != nil {
+		return fmt.Errorf("auth-credential-policy: %w", err)
+	}
+	if c.replacesCredential() {
+		if credentials == auth.CredentialsKeep {
+			return errors.New("auth-credential-policy 'keep' can't be used with upstream-credential, upstream-token-url or upstream-google-audience")
 		}
-		claims, err := toClaimMap(c.AuthRequiredClaims)
+		credentials = auth.CredentialsRemove
+	}
+
+	setter, ok := p.(auth.CredentialPolicySetter)
+	if !ok {
+		// the provider doesn't forward credentials, there is nothing to
+		// remove unless the policy was asked for
+		if strings.TrimSpace(c.AuthCredentialPolicy) != "" {
+			return fmt.Errorf("auth-credential-policy is not supported for auth-provider %q", c.AuthProvider)
+		}
+		return nil
+	}
+	setter.SetCredentialPolicy(credentials)
+	return nil
+}
+
+func (c *Config) replacesCredential() bool {
+	return c.UpstreamCredential != "" || c.UpstreamTokenUrl != "" || c.UpstreamGoogleAudience != ""
+}
+
+// Upstream returns the credential the proxy authenticates to the upstream
+// with, nil if the upstream gets the credential of the caller.
+func (c *Config) Upstream() (proxy.Credential, error) {
+	set := 0
+	for _, v := range []string{c.UpstreamCredential, c.UpstreamTokenUrl, c.UpstreamGoogleAudience} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("only one of upstream-credential, upstream-token-url and upstream-google-audience can be set")
+	}
+
+	switch {
+	case c.UpstreamGoogleAudience != "":
+		return c.googleIDTokens()
+	case c.UpstreamTokenUrl != "":
+		switch strings.ToLower(c.UpstreamGrant) {
+		case "", "client_credentials":
+			return c.clientCredentials()
+		case "token_exchange":
+			return c.tokenExchange()
+		default:
+			return nil, fmt.Errorf("unknown upstream-grant %q, expected 'client_credentials' or 'token_exchange'", c.UpstreamGrant)
+		}
+	case c.UpstreamCredential != "":
+		header := c.UpstreamCredentialHeader
+		if header == "" {
+			header = "Authorization"
+		}
+		return proxy.Static(http.CanonicalHeaderKey(header), c.UpstreamCredential), nil
+	default:
+		return nil, nil
+	}
+}
+
+// googleIDTokens gets ID tokens from the metadata server, or signs them with
+// a service account key if a credentials file is set.
+func (c *Config) googleIDTokens() (*proxy.GoogleIDToken, error) {
+	if c.UpstreamGoogleCredentialsFile == "" {
+		return proxy.GoogleIDTokens(c.UpstreamGoogleAudience, proxy.MetadataIDTokens(c.UpstreamGoogleAudience)), nil
+	}
+	source, err := proxy.ServiceAccountIDTokens(context.Background(), c.UpstreamGoogleCredentialsFile, c.UpstreamGoogleAudience)
+	if err != nil {
+		return nil, fmt.Errorf("upstream-google-credentials-file: %w", err)
+	}
+	return proxy.GoogleIDTokens(c.UpstreamGoogleAudience, source), nil
+}
+
+// Minter returns the signer of identity tokens for the upstream, nil if
+// none are minted. The first key file signs, the others are only published.
+func (c *Config) Minter() (*proxy.Minter, error) {
+	if c.UpstreamJwtKeyFiles == "" {
+		return nil, nil
+	}
+	var keys []jwk.Key
+	for _, file := range toList(c.UpstreamJwtKeyFiles) {
+		b, err := os.ReadFile(file)
 		if err != nil {
-			return nil, fmt.Errorf("auth-required-claims invalid format: %w", err)
+			return nil, fmt.Errorf("upstream-jwt-key-files: %w", err)
 		}
-		p, err = auth.JWT(c.AuthTokenHeader, c.AuthJwksUrl, claims)
+		key, err := proxy.ParseSigningKey(b)
 		if err != nil {
-			return nil, fmt.Errorf("creating JWT auth provider: %w", err)
+			return nil, fmt.Errorf("upstream-jwt-key-files: %s: %w", file, err)
 		}
-	case "key":
-		if c.AuthPreSharedKey == "" {
-			return nil, errors.New("auth-pre-shared-key must be set")
+		keys = append(keys, key)
+	}
+	m, err := proxy.Mint(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("upstream-jwt-key-files: %w", err)
+	}
+	if c.UpstreamJwtHeader != "" {
+		m.Header = http.CanonicalHeaderKey(c.UpstreamJwtHeader)
+	}
+	if c.UpstreamJwtIssuer != "" {
+		m.Issuer = c.UpstreamJwtIssuer
+	}
+	m.Audience = c.UpstreamJwtAudience
+	if c.UpstreamJwtLifetime != "" {
+		lifetime, err := time.ParseDuration(c.UpstreamJwtLifetime)
+		if err != nil || lifetime <= 0 {
+			return nil, fmt.Errorf("upstream-jwt-lifetime invalid duration %q", c.UpstreamJwtLifetime)
+		}
+		m.Lifetime = lifetime
+	}
+	return m, nil
+}
+
+func (c *Config) clientCredentials() (*proxy.ClientCredentials, error) {
+	if c.UpstreamClientId == "" {
+		return nil, errors.New("upstream-client-id must be set with upstream-token-url")
+	}
+	clientAuth, err := c.clientAuth()
+	if err != nil {
+		return nil, err
+	}
+	scopes := strings.Fields(strings.ReplaceAll(c.UpstreamScopes, ",", " "))
+	return proxy.OAuth2ClientCredentials(c.UpstreamTokenUrl, c.UpstreamClientId, clientAuth, scopes...), nil
+}
+
+func (c *Config) tokenExchange() (*proxy.TokenExchange, error) {
+	if spec, ok := LookupProvider(c.AuthProvider); !ok || !spec.ExchangesToken {
+		exchanges := func(p ProviderSpec) bool { return p.ExchangesToken }
+		return nil, errors.New("upstream-grant 'token_exchange' requires auth-provider " + ProviderNames(exchanges))
+	}
+	if c.UpstreamClientId == "" {
+		return nil, errors.New("upstream-client-id must be set with upstream-token-url")
+	}
+	if c.UpstreamAudience == "" {
+		return nil, errors.New("upstream-audience must be set for upstream-grant 'token_exchange'")
+	}
+	clientAuth, err := c.clientAuth()
+	if err != nil {
+		return nil, err
+	}
+	return proxy.OAuth2TokenExchange(c.UpstreamTokenUrl, c.UpstreamClientId, c.UpstreamAudience, clientAuth), nil
+}
+
+// clientAuth is how the proxy authenticates at the upstream token endpoint,
+// with either a client secret or a private key.
+func (c *Config) clientAuth() (proxy.ClientAuth, error) {
+	switch {
+	case c.UpstreamClientSecret != "" && c.UpstreamClientKeyFile != "":
+		return nil, errors.New("only one of upstream-client-secret and upstream-client-key-file can be set")
+	case c.UpstreamClientKeyFile != "":
+		b, err := os.ReadFile(c.UpstreamClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstream-client-key-file: %w", err)
 		}
-		if c.AuthTokenHeader == "" {
-			return nil, errors.New("auth-token-header must be set")
+		key, err := proxy.ParseSigningKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("upstream-client-key-file: %w", err)
 		}
-		p = auth.PreSharedKey(c.AuthTokenHeader, c.AuthPreSharedKey)
-	case "no-op":
-		p = auth.NoOp()
+		return proxy.PrivateKey(key), nil
+	case c.UpstreamClientSecret != "":
+		return proxy.ClientSecret(c.UpstreamClientSecret), nil
 	default:
-		return nil, errors.New("unknown auth-provider:" + strings.ToLower(c.AuthProvider))
+		return nil, errors.New("one of upstream-client-secret or upstream-client-key-file must be set")
+	}
+}
+
+// Identity parses the identity header mapping, i.e.
+// 'X-Auth-Request-User=sub,X-Auth-Request-Email=email'. Presets add their
+// own headers, a mapping for the same header replaces them.
+func (c *Config) Identity() (auth.IdentityHeaders, error) {
+	var headers auth.IdentityHeaders
+	if spec, ok := LookupProvider(c.AuthProvider); ok && spec.Identity != nil {
+		headers = append(headers, spec.Identity(c)...)
+	}
+	for _, entry := range toList(c.IdentityHeaders) {
+		name, claim, found := strings.Cut(entry, "=")
+		name, claim = strings.TrimSpace(name), strings.TrimSpace(claim)
+		if !found || name == "" || claim == "" {
+			return nil, fmt.Errorf("identity-headers invalid format: expected '<header>=<claim>', got %q", entry)
+		}
+		if strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("identity-headers invalid header name %q", name)
+		}
+		name = http.CanonicalHeaderKey(name)
+		headers = slices.DeleteFunc(headers, func(h auth.IdentityHeader) bool { return h.Name == name })
+		headers = append(headers, auth.IdentityHeader{Name: name, Claim: claim})
+	}
+	return headers, nil
+}
+
+func (c *Config) keySources() ([]auth.KeySource, error) {
+	var sources []auth.KeySource
+
+	if c.get("auth-jwks-file") != "" {
+		s, err := auth.FileKeys(c.get("auth-jwks-file"))
+		if err != nil {
+			return nil, fmt.Errorf("auth-jwks-file: %w", err)
+		}
+		sources = append(sources, s)
+	}
+	if c.get("auth-public-key-file") != "" {
+		s, err := auth.FileKeys(c.get("auth-public-key-file"))
+		if err != nil {
+			return nil, fmt.Errorf("auth-public-key-file: %w", err)
+		}
+		sources = append(sources, s)
+	}
+	if c.get("auth-jwks") != "" {
+		s, err := auth.ParseStaticKeys([]byte(c.get("auth-jwks")))
+		if err != nil {
+			return nil, fmt.Errorf("auth-jwks: %w", err)
+		}
+		sources = append(sources, s)
+	}
+
+	return sources, nil
+}
+
+func (c *Config) iap() (*auth.GoogleIAP, error) {
+	audiences := toList(c.get("auth-audience"))
+	if c.get("auth-iap-project-number") == "" && (c.get("auth-iap-project-id") != "" || c.get("auth-iap-backend-service-ids") != "") {
+		return nil, errors.New("auth-iap-project-number must be set with auth-iap-project-id or auth-iap-backend-service-ids")
+	}
+	if c.get("auth-iap-project-id") != "" {
+		audiences = append(audiences, auth.AppEngineAudience(c.get("auth-iap-project-number"), c.get("auth-iap-project-id")))
+	}
+	for _, id := range toList(c.get("auth-iap-backend-service-ids")) {
+		audiences = append(audiences, auth.BackendServiceAudience(c.get("auth-iap-project-number"), id))
+	}
+	if len(audiences) == 0 {
+		return nil, errors.New("auth-audience must be set, or auth-iap-project-number with auth-iap-project-id or auth-iap-backend-service-ids")
+	}
+
+	iap := auth.IAP(audiences...)
+	if c.get("auth-iap-header") != "" {
+		iap.Header = c.get("auth-iap-header")
+	}
+	iap.AllowedEmails = toList(c.get("auth-iap-allowed-emails"))
+	iap.AllowedDomains = toList(c.get("auth-iap-allowed-domains"))
+	iap.Realm = c.AuthRealm
+
+	var err error
+	iap.Policy, err = c.tokenPolicy(iap.Policy)
+	if err != nil {
+		return nil, err
+	}
+	// keys from a file or inline instead of Google's, e.g. for local testing
+	sources, err := c.keySources()
+	if err != nil {
+		return nil, err
+	}
+	iap.WithKeySources(sources...)
+	return iap, nil
+}
+
+// azure configures Entra ID from the variables the platform sets for the
+// app, i.e. AZURE_APP_CLIENT_ID.
+func (c *Config) azure() (*auth.JWTAuth, error) {
+	if c.get("azure-app-well-known-url") == "" || c.get("azure-app-client-id") == "" || c.get("azure-app-tenant-id") == "" {
+		return nil, errors.New("azure-app-well-known-url, azure-app-client-id and azure-app-tenant-id must be set")
+	}
+	p, err := auth.Azure(c.get("azure-app-well-known-url"), c.get("azure-app-client-id"), c.get("azure-app-tenant-id"))
+	if err != nil {
+		return nil, err
+	}
+	if groups := toList(c.get("auth-azure-allowed-groups")); len(groups) > 0 {
+		p.Allowed = append(p.Allowed, auth.ClaimRule{Claim: "groups", Values: groups})
+	}
+	if roles := toList(c.get("auth-azure-allowed-roles")); len(roles) > 0 {
+		p.Allowed = append(p.Allowed, auth.ClaimRule{Claim: "roles", Values: roles})
+	}
+	if apps := toList(c.get("auth-azure-allowed-apps")); len(apps) > 0 {
+		clientIDs, err := c.azureClientIDs(apps)
+		if err != nil {
+			return nil, err
+		}
+		p.Allowed = append(p.Allowed, auth.ClaimRule{Claim: "azp", Values: clientIDs})
+	}
+	return c.preset(p)
+}
+
+// maskinporten configures Maskinporten from the variables the platform sets
+// for the app, i.e. MASKINPORTEN_WELL_KNOWN_URL.
+func (c *Config) maskinporten() (*auth.JWTAuth, error) {
+	if c.get("maskinporten-well-known-url") == "" {
+		return nil, errors.New("maskinporten-well-known-url must be set")
+	}
+	scopes := strings.FieldsFunc(c.get("auth-maskinporten-scopes"), func(r rune) bool { return r == ' ' || r == ',' })
+	if len(scopes) == 0 {
+		return nil, errors.New("auth-maskinporten-scopes must be set")
+	}
+	p, err := auth.Maskinporten(c.get("maskinporten-well-known-url"), scopes...)
+	if err != nil {
+		return nil, err
+	}
+	if consumers := toList(c.get("auth-maskinporten-allowed-consumers")); len(consumers) > 0 {
+		p.Allowed = append(p.Allowed, auth.MaskinportenConsumers(consumers...))
+	}
+	return c.preset(p)
+}
+
+// idPorten configures ID-porten from the variables the platform sets for the
+// app, i.e. IDPORTEN_CLIENT_ID.
+func (c *Config) idPorten() (*auth.JWTAuth, error) {
+	if c.get("idporten-well-known-url") == "" || c.get("idporten-audience") == "" || c.get("idporten-client-id") == "" {
+		return nil, errors.New("idporten-well-known-url, idporten-audience and idporten-client-id must be set")
+	}
+	level := c.get("auth-idporten-acr")
+	if level == "" {
+		level = auth.DefaultIDPortenLevel
+	}
+	minimum := slices.Index(auth.IDPortenLevels, level)
+	if minimum < 0 {
+		return nil, fmt.Errorf("auth-idporten-acr must be one of %s", strings.Join(auth.IDPortenLevels, ", "))
+	}
+
+	p, err := auth.IDPorten(c.get("idporten-well-known-url"), c.get("idporten-audience"), c.get("idporten-client-id"), level)
+	if err != nil {
+		return nil, err
+	}
+	if c.enabled("auth-idporten-require-sid") {
+		p.Allowed = append(p.Allowed, auth.ClaimRule{Claim: "sid", Values: []string{"*"}})
+	}
+	// step-up rules can require more than the minimum level, never less
+	stepUp, err := toStepUpPolicy(strings.Join(auth.IDPortenLevels, ","), c.get("auth-step-up"))
+	if err != nil {
+		return nil, fmt.Errorf("auth-step-up invalid format: %w", err)
+	}
+	if stepUp != nil {
+		for _, rule := range stepUp.Rules {
+			for _, acr := range rule.ACRValues {
+				if slices.Index(auth.IDPortenLevels, acr) < minimum {
+					return nil, fmt.Errorf("auth-step-up: acr %q is weaker than auth-idporten-acr", acr)
+				}
+			}
+			if len(rule.ACRValues) == 0 {
+				rule.ACRValues = []string{level}
+			}
+			p.StepUp.Rules = append(p.StepUp.Rules, rule)
+		}
+	}
+	return c.preset(p)
+}
+
+// tokenX configures TokenX from the variables the platform sets for the app,
+// i.e. TOKEN_X_CLIENT_ID.
+func (c *Config) tokenX() (*auth.JWTAuth, error) {
+	if c.get("token-x-well-known-url") == "" || c.get("token-x-client-id") == "" {
+		return nil, errors.New("token-x-well-known-url and token-x-client-id must be set")
+	}
+	p, err := auth.TokenX(c.get("token-x-well-known-url"), c.get("token-x-client-id"))
+	if err != nil {
+		return nil, err
+	}
+	if apps := toList(c.get("auth-tokenx-allowed-apps")); len(apps) > 0 {
+		for _, app := range apps {
+			if strings.Count(app, ":") != 2 {
+				return nil, fmt.Errorf("auth-tokenx-allowed-apps invalid format: expected 'cluster:namespace:app', got %q", app)
+			}
+		}
+		p.Allowed = append(p.Allowed, auth.TokenXApps(apps...))
+	}
+	return c.preset(p)
+}
+
+// preset applies the settings the platform presets share with the other
+// token providers: where the token is read from, the realm and the policy
+// for the time claims.
+func (c *Config) preset(p *auth.JWTAuth) (*auth.JWTAuth, error) {
+	tokenSources, err := toTokenSources(c.get("auth-token-sources"))
+	if err != nil {
+		return nil, fmt.Errorf("auth-token-sources invalid format: %w", err)
+	}
+	p.WithTokenSources(tokenSources...)
+	p.Realm = c.AuthRealm
+	p.Policy, err = c.tokenPolicy(p.Policy)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// azureClientIDs resolves the names of pre-authorized apps, i.e.
+// 'cluster:namespace:app', to their client IDs. Other entries are client IDs.
+func (c *Config) azureClientIDs(apps []string) ([]string, error) {
+	var preAuthorized []auth.AzureApp
+	if c.get("azure-app-pre-authorized-apps") != "" {
+		var err error
+		preAuthorized, err = auth.ParseAzureApps(c.get("azure-app-pre-authorized-apps"))
+		if err != nil {
+			return nil, fmt.Errorf("azure-app-pre-authorized-apps: %w", err)
+		}
+	}
+
+	var clientIDs []string
+	for _, app := range apps {
+		if !strings.Contains(app, ":") {
+			clientIDs = append(clientIDs, app)
+			continue
+		}
+		i := slices.IndexFunc(preAuthorized, func(a auth.AzureApp) bool { return a.Name == app })
+		if i < 0 {
+			return nil, fmt.Errorf("auth-azure-allowed-apps: %q is not a pre-authorized app", app)
+		}
+		clientIDs = append(clientIDs, preAuthorized[i].ClientID)
+	}
+	return clientIDs, nil
+}
+
+func (c *Config) paseto() (*auth.PasetoAuth, error) {
+	if c.get("auth-paseto-keys") == "" {
+		return nil, errors.New("auth-paseto-keys must be set")
+	}
+	if c.get("auth-required-claims") == "" {
+		return nil, errors.New("auth-required-claims must be set")
+	}
+	claims, err := toClaimMap(c.get("auth-required-claims"))
+	if err != nil {
+		return nil, fmt.Errorf("auth-required-claims invalid format: %w", err)
+	}
+	var keys []auth.PasetoKey
+	for _, s := range strings.Split(c.get("auth-paseto-keys"), ",") {
+		key, err := auth.ParsePasetoKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("auth-paseto-keys: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	tokenSources, err := toTokenSources(c.get("auth-token-sources"))
+	if err != nil {
+		return nil, fmt.Errorf("auth-token-sources invalid format: %w", err)
+	}
+	header := c.get("auth-token-header")
+	if header == "" {
+		header = "Authorization"
 	}
 
+	p := auth.Paseto(header, claims, keys...).WithTokenSources(tokenSources...)
+	p.Realm = c.AuthRealm
+	p.Policy, err = c.tokenPolicy(p.Policy)
 	if err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
+func (c *Config) oidcLogin() (*auth.OIDCLogin, error) {
+	required := []struct {
+		flag  string
+		value string
+	}{
+		{"auth-issuer", c.get("auth-issuer")},
+		{"auth-client-id", c.get("auth-client-id")},
+		{"auth-redirect-url", c.get("auth-redirect-url")},
+		{"auth-cookie-secret", c.get("auth-cookie-secret")},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			return nil, errors.New(r.flag + " must be set")
+		}
+	}
+	if len(c.get("auth-cookie-secret")) < auth.MinCookieSecretLength {
+		return nil, fmt.Errorf("auth-cookie-secret must be at least %d characters", auth.MinCookieSecretLength)
+	}
+
+	p := auth.OIDC(c.get("auth-issuer"), c.get("auth-client-id"), c.get("auth-client-secret"), c.get("auth-redirect-url"), []byte(c.get("auth-cookie-secret")))
+	p.Realm = c.AuthRealm
+	p.PostLogoutRedirectURL = c.get("auth-post-logout-redirect-url")
+	if c.get("auth-scopes") != "" {
+		p.Scopes = strings.Fields(strings.ReplaceAll(c.get("auth-scopes"), ",", " "))
+	}
+	if c.get("auth-cookie-name") != "" {
+		p.CookieName = c.get("auth-cookie-name")
+	}
+	if c.get("auth-session-max-age") != "" {
+		v, err := time.ParseDuration(c.get("auth-session-max-age"))
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("auth-session-max-age must be a positive duration: %q", c.get("auth-session-max-age"))
+		}
+		p.SessionMaxAge = v
+	}
+	return p, nil
+}
+
+// decryptionKeys reads the private keys from a comma separated list of JWKS
+// or PEM files.
+func decryptionKeys(files string) (jwk.Set, error) {
+	set := jwk.NewSet()
+	for _, file := range strings.Split(files, ",") {
+		file = strings.TrimSpace(file)
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := auth.ParseDecryptionKeys(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for i := 0; i < keys.Len(); i++ {
+			key, _ := keys.Key(i)
+			_ = set.AddKey(key)
+		}
+	}
+	return set, nil
+}
+
+// tokenPolicy overrides the provider's default token policy with the
+// configured values, if any.
+func (c *Config) tokenPolicy(policy auth.TokenPolicy) (auth.TokenPolicy, error) {
+	durations := []struct {
+		flag  string
+		value string
+		dst   *time.Duration
+	}{
+		{"auth-clock-skew", c.get("auth-clock-skew"), &policy.ClockSkew},
+		{"auth-max-token-age", c.get("auth-max-token-age"), &policy.MaxAge},
+		{"auth-max-token-lifetime", c.get("auth-max-token-lifetime"), &policy.MaxLifetime},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			return policy, fmt.Errorf("%s must be a positive duration: %q", d.flag, d.value)
+		}
+		*d.dst = v
+	}
+
+	if c.get("auth-required-time-claims") != "" {
+		policy.RequireExp, policy.RequireIat, policy.RequireNbf = false, false, false
+		for _, claim := range strings.Split(c.get("auth-required-time-claims"), ",") {
+			switch strings.TrimSpace(claim) {
+			case "exp":
+				policy.RequireExp = true
+			case "iat":
+				policy.RequireIat = true
+			case "nbf":
+				policy.RequireNbf = true
+			case "none":
+			default:
+				return policy, fmt.Errorf("auth-required-time-claims: unknown claim %q, must be one of exp, iat, nbf or none", claim)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// toTokenSources parses a comma separated list of token sources, i.e.
+// 'header:Authorization:Bearer,cookie:token,query:access_token,websocket'.
+func toTokenSources(s string) ([]auth.TokenSource, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var sources []auth.TokenSource
+	for _, entry := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		kind := parts[0]
+		name := ""
+		if len(parts) > 1 {
+			name = parts[1]
+		}
+
+		switch {
+		case kind == "header" && name != "":
+			scheme := ""
+			if len(parts) == 3 {
+				scheme = parts[2]
+			}
+			sources = append(sources, auth.Header(name, scheme))
+		case kind == "cookie" && name != "" && len(parts) == 2:
+			sources = append(sources, auth.Cookie(name))
+		case kind == "query" && name != "" && len(parts) == 2:
+			sources = append(sources, auth.Query(name))
+		case kind == "websocket" && len(parts) <= 2:
+			sources = append(sources, auth.WebSocketProtocol(name))
+		default:
+			return nil, errors.New("should be one of 'header:<name>[:<scheme>]', 'cookie:<name>', 'query:<name>' or 'websocket[:<prefix>]': " + entry)
+		}
+	}
+	return sources, nil
+}
+
+// toStepUpPolicy parses an ordered list of acr levels, i.e. 'Level3,Level4',
+// and a comma separated list of step-up rules as
+// '<path-prefix>=[<acr> ...][;max_age=<duration>]', i.e.
+// '/payments=Level4,/profile=;max_age=1h'.
+func toStepUpPolicy(levels, rules string) (*auth.StepUpPolicy, error) {
+	if rules == "" {
+		return nil, nil
+	}
+
+	policy := &auth.StepUpPolicy{}
+	if levels != "" {
+		for _, level := range strings.Split(levels, ",") {
+			policy.Levels = append(policy.Levels, strings.TrimSpace(level))
+		}
+	}
+
+	for _, entry := range strings.Split(rules, ",") {
+		path, requirement, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || !strings.HasPrefix(path, "/") {
+			return nil, errors.New("should be '<path-prefix>=[<acr> ...][;max_age=<duration>]': " + entry)
+		}
+		acrs, maxAge, _ := strings.Cut(requirement, ";")
+
+		rule := auth.StepUpRule{
+			PathPrefix: path,
+			ACRValues:  strings.Fields(acrs),
+		}
+		for _, acr := range rule.ACRValues {
+			if len(policy.Levels) > 0 && !slices.Contains(policy.Levels, acr) {
+				return nil, fmt.Errorf("acr %q is not one of auth-acr-levels", acr)
+			}
+		}
+		if maxAge != "" {
+			v, found := strings.CutPrefix(maxAge, "max_age=")
+			d, err := time.ParseDuration(v)
+			if !found || err != nil || d <= 0 {
+				return nil, errors.New("max_age must be a positive duration: " + entry)
+			}
+			rule.MaxAge = d
+		}
+		if len(rule.ACRValues) == 0 && rule.MaxAge == 0 {
+			return nil, errors.New("rule requires neither acr nor max_age: " + entry)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+// toList splits a comma separated list, ignoring empty entries.
+func toList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func toAlgorithms(s string) ([]jwa.SignatureAlgorithm, error) {
+	var algs []jwa.SignatureAlgorithm
+	for _, v := range strings.Split(s, ",") {
+		var alg jwa.SignatureAlgorithm
+		if err := alg.Accept(strings.TrimSpace(v)); err != nil {
+			return nil, fmt.Errorf("unknown algorithm %q", strings.TrimSpace(v))
+		}
+		if alg == jwa.NoSignature {
+			return nil, errors.New("algorithm 'none' is not allowed")
+		}
+		algs = append(algs, alg)
+	}
+	return algs, nil
+}
+
 func toClaimMap(s string) (map[string]any, error) {
 	m := make(map[string]any)
 
@@ -1,9 +1,19 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
-	"authproxy/internal/auth"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/nais/authproxy/internal/auth"
+	"github.com/nais/authproxy/internal/proxy"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,11 +25,10 @@ func TestConfigPreSharedKey(t *testing.T) {
 	}{
 		{
 			name: "valid pre-shared key config",
-			cfg: &Config{
-				AuthProvider:     "key",
-				AuthPreSharedKey: "1234",
-				AuthTokenHeader:  "Authorization",
-			},
+			cfg: withSettings(&Config{AuthProvider: "key"},
+				"auth-pre-shared-key", "1234",
+				"auth-token-header", "Authorization",
+			),
 			assertFunc: func(provider auth.Provider, err error) {
 				assert.NoError(t, err)
 				assert.NotNil(t, provider)
@@ -27,26 +36,111 @@ func TestConfigPreSharedKey(t *testing.T) {
 		},
 		{
 			name: "missing auth-pre-shared-key",
-			cfg: &Config{
-				AuthProvider:    "key",
-				AuthTokenHeader: "Authorization",
-			},
+			cfg: withSettings(&Config{AuthProvider: "key"},
+				"auth-token-header", "Authorization",
+			),
 			assertFunc: func(_ auth.Provider, err error) {
 				assert.Error(t, err)
 				assert.Containsf(t, err.Error(), "auth-pre-shared-key", "expected error to contain '%s' but got '%s'", "auth-pre-shared-key", err.Error())
 			},
 		},
 		{
-			name: "missing auth-token-header",
-			cfg: &Config{
-				AuthProvider:     "key",
-				AuthPreSharedKey: "1234",
+			name: "named pre-shared keys",
+			cfg: withSettings(&Config{AuthProvider: "key"},
+				"auth-pre-shared-keys", "billing=1234, reports=abc=",
+				"auth-token-header", "Authorization",
+			),
+			assertFunc: func(provider auth.Provider, err error) {
+				assert.NoError(t, err)
+				assert.NotNil(t, provider)
 			},
+		},
+		{
+			name: "named pre-shared key without name",
+			cfg: withSettings(&Config{AuthProvider: "key"},
+				"auth-pre-shared-keys", "billing=1234,secret",
+				"auth-token-header", "Authorization",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "auth-pre-shared-keys")
+				assert.NotContains(t, err.Error(), "secret")
+			},
+		},
+		{
+			name: "missing auth-token-header",
+			cfg: withSettings(&Config{AuthProvider: "key"},
+				"auth-pre-shared-key", "1234",
+			),
 			assertFunc: func(_ auth.Provider, err error) {
 				assert.Error(t, err)
 				assert.Containsf(t, err.Error(), "auth-token-header", "expected error to contain '%s' but got '%s'", "auth-token-header", err.Error())
 			},
 		},
+		{
+			name: "optional pre-shared key config",
+			cfg: withSettings(&Config{AuthProvider: "key", AuthOptional: true},
+				"auth-pre-shared-key", "1234",
+				"auth-token-header", "Authorization",
+			),
+			assertFunc: func(provider auth.Provider, err error) {
+				assert.NoError(t, err)
+				assert.IsType(t, &auth.OptionalAuth{}, provider)
+			},
+		},
+		{
+			name: "pre-shared key with jwt shadow provider",
+			cfg: withSettings(&Config{
+				AuthProvider: "key",
+				Shadow: withSettings(&Config{AuthProvider: "jwt"},
+					"auth-jwks-url", "http://localhost:1234",
+					"auth-required-claims", "aud=yolo",
+				),
+			},
+				"auth-pre-shared-key", "1234",
+				"auth-token-header", "Authorization",
+			),
+			assertFunc: func(provider auth.Provider, err error) {
+				assert.NoError(t, err)
+				assert.IsType(t, &auth.ShadowAuth{}, provider)
+			},
+		},
+		{
+			name: "invalid shadow provider",
+			cfg: withSettings(&Config{
+				AuthProvider: "key",
+				Shadow: &Config{
+					AuthProvider: "jwt",
+				},
+			},
+				"auth-pre-shared-key", "1234",
+				"auth-token-header", "Authorization",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "shadow provider")
+			},
+		},
+		{
+			name: "platform preset as shadow provider",
+			cfg: withSettings(&Config{
+				AuthProvider: "key",
+				Shadow: &Config{
+					AuthProvider: "Azure",
+				},
+			},
+				"auth-pre-shared-key", "1234",
+				"auth-token-header", "Authorization",
+				// the platform variables of the enforcing provider are
+				// never used for the shadow provider
+				"azure-app-well-known-url", "http://localhost:1234/.well-known/openid-configuration",
+				"azure-app-client-id", "client",
+				"azure-app-tenant-id", "tenant",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.EqualError(t, err, "shadow-auth-provider 'azure' is not supported, it is configured from the app's platform variables, use 'jwt' with the shadow flags instead")
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -57,6 +151,54 @@ func TestConfigPreSharedKey(t *testing.T) {
 	}
 }
 
+func TestConfigOIDCLogin(t *testing.T) {
+	valid := func() *Config {
+		return withSettings(&Config{AuthProvider: "oidc-login"},
+			"auth-issuer", "https://idp.example.com",
+			"auth-client-id", "client",
+			"auth-client-secret", "secret",
+			"auth-redirect-url", "https://app.example.com/oauth2/callback",
+			"auth-cookie-secret", "0123456789abcdef0123456789abcdef",
+			"auth-scopes", "openid,email",
+			"auth-session-max-age", "1h",
+		)
+	}
+
+	p, err := valid().Auth()
+	assert.NoError(t, err)
+	login, ok := p.(*auth.OIDCLogin)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"openid", "email"}, login.Scopes)
+	assert.Equal(t, time.Hour, login.SessionMaxAge)
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		errMsg string
+	}{
+		{"missing issuer", func(c *Config) { *c.Setting("auth-issuer") = "" }, "auth-issuer"},
+		{"missing client id", func(c *Config) { *c.Setting("auth-client-id") = "" }, "auth-client-id"},
+		{"missing redirect url", func(c *Config) { *c.Setting("auth-redirect-url") = "" }, "auth-redirect-url"},
+		{"short cookie secret", func(c *Config) { *c.Setting("auth-cookie-secret") = "short" }, "auth-cookie-secret"},
+		{"invalid session max age", func(c *Config) { *c.Setting("auth-session-max-age") = "forever" }, "auth-session-max-age"},
+		{"optional", func(c *Config) { c.AuthOptional = true }, "auth-optional is not supported for auth-provider 'oidc-login'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			_, err := c.Auth()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errMsg)
+		})
+	}
+
+	// the login flow takes over the response, it can't be evaluated as shadow
+	c := withSettings(&Config{AuthProvider: "key", Shadow: valid()}, "auth-pre-shared-key", "1234", "auth-token-header", "X-Api-Key")
+	_, err = c.Auth()
+	assert.ErrorContains(t, err, "shadow-auth-provider 'oidc-login' is not supported")
+}
+
 func TestConfigIAP(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -65,15 +207,49 @@ func TestConfigIAP(t *testing.T) {
 	}{
 		{
 			name: "valid JWT config",
-			cfg: &Config{
-				AuthProvider: "iap",
-				AuthAudience: "test",
-			},
+			cfg: withSettings(&Config{AuthProvider: "iap"},
+				"auth-audience", "test",
+			),
 			assertFunc: func(provider auth.Provider, err error) {
 				assert.NoError(t, err)
 				assert.NotNil(t, provider)
 			},
 		},
+		{
+			name: "audiences from project",
+			cfg: withSettings(&Config{AuthProvider: "iap"},
+				"auth-audience", "test, other",
+				"auth-iap-project-number", "123456",
+				"auth-iap-project-id", "my-project",
+				"auth-iap-backend-service-ids", "1,2",
+				"auth-iap-header", "X-Iap-Assertion",
+				"auth-iap-allowed-domains", "nais.io",
+			),
+			assertFunc: func(provider auth.Provider, err error) {
+				assert.NoError(t, err)
+				iap := provider.(*auth.GoogleIAP)
+				assert.Equal(t, []string{
+					"test",
+					"other",
+					"/projects/123456/apps/my-project",
+					"/projects/123456/global/backendServices/1",
+					"/projects/123456/global/backendServices/2",
+				}, iap.Audiences)
+				assert.Equal(t, "X-Iap-Assertion", iap.Header)
+				assert.Equal(t, []string{"nais.io"}, iap.AllowedDomains)
+				assert.Nil(t, iap.AllowedEmails)
+			},
+		},
+		{
+			name: "backend service ids without project number",
+			cfg: withSettings(&Config{AuthProvider: "iap"},
+				"auth-iap-backend-service-ids", "1",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "auth-iap-project-number")
+			},
+		},
 		{
 			name: "missing auth-audience",
 			cfg: &Config{
@@ -102,11 +278,10 @@ func TestConfigJWT(t *testing.T) {
 	}{
 		{
 			name: "valid JWT config",
-			cfg: &Config{
-				AuthProvider:       "jwt",
-				AuthJwksUrl:        "http://localhost",
-				AuthRequiredClaims: "iss=http://localhost:1234, aud=yolo",
-			},
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks-url", "http://localhost",
+				"auth-required-claims", "iss=http://localhost:1234, aud=yolo",
+			),
 			assertFunc: func(provider auth.Provider, err error) {
 				assert.NoError(t, err)
 				assert.IsTypef(t, &auth.JWTAuth{}, provider, "expected provider to be of type '%T' but got '%T'", &auth.JWTAuth{}, provider)
@@ -124,22 +299,102 @@ func TestConfigJWT(t *testing.T) {
 		},
 		{
 			name: "missing auth-required-claims",
-			cfg: &Config{
-				AuthProvider: "jwt",
-				AuthJwksUrl:  "http://localhost:1234",
-			},
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks-url", "http://localhost:1234",
+			),
 			assertFunc: func(_ auth.Provider, err error) {
 				assert.Error(t, err)
 				assert.Containsf(t, err.Error(), "auth-required-claims", "expected error to contain '%s' but got '%s'", "auth-required-claims", err.Error())
 			},
 		},
 		{
-			name: "auth-required-claims has invalid format",
-			cfg: &Config{
-				AuthProvider:       "jwt",
-				AuthJwksUrl:        "http://localhost:1234",
-				AuthRequiredClaims: "iss: http://localhost:1234",
+			name: "invalid auth-jwks",
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks", "not a jwks",
+				"auth-required-claims", "iss=http://localhost:1234, aud=yolo",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Containsf(t, err.Error(), "auth-jwks", "expected error to contain '%s' but got '%s'", "auth-jwks", err.Error())
+			},
+		},
+		{
+			name: "missing auth-jwks-file",
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks-file", "/does/not/exist.json",
+				"auth-required-claims", "iss=http://localhost:1234, aud=yolo",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Containsf(t, err.Error(), "auth-jwks-file", "expected error to contain '%s' but got '%s'", "auth-jwks-file", err.Error())
+			},
+		},
+		{
+			name: "auth-jwt-algorithms has unknown algorithm",
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks-url", "http://localhost:1234",
+				"auth-required-claims", "iss=http://localhost:1234, aud=yolo",
+				"auth-jwt-algorithms", "RS256, FOO256",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Containsf(t, err.Error(), "auth-jwt-algorithms", "expected error to contain '%s' but got '%s'", "auth-jwt-algorithms", err.Error())
+			},
+		},
+		{
+			name: "auth-max-token-age is not a duration",
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks-url", "http://localhost:1234",
+				"auth-required-claims", "iss=http://localhost:1234, aud=yolo",
+				"auth-max-token-age", "one hour",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Containsf(t, err.Error(), "auth-max-token-age", "expected error to contain '%s' but got '%s'", "auth-max-token-age", err.Error())
+			},
+		},
+		{
+			name: "auth-required-time-claims has unknown claim",
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks-url", "http://localhost:1234",
+				"auth-required-claims", "iss=http://localhost:1234, aud=yolo",
+				"auth-required-time-claims", "exp,foo",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Containsf(t, err.Error(), "auth-required-time-claims", "expected error to contain '%s' but got '%s'", "auth-required-time-claims", err.Error())
+			},
+		},
+		{
+			name: "missing auth-jwe-key-files",
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks-url", "http://localhost:1234",
+				"auth-required-claims", "iss=http://localhost:1234, aud=yolo",
+				"auth-jwe-key-files", "/does/not/exist.pem",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Containsf(t, err.Error(), "auth-jwe-key-files", "expected error to contain '%s' but got '%s'", "auth-jwe-key-files", err.Error())
 			},
+		},
+		{
+			name: "auth-jwe-required without keys",
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks-url", "http://localhost:1234",
+				"auth-required-claims", "iss=http://localhost:1234, aud=yolo",
+				"auth-jwe-required", "true",
+			),
+			assertFunc: func(_ auth.Provider, err error) {
+				assert.Error(t, err)
+				assert.Containsf(t, err.Error(), "auth-jwe-key-files", "expected error to contain '%s' but got '%s'", "auth-jwe-key-files", err.Error())
+			},
+		},
+		{
+			name: "auth-required-claims has invalid format",
+			cfg: withSettings(&Config{AuthProvider: "jwt"},
+				"auth-jwks-url", "http://localhost:1234",
+				"auth-required-claims", "iss: http://localhost:1234",
+			),
 			assertFunc: func(_ auth.Provider, err error) {
 				assert.Error(t, err)
 				assert.Containsf(t, err.Error(), "auth-required-claims", "expected error to contain '%s' but got '%s'", "auth-required-claims", err.Error())
@@ -162,3 +417,465 @@ func TestToClaimMap(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, map[string]any{"key1": "value1", "key2": "value2"}, m)
 }
+
+func TestTokenPolicy(t *testing.T) {
+	cfg := withSettings(&Config{},
+		"auth-clock-skew", "10s",
+		"auth-max-token-age", "1h",
+		"auth-required-time-claims", "iat, nbf",
+	)
+	policy, err := cfg.tokenPolicy(auth.TokenPolicy{ClockSkew: time.Second, RequireExp: true})
+	assert.NoError(t, err)
+	assert.Equal(t, auth.TokenPolicy{
+		ClockSkew:  10 * time.Second,
+		MaxAge:     time.Hour,
+		RequireIat: true,
+		RequireNbf: true,
+	}, policy)
+}
+
+func TestRequiredTimeClaims(t *testing.T) {
+	for _, tt := range []struct {
+		required   string
+		requireExp bool
+	}{
+		{required: "", requireExp: false},
+		{required: "exp", requireExp: true},
+	} {
+		cfg := withSettings(&Config{AuthProvider: "jwt"}, "auth-jwks-url", "http://localhost:1234", "auth-required-claims", "aud=yolo", "auth-required-time-claims", tt.required)
+		p, err := cfg.jwt()
+		assert.NoError(t, err)
+		assert.Equal(t, tt.requireExp, p.Policy.RequireExp, tt.required)
+	}
+}
+
+func TestToTokenSources(t *testing.T) {
+	sources, err := toTokenSources("header:Authorization:Bearer, cookie:token,query:access_token,websocket")
+	assert.NoError(t, err)
+	assert.Equal(t, []auth.TokenSource{
+		auth.Header("Authorization", "Bearer"),
+		auth.Cookie("token"),
+		auth.Query("access_token"),
+		auth.WebSocketProtocol(""),
+	}, sources)
+
+	_, err = toTokenSources("body:token")
+	assert.Error(t, err)
+	_, err = toTokenSources("cookie")
+	assert.Error(t, err)
+}
+
+func TestToAlgorithms(t *testing.T) {
+	algs, err := toAlgorithms("RS256, ES256,EdDSA")
+	assert.NoError(t, err)
+	assert.Equal(t, []jwa.SignatureAlgorithm{jwa.RS256, jwa.ES256, jwa.EdDSA}, algs)
+
+	_, err = toAlgorithms("none")
+	assert.Error(t, err)
+}
+
+func TestToStepUpPolicy(t *testing.T) {
+	policy, err := toStepUpPolicy("Level3,Level4", "/payments=Level4,/profile=;max_age=1h")
+	assert.NoError(t, err)
+	assert.Equal(t, &auth.StepUpPolicy{
+		Levels: []string{"Level3", "Level4"},
+		Rules: []auth.StepUpRule{
+			{PathPrefix: "/payments", ACRValues: []string{"Level4"}},
+			{PathPrefix: "/profile", ACRValues: []string{}, MaxAge: time.Hour},
+		},
+	}, policy)
+
+	policy, err = toStepUpPolicy("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+
+	for _, invalid := range []string{"payments=Level4", "/payments", "/payments=", "/payments=Level4;max_age=soon", "/payments=Level9"} {
+		_, err := toStepUpPolicy("Level3,Level4", invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestConfigPaseto(t *testing.T) {
+	cfg := withSettings(&Config{AuthProvider: "paseto"},
+		"auth-paseto-keys", "1eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2",
+		"auth-required-claims", "aud=yolo",
+	)
+	p, err := cfg.Auth()
+	assert.NoError(t, err)
+	assert.IsType(t, &auth.PasetoAuth{}, p)
+
+	*cfg.Setting("auth-paseto-keys") = "not a key"
+	_, err = cfg.Auth()
+	assert.ErrorContains(t, err, "auth-paseto-keys")
+
+	*cfg.Setting("auth-paseto-keys") = ""
+	_, err = cfg.Auth()
+	assert.ErrorContains(t, err, "auth-paseto-keys")
+}
+
+func TestConfigAzure(t *testing.T) {
+	azure := func() *Config {
+		return withSettings(&Config{AuthProvider: "azure"},
+			"azure-app-well-known-url", "https://login.microsoftonline.com/tenant/v2.0/.well-known/openid-configuration",
+			"azure-app-client-id", "client",
+			"azure-app-tenant-id", "tenant",
+			"azure-app-pre-authorized-apps", `[{"name":"dev-gcp:team:app","clientId":"1234"}]`,
+		)
+	}
+
+	c := azure()
+	*c.Setting("auth-azure-allowed-groups") = "group1,group2"
+	*c.Setting("auth-azure-allowed-roles") = "admin"
+	*c.Setting("auth-azure-allowed-apps") = "dev-gcp:team:app,5678"
+	p, err := c.Auth()
+	assert.NoError(t, err)
+	jwtAuth, ok := p.(*auth.JWTAuth)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]any{"aud": "client"}, jwtAuth.RequiredClaims)
+	assert.Equal(t, map[string]any{"tid": "tenant"}, jwtAuth.ValidClaims)
+	assert.Equal(t, []auth.ClaimRule{
+		{Claim: "groups", Values: []string{"group1", "group2"}},
+		{Claim: "roles", Values: []string{"admin"}},
+		{Claim: "azp", Values: []string{"1234", "5678"}},
+	}, jwtAuth.Allowed)
+
+	p, err = azure().Auth()
+	assert.NoError(t, err)
+	assert.Empty(t, p.(*auth.JWTAuth).Allowed)
+
+	c = azure()
+	*c.Setting("azure-app-tenant-id") = ""
+	_, err = c.Auth()
+	assert.ErrorContains(t, err, "azure-app-tenant-id")
+
+	c = azure()
+	*c.Setting("auth-azure-allowed-apps") = "dev-gcp:team:other"
+	_, err = c.Auth()
+	assert.ErrorContains(t, err, "not a pre-authorized app")
+
+	c = azure()
+	*c.Setting("azure-app-pre-authorized-apps") = "dev-gcp:team:app"
+	*c.Setting("auth-azure-allowed-apps") = "dev-gcp:team:app"
+	_, err = c.Auth()
+	assert.ErrorContains(t, err, "azure-app-pre-authorized-apps")
+}
+
+func TestConfigMaskinporten(t *testing.T) {
+	c := withSettings(&Config{AuthProvider: "maskinporten"},
+		"maskinporten-well-known-url", "https://test.maskinporten.no/.well-known/oauth-authorization-server",
+		"auth-maskinporten-scopes", "nav:team/read nav:team/write",
+		"auth-maskinporten-allowed-consumers", "889640782, 0192:974761076",
+	)
+	p, err := c.Auth()
+	assert.NoError(t, err)
+	jwtAuth, ok := p.(*auth.JWTAuth)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"nav:team/read", "nav:team/write"}, jwtAuth.Scopes)
+	assert.Equal(t, []auth.ClaimRule{
+		{Claim: "consumer.ID", Values: []string{"0192:889640782", "0192:974761076"}},
+	}, jwtAuth.Allowed)
+
+	headers, err := c.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, auth.IdentityHeaders{
+		{Name: "X-Auth-Consumer-Orgno", Claim: "consumer.ID", TrimPrefix: "0192:"},
+	}, headers)
+
+	_, err = (withSettings(&Config{AuthProvider: "maskinporten"}, "auth-maskinporten-scopes", "nav:team/read")).Auth()
+	assert.ErrorContains(t, err, "maskinporten-well-known-url")
+
+	_, err = (withSettings(&Config{AuthProvider: "maskinporten"}, "maskinporten-well-known-url", c.get("maskinporten-well-known-url"))).Auth()
+	assert.ErrorContains(t, err, "auth-maskinporten-scopes")
+}
+
+func TestConfigTokenX(t *testing.T) {
+	c := withSettings(&Config{AuthProvider: "tokenx"},
+		"token-x-well-known-url", "https://tokenx.dev-gcp.example.com/.well-known/oauth-authorization-server",
+		"token-x-client-id", "dev-gcp:team:api",
+		"auth-tokenx-allowed-apps", "dev-gcp:team:*, dev-gcp:other:frontend",
+	)
+	p, err := c.Auth()
+	assert.NoError(t, err)
+	jwtAuth, ok := p.(*auth.JWTAuth)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]any{"aud": "dev-gcp:team:api"}, jwtAuth.RequiredClaims)
+	assert.Equal(t, []auth.ClaimRule{
+		{Claim: "client_id", Values: []string{"dev-gcp:team:*", "dev-gcp:other:frontend"}},
+	}, jwtAuth.Allowed)
+
+	headers, err := c.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, auth.IdentityHeaders{
+		{Name: "X-Auth-Pid", Claim: "pid"},
+		{Name: "X-Auth-Client-Id", Claim: "client_id"},
+	}, headers)
+
+	*c.Setting("auth-tokenx-allowed-apps") = "frontend"
+	_, err = c.Auth()
+	assert.ErrorContains(t, err, "auth-tokenx-allowed-apps")
+
+	_, err = (withSettings(&Config{AuthProvider: "tokenx"}, "token-x-well-known-url", c.get("token-x-well-known-url"))).Auth()
+	assert.ErrorContains(t, err, "token-x-client-id")
+}
+
+func TestConfigIDPorten(t *testing.T) {
+	idporten := func() *Config {
+		return withSettings(&Config{AuthProvider: "idporten"},
+			"idporten-well-known-url", "https://test.idporten.no/.well-known/openid-configuration",
+			"idporten-audience", "https://app.example.com",
+			"idporten-client-id", "client",
+		)
+	}
+
+	p, err := idporten().Auth()
+	assert.NoError(t, err)
+	jwtAuth := p.(*auth.JWTAuth)
+	assert.Equal(t, map[string]any{"aud": "https://app.example.com"}, jwtAuth.RequiredClaims)
+	assert.Equal(t, []auth.ClaimRule{{Claim: "client_id", Values: []string{"client"}}}, jwtAuth.Allowed)
+	assert.Equal(t, []auth.StepUpRule{{PathPrefix: "/", ACRValues: []string{"idporten-loa-high"}}}, jwtAuth.StepUp.Rules)
+
+	c := idporten()
+	*c.Setting("auth-idporten-acr") = "idporten-loa-substantial"
+	*c.BoolSetting("auth-idporten-require-sid") = true
+	*c.Setting("auth-step-up") = "/payments=idporten-loa-high,/profile=;max_age=1h"
+	p, err = c.Auth()
+	assert.NoError(t, err)
+	jwtAuth = p.(*auth.JWTAuth)
+	assert.Contains(t, jwtAuth.Allowed, auth.ClaimRule{Claim: "sid", Values: []string{"*"}})
+	assert.Equal(t, []auth.StepUpRule{
+		{PathPrefix: "/", ACRValues: []string{"idporten-loa-substantial"}},
+		{PathPrefix: "/payments", ACRValues: []string{"idporten-loa-high"}},
+		{PathPrefix: "/profile", ACRValues: []string{"idporten-loa-substantial"}, MaxAge: time.Hour},
+	}, jwtAuth.StepUp.Rules)
+
+	c = idporten()
+	*c.Setting("auth-step-up") = "/payments=idporten-loa-substantial"
+	_, err = c.Auth()
+	assert.ErrorContains(t, err, "weaker than auth-idporten-acr")
+
+	c = idporten()
+	*c.Setting("auth-idporten-acr") = "Level4"
+	_, err = c.Auth()
+	assert.ErrorContains(t, err, "auth-idporten-acr")
+
+	c = idporten()
+	*c.Setting("idporten-client-id") = ""
+	_, err = c.Auth()
+	assert.ErrorContains(t, err, "idporten-client-id")
+
+	headers, err := idporten().Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, auth.IdentityHeaders{{Name: "X-Auth-Pid", Claim: "pid"}}, headers)
+
+	c = idporten()
+	*c.Setting("auth-idporten-pid-header") = "x-fnr"
+	headers, err = c.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, auth.IdentityHeaders{{Name: "X-Fnr", Claim: "pid"}}, headers)
+}
+
+func TestIdentity(t *testing.T) {
+	c := &Config{IdentityHeaders: "x-auth-request-user=sub, X-Auth-Request-Groups = groups"}
+	headers, err := c.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, auth.IdentityHeaders{
+		{Name: "X-Auth-Request-User", Claim: "sub"},
+		{Name: "X-Auth-Request-Groups", Claim: "groups"},
+	}, headers)
+
+	headers, err = (&Config{}).Identity()
+	assert.NoError(t, err)
+	assert.Empty(t, headers)
+
+	c = &Config{AuthProvider: "azure", IdentityHeaders: "X-Auth-Oid=sub,X-Auth-Request-Email=preferred_username"}
+	headers, err = c.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, auth.IdentityHeaders{
+		{Name: "X-Auth-Navident", Claim: "NAVident"},
+		{Name: "X-Auth-Oid", Claim: "sub"},
+		{Name: "X-Auth-Request-Email", Claim: "preferred_username"},
+	}, headers)
+
+	for _, invalid := range []string{"X-Auth-Request-User", "X-Auth-Request-User=", "=sub", "X Auth=sub"} {
+		_, err := (&Config{IdentityHeaders: invalid}).Identity()
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestCredentialPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        *Config
+		credential bool
+		errMsg     string
+	}{
+		{
+			name: "keep",
+			cfg:  &Config{AuthCredentialPolicy: "keep"},
+		},
+		{
+			name:       "replace",
+			cfg:        &Config{AuthCredentialPolicy: "replace", UpstreamCredential: "Bearer upstream"},
+			credential: true,
+		},
+		{
+			name:   "replace without upstream credential",
+			cfg:    &Config{AuthCredentialPolicy: "replace"},
+			errMsg: "upstream-credential",
+		},
+		{
+			name:   "keep with upstream credential",
+			cfg:    &Config{AuthCredentialPolicy: "keep", UpstreamCredential: "Bearer upstream"},
+			errMsg: "auth-credential-policy",
+		},
+		{
+			name:   "unknown policy",
+			cfg:    &Config{AuthCredentialPolicy: "forward"},
+			errMsg: "auth-credential-policy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.AuthProvider = "key"
+			*tt.cfg.Setting("auth-pre-shared-key") = "1234"
+			*tt.cfg.Setting("auth-token-header") = "Authorization"
+			_, err := tt.cfg.Auth()
+			if tt.errMsg != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errMsg)
+				return
+			}
+			assert.NoError(t, err)
+
+			credential, err := tt.cfg.Upstream()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.credential, credential != nil)
+		})
+	}
+}
+
+func TestCredentialPolicyUnsupported(t *testing.T) {
+	// the upstream credential alone doesn't ask for a policy
+	_, err := (&Config{AuthProvider: "no-op", UpstreamCredential: "Bearer upstream"}).Auth()
+	assert.NoError(t, err)
+
+	_, err = (&Config{AuthProvider: "no-op", AuthCredentialPolicy: "remove"}).Auth()
+	assert.ErrorContains(t, err, "auth-credential-policy is not supported")
+}
+
+func TestUpstreamClientCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    *Config
+		errMsg string
+	}{
+		{
+			name: "client secret",
+			cfg:  &Config{UpstreamTokenUrl: "http://localhost/token", UpstreamClientId: "proxy", UpstreamClientSecret: "s3cret"},
+		},
+		{
+			name:   "missing client id",
+			cfg:    &Config{UpstreamTokenUrl: "http://localhost/token", UpstreamClientSecret: "s3cret"},
+			errMsg: "upstream-client-id",
+		},
+		{
+			name:   "missing client authentication",
+			cfg:    &Config{UpstreamTokenUrl: "http://localhost/token", UpstreamClientId: "proxy"},
+			errMsg: "upstream-client-secret",
+		},
+		{
+			name:   "missing key file",
+			cfg:    &Config{UpstreamTokenUrl: "http://localhost/token", UpstreamClientId: "proxy", UpstreamClientKeyFile: "/does/not/exist"},
+			errMsg: "upstream-client-key-file",
+		},
+		{
+			name:   "token exchange without jwt provider",
+			cfg:    &Config{AuthProvider: "key", UpstreamTokenUrl: "http://localhost/token", UpstreamGrant: "token_exchange", UpstreamClientId: "proxy", UpstreamClientSecret: "s3cret", UpstreamAudience: "app"},
+			errMsg: "auth-provider 'jwt'",
+		},
+		{
+			name:   "token exchange without audience",
+			cfg:    &Config{AuthProvider: "jwt", UpstreamTokenUrl: "http://localhost/token", UpstreamGrant: "token_exchange", UpstreamClientId: "proxy", UpstreamClientSecret: "s3cret"},
+			errMsg: "upstream-audience",
+		},
+		{
+			name:   "unknown grant",
+			cfg:    &Config{UpstreamTokenUrl: "http://localhost/token", UpstreamGrant: "password"},
+			errMsg: "upstream-grant",
+		},
+		{
+			name:   "google audience and token url",
+			cfg:    &Config{UpstreamTokenUrl: "http://localhost/token", UpstreamGoogleAudience: "https://upstream.a.run.app"},
+			errMsg: "upstream-google-audience",
+		},
+		{
+			name:   "missing google credentials file",
+			cfg:    &Config{UpstreamGoogleAudience: "https://upstream.a.run.app", UpstreamGoogleCredentialsFile: "/does/not/exist"},
+			errMsg: "upstream-google-credentials-file",
+		},
+		{
+			name:   "static credential and token url",
+			cfg:    &Config{UpstreamTokenUrl: "http://localhost/token", UpstreamCredential: "Bearer upstream"},
+			errMsg: "upstream-token-url",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credential, err := tt.cfg.Upstream()
+			if tt.errMsg != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.errMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.IsType(t, &proxy.ClientCredentials{}, credential)
+		})
+	}
+
+	// TokenX tokens can be exchanged again for the next app in the chain
+	credential, err := (&Config{AuthProvider: "tokenx", UpstreamTokenUrl: "http://localhost/token", UpstreamGrant: "token_exchange", UpstreamClientId: "proxy", UpstreamClientSecret: "s3cret", UpstreamAudience: "app"}).Upstream()
+	assert.NoError(t, err)
+	assert.IsType(t, &proxy.TokenExchange{}, credential)
+}
+
+func TestMinter(t *testing.T) {
+	m, err := (&Config{}).Minter()
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	_, err = (&Config{UpstreamJwtKeyFiles: "/does/not/exist"}).Minter()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "upstream-jwt-key-files")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	m, err = (&Config{UpstreamJwtKeyFiles: file, UpstreamJwtHeader: "x-identity", UpstreamJwtLifetime: "1m"}).Minter()
+	assert.NoError(t, err)
+	assert.Equal(t, "X-Identity", m.Header)
+	assert.Equal(t, time.Minute, m.Lifetime)
+
+	// the same key twice has the same key id
+	_, err = (&Config{UpstreamJwtKeyFiles: file + "," + file}).Minter()
+	assert.Error(t, err)
+
+	_, err = (&Config{UpstreamJwtKeyFiles: file, UpstreamJwtLifetime: "forever"}).Minter()
+	assert.Error(t, err)
+}
+
+// withSettings sets the provider settings of c, as name and value pairs, like
+// their flags.
+func withSettings(c *Config, settings ...string) *Config {
+	for i := 0; i < len(settings); i += 2 {
+		if err := c.Set(settings[i], settings[i+1]); err != nil {
+			panic(err)
+		}
+	}
+	return c
+}
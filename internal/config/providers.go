@@ -0,0 +1,206 @@
+package config
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/nais/authproxy/internal/auth"
+)
+
+// the settings shared by several providers
+var (
+	tokenHeader    = Extra("auth-token-header", "Auth token header, which header to check for token, required for --auth-provider 'key'")
+	tokenSources   = Extra("auth-token-sources", "Comma separated list of where to look for the token, in order, i.e. 'header:Authorization:Bearer,cookie:token,query:access_token,websocket'. Overrides --auth-token-header for --auth-provider 'jwt', 'paseto' and 'key'")
+	requiredClaims = Extra("auth-required-claims", "Comma separated list of required JWT claims as key/value pairs, i.e. 'key1=value1,key2=value2'. Used for auth-provider 'jwt' and 'paseto'")
+	// keyFiles replace or add to the keys of the provider
+	keyFiles = []Setting{
+		Extra("auth-jwks-file", "Path to a JWKS file, checked for changes every 10s. Can be combined with --auth-jwks-url for --auth-provider 'jwt'. Replaces Google's keys for 'iap'"),
+		Extra("auth-jwks", "Inline JWKS JSON or PEM encoded public keys. Can be combined with --auth-jwks-url for --auth-provider 'jwt'"),
+		Extra("auth-public-key-file", "Path to a file with PEM encoded public keys, checked for changes every 10s. Can be combined with --auth-jwks-url for --auth-provider 'jwt'"),
+	}
+	// tokenPolicy overrides the checks of the token time claims
+	tokenPolicy = []Setting{
+		Extra("auth-clock-skew", "Clock skew allowed when checking token time claims, i.e. '10s'. Defaults to 5s for 'jwt' and 30s for 'iap', where 'exp' is checked without it"),
+		Extra("auth-max-token-age", "Maximum time since the token was issued ('iat'), i.e. '1h'. Used for auth-provider 'jwt', 'paseto' and 'iap'"),
+		Extra("auth-max-token-lifetime", "Maximum token lifetime ('exp' - 'iat'), i.e. '24h'. Used for auth-provider 'jwt', 'paseto' and 'iap'"),
+		Extra("auth-required-time-claims", "Comma separated list of time claims that must be present, any of 'exp', 'iat', 'nbf' or 'none'. Defaults to 'none' for 'jwt' and 'paseto', so tokens without 'exp' are accepted, and 'exp,iat' for 'iap'"),
+	}
+	acrLevels = Extra("auth-acr-levels", "Comma separated list of 'acr' values ordered from weakest to strongest, i.e. 'Level3,Level4'. Used with --auth-step-up")
+	stepUp    = Extra("auth-step-up", "Comma separated list of paths that require a stronger or more recent login, i.e. '/payments=Level4,/profile=;max_age=1h'. Used for auth-provider 'jwt' and 'idporten'")
+)
+
+// azureIdentityHeaders pass the NAV ident of employees and the object ID of
+// the user or application upstream.
+var azureIdentityHeaders = auth.IdentityHeaders{
+	{Name: "X-Auth-Navident", Claim: "NAVident"},
+	{Name: "X-Auth-Oid", Claim: "oid"},
+}
+
+// DefaultPidHeader passes the national identity number of the citizen
+// upstream for ID-porten.
+const DefaultPidHeader = "X-Auth-Pid"
+
+// tokenXIdentityHeaders pass the person the token was issued for and the
+// calling application upstream.
+var tokenXIdentityHeaders = auth.IdentityHeaders{
+	{Name: DefaultPidHeader, Claim: "pid"},
+	{Name: "X-Auth-Client-Id", Claim: "client_id"},
+}
+
+// maskinportenIdentityHeaders pass the organisation number of the consumer
+// upstream, without the ISO 6523 scheme.
+var maskinportenIdentityHeaders = auth.IdentityHeaders{
+	{Name: "X-Auth-Consumer-Orgno", Claim: "consumer.ID", TrimPrefix: auth.MaskinportenOrgPrefix},
+}
+
+// idPortenIdentity passes the national identity number under the configured
+// header upstream.
+func idPortenIdentity(c *Config) auth.IdentityHeaders {
+	header := c.get("auth-idporten-pid-header")
+	if header == "" {
+		header = DefaultPidHeader
+	}
+	return auth.IdentityHeaders{{Name: http.CanonicalHeaderKey(header), Claim: "pid"}}
+}
+
+// the built-in providers, in the order they are listed in the help
+func init() {
+	Register(ProviderSpec{
+		Name:        "iap",
+		Description: "Google IAP signed headers",
+		Settings: append(append([]Setting{
+			Extra("auth-audience", "Comma separated list of accepted audiences, the 'aud' claim to expect in the JWT. Used for --auth-provider 'iap'"),
+			Extra("auth-iap-header", "Header with the IAP assertion. Defaults to 'X-Goog-IAP-JWT-Assertion'"),
+			Extra("auth-iap-project-number", "Google Cloud project number, used to build the IAP audiences for --auth-iap-project-id and --auth-iap-backend-service-ids"),
+			Extra("auth-iap-project-id", "Google Cloud project ID, accepts the IAP audience of the App Engine app"),
+			Extra("auth-iap-backend-service-ids", "Comma separated list of backend service IDs, accepts their IAP audiences"),
+			Extra("auth-iap-allowed-emails", "Comma separated list of users allowed through IAP, others are forbidden"),
+			Extra("auth-iap-allowed-domains", "Comma separated list of Google Workspace domains ('hd' claim) allowed through IAP, others are forbidden"),
+		}, keyFiles...), tokenPolicy...),
+		New: func(c *Config) (auth.Provider, error) { return c.iap() },
+	})
+	Register(ProviderSpec{
+		Name:        "key",
+		Description: "Pre shared keys, e.g. API keys",
+		Settings: []Setting{
+			Extra("auth-pre-shared-key", "Auth pre shared key, the pre shared key to check against, required for --auth-provider 'key'"),
+			Extra("auth-pre-shared-keys", "Comma separated list of named pre shared keys, i.e. 'billing=key1,reports=key2'. The name is passed upstream as the subject. Used for --auth-provider 'key'"),
+			tokenHeader,
+			tokenSources,
+		},
+		New: func(c *Config) (auth.Provider, error) { return c.preSharedKey() },
+	})
+	Register(ProviderSpec{
+		Name:        "jwt",
+		Description: "Any OAuth2 bearer JWT",
+		Settings: append([]Setting{
+			Extra("auth-jwks-url", "The URL to fetch the JWKS from, required for --auth-provider 'jwt' unless another key source is set"),
+			requiredClaims,
+			Extra("auth-jwt-algorithms", "Comma separated allowlist of JWT signing algorithms, i.e. 'RS256,ES256,EdDSA'. Defaults to all asymmetric algorithms. Used for auth-provider 'jwt'"),
+			Extra("auth-jwt-type", "Required JWT 'typ' header, i.e. 'at+jwt' for RFC 9068 access tokens. Used for auth-provider 'jwt'"),
+			ExtraBool("auth-jwt-allow-id-tokens", "Accept OpenID Connect ID tokens, which are rejected by default so they can't be used as access tokens. Used for auth-provider 'jwt'"),
+			ExtraBool("auth-jwt-allow-no-kid", "Accept JWTs without a 'kid' header by trying every key allowed for the algorithm. Used for auth-provider 'jwt'"),
+			Extra("auth-jwe-key-files", "Comma separated list of JWKS or PEM files with private keys to decrypt encrypted tokens (JWE). Several keys can be given for rotation. Used for auth-provider 'jwt'"),
+			ExtraBool("auth-jwe-required", "Reject tokens that aren't encrypted. Used with --auth-jwe-key-files"),
+			tokenHeader,
+			tokenSources,
+		}, slices.Concat(keyFiles, tokenPolicy, []Setting{acrLevels, stepUp})...),
+		New:            func(c *Config) (auth.Provider, error) { return c.jwt() },
+		ExchangesToken: true,
+	})
+	Register(ProviderSpec{
+		Name:        "azure",
+		Description: "Entra ID (Azure AD) access tokens",
+		Settings: append([]Setting{
+			Extra("azure-app-well-known-url", "Entra ID discovery URL of the tenant. Required for --auth-provider 'azure'"),
+			Extra("azure-app-client-id", "Client ID of the app in Entra ID, the expected 'aud' claim. Required for --auth-provider 'azure'"),
+			Extra("azure-app-tenant-id", "Entra ID tenant ID, the expected 'tid' claim. Required for --auth-provider 'azure'"),
+			Extra("azure-app-pre-authorized-apps", "JSON list of pre-authorized apps, i.e. '[{\"name\":\"cluster:namespace:app\",\"clientId\":\"...\"}]'. Used to resolve --auth-azure-allowed-apps"),
+			Extra("auth-azure-allowed-groups", "Comma separated list of group object IDs ('groups' claim), others are forbidden. Used for --auth-provider 'azure'"),
+			Extra("auth-azure-allowed-roles", "Comma separated list of app roles ('roles' claim), others are forbidden. Used for --auth-provider 'azure'"),
+			Extra("auth-azure-allowed-apps", "Comma separated list of calling apps ('azp' claim), client IDs or names of pre-authorized apps, others are forbidden. Used for --auth-provider 'azure'"),
+			tokenSources,
+		}, tokenPolicy...),
+		New:      func(c *Config) (auth.Provider, error) { return c.azure() },
+		Identity: func(*Config) auth.IdentityHeaders { return azureIdentityHeaders },
+		Preset:   true,
+	})
+	Register(ProviderSpec{
+		Name:        "maskinporten",
+		Description: "Maskinporten access tokens of external organisations",
+		Settings: append([]Setting{
+			Extra("maskinporten-well-known-url", "Maskinporten authorization server metadata URL. Required for --auth-provider 'maskinporten'"),
+			Extra("auth-maskinporten-scopes", "Space or comma separated list of scopes that must all be granted, i.e. 'nav:team/api'. Required for --auth-provider 'maskinporten'"),
+			Extra("auth-maskinporten-allowed-consumers", "Comma separated list of organisation numbers of allowed consumers ('consumer.ID' claim), others are forbidden. Used for --auth-provider 'maskinporten'"),
+			tokenSources,
+		}, tokenPolicy...),
+		New:      func(c *Config) (auth.Provider, error) { return c.maskinporten() },
+		Identity: func(*Config) auth.IdentityHeaders { return maskinportenIdentityHeaders },
+		Preset:   true,
+	})
+	Register(ProviderSpec{
+		Name:        "tokenx",
+		Description: "TokenX tokens of other apps on the platform",
+		Settings: append([]Setting{
+			Extra("token-x-well-known-url", "TokenX discovery URL. Required for --auth-provider 'tokenx'"),
+			Extra("token-x-client-id", "Client ID of the app in TokenX, the expected 'aud' claim. Required for --auth-provider 'tokenx'"),
+			Extra("auth-tokenx-allowed-apps", "Comma separated list of calling apps ('client_id' claim) as 'cluster:namespace:app', '*' matches any part, i.e. 'dev-gcp:team:*'. Others are forbidden. Used for --auth-provider 'tokenx'"),
+			tokenSources,
+		}, tokenPolicy...),
+		New:            func(c *Config) (auth.Provider, error) { return c.tokenX() },
+		Identity:       func(*Config) auth.IdentityHeaders { return tokenXIdentityHeaders },
+		ExchangesToken: true,
+		Preset:         true,
+	})
+	Register(ProviderSpec{
+		Name:        "idporten",
+		Description: "ID-porten access tokens of citizens",
+		Settings: append([]Setting{
+			Extra("idporten-well-known-url", "ID-porten discovery URL. Required for --auth-provider 'idporten'"),
+			Extra("idporten-audience", "Audience of the access tokens, the expected 'aud' claim. Required for --auth-provider 'idporten'"),
+			Extra("idporten-client-id", "Client ID the access tokens are issued to, the expected 'client_id' claim. Required for --auth-provider 'idporten'"),
+			Extra("auth-idporten-acr", "Minimum level of assurance ('acr' claim), 'idporten-loa-substantial' or 'idporten-loa-high' (default). Used for --auth-provider 'idporten'"),
+			ExtraBool("auth-idporten-require-sid", "Reject tokens without a session ID ('sid' claim). Used for --auth-provider 'idporten'"),
+			Extra("auth-idporten-pid-header", "Header for the national identity number ('pid' claim), default 'X-Auth-Pid'. Used for --auth-provider 'idporten'"),
+			stepUp,
+			tokenSources,
+		}, tokenPolicy...),
+		New:            func(c *Config) (auth.Provider, error) { return c.idPorten() },
+		Identity:       idPortenIdentity,
+		ExchangesToken: true,
+		Preset:         true,
+	})
+	Register(ProviderSpec{
+		Name:        "paseto",
+		Description: "PASETO v4.public tokens",
+		Settings: append([]Setting{
+			Extra("auth-paseto-keys", "Comma separated list of Ed25519 public keys for PASETO v4.public tokens, hex or PASERK 'k4.public.', optionally as '<kid>=<key>'. Required for auth-provider 'paseto'"),
+			requiredClaims,
+			tokenHeader,
+			tokenSources,
+		}, tokenPolicy...),
+		New: func(c *Config) (auth.Provider, error) { return c.paseto() },
+	})
+	Register(ProviderSpec{
+		Name:        "oidc-login",
+		Description: "Browser login with OpenID Connect",
+		Settings: []Setting{
+			Extra("auth-issuer", "OpenID Connect issuer, used for discovery. Required for --auth-provider 'oidc-login'"),
+			Extra("auth-client-id", "OAuth2 client ID. Required for --auth-provider 'oidc-login'"),
+			Extra("auth-client-secret", "OAuth2 client secret. Used for --auth-provider 'oidc-login'"),
+			Extra("auth-redirect-url", "Absolute URL of the login callback, i.e. 'https://app.example.com/oauth2/callback'. Required for --auth-provider 'oidc-login'"),
+			Extra("auth-scopes", "Space or comma separated list of scopes to request, default 'openid profile email'. Used for --auth-provider 'oidc-login'"),
+			Extra("auth-cookie-secret", "Secret of at least 32 characters used to encrypt session cookies. Required for --auth-provider 'oidc-login'"),
+			Extra("auth-cookie-name", "Name of the session cookie, default 'authproxy_session'. Used for --auth-provider 'oidc-login'"),
+			Extra("auth-session-max-age", "Maximum session duration before the user has to log in again, default '12h'. Used for --auth-provider 'oidc-login'"),
+			Extra("auth-post-logout-redirect-url", "Where the identity provider sends the user after logout. Used for --auth-provider 'oidc-login'"),
+		},
+		New: func(c *Config) (auth.Provider, error) { return c.oidcLogin() },
+	})
+	Register(ProviderSpec{
+		Name:        "no-op",
+		Description: "No authentication, every request is passed through",
+		Settings:    nil,
+		New:         func(*Config) (auth.Provider, error) { return auth.NoOp(), nil },
+	})
+}
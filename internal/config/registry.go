@@ -0,0 +1,229 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nais/authproxy/internal/auth"
+)
+
+// Setting is a configuration value of a provider. It is set with the flag of
+// the same name or its environment variable, i.e. AUTH_JWKS_URL for
+// 'auth-jwks-url'.
+type Setting struct {
+	Name  string
+	Usage string
+	// Value returns where the setting is stored in the configuration, a
+	// *string or a *bool.
+	Value func(c *Config) any
+}
+
+// EnvVar is the environment variable of the setting.
+func (s Setting) EnvVar() string {
+	return strings.ToUpper(strings.ReplaceAll(s.Name, "-", "_"))
+}
+
+// Extra is a string setting stored in Config.Settings.
+func Extra(name, usage string) Setting {
+	return Setting{
+		Name:  name,
+		Usage: usage,
+		Value: func(c *Config) any { return c.Setting(name) },
+	}
+}
+
+// ExtraBool is a bool setting stored in Config.BoolSettings.
+func ExtraBool(name, usage string) Setting {
+	return Setting{
+		Name:  name,
+		Usage: usage,
+		Value: func(c *Config) any { return c.BoolSetting(name) },
+	}
+}
+
+// ProviderSpec describes an auth provider that can be selected with
+// --auth-provider.
+type ProviderSpec struct {
+	Name string
+	// Description is a one-line summary for the help output.
+	Description string
+	// Settings are the settings the provider reads. Settings with the same
+	// name are shared between providers.
+	Settings []Setting
+	// New creates the provider from the configuration.
+	New func(c *Config) (auth.Provider, error)
+	// Identity returns the identity headers the provider passes upstream
+	// in addition to --identity-headers, if any.
+	Identity func(c *Config) auth.IdentityHeaders
+	// ExchangesToken is whether the provider keeps the verified token, so it
+	// can be exchanged with --upstream-grant token_exchange.
+	ExchangesToken bool
+	// Preset is whether the provider is configured from the variables the
+	// platform sets for the app, i.e. AZURE_APP_CLIENT_ID. Those are only
+	// set for the enforcing provider, so a preset can't be the shadow
+	// provider.
+	Preset bool
+}
+
+var registry struct {
+	sync.RWMutex
+	providers []ProviderSpec
+}
+
+// Register adds a provider. Providers are registered from init functions,
+// i.e. in a file behind a build tag. It panics if the name is taken or a
+// setting of another provider is redefined.
+func Register(spec ProviderSpec) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if spec.Name == "" || spec.New == nil {
+		panic("config: provider needs a name and a factory")
+	}
+	for _, p := range registry.providers {
+		if p.Name == spec.Name {
+			panic("config: provider registered twice: " + spec.Name)
+		}
+		// shared settings are registered as a single flag, so they must be
+		// the same setting
+		for _, registered := range p.Settings {
+			for _, s := range spec.Settings {
+				if s.Name == registered.Name && s.Usage != registered.Usage {
+					panic("config: setting " + s.Name + " of " + spec.Name + " differs from the one of " + p.Name)
+				}
+			}
+		}
+	}
+	registry.providers = append(registry.providers, spec)
+}
+
+// Providers returns the registered providers in the order they were
+// registered.
+func Providers() []ProviderSpec {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append([]ProviderSpec(nil), registry.providers...)
+}
+
+// LookupProvider returns the provider with the name, ignoring case.
+func LookupProvider(name string) (ProviderSpec, bool) {
+	for _, p := range Providers() {
+		if strings.EqualFold(p.Name, name) {
+			return p, true
+		}
+	}
+	return ProviderSpec{}, false
+}
+
+// ProviderSettings returns the settings of the providers, each once, to
+// register them as flags.
+func ProviderSettings(filter func(ProviderSpec) bool) []Setting {
+	var settings []Setting
+	seen := map[string]bool{}
+	for _, p := range Providers() {
+		if filter != nil && !filter(p) {
+			continue
+		}
+		for _, s := range p.Settings {
+			if !seen[s.Name] {
+				seen[s.Name] = true
+				settings = append(settings, s)
+			}
+		}
+	}
+	return settings
+}
+
+// ProviderNames lists the names of the providers, i.e. "'iap', 'key' or
+// 'jwt'", for usage and error messages.
+func ProviderNames(filter func(ProviderSpec) bool) string {
+	var names []string
+	for _, p := range Providers() {
+		if filter == nil || filter(p) {
+			names = append(names, "'"+p.Name+"'")
+		}
+	}
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// Shadowable is whether the provider can be the shadow provider, see
+// ProviderSpec.Preset.
+func Shadowable(p ProviderSpec) bool {
+	return !p.Preset
+}
+
+// WriteProviderHelp writes the providers and the flags and environment
+// variables each of them reads.
+func WriteProviderHelp(w io.Writer) {
+	fmt.Fprintf(w, "Auth providers, selected with --auth-provider (AUTH_PROVIDER):\n")
+	for _, p := range Providers() {
+		fmt.Fprintf(w, "\n  %s\n", p.Name)
+		if p.Description != "" {
+			fmt.Fprintf(w, "    %s\n", p.Description)
+		}
+		for _, s := range p.Settings {
+			fmt.Fprintf(w, "    --%s (%s)\n", s.Name, s.EnvVar())
+		}
+	}
+}
+
+// Setting returns the value of a string setting, see Extra.
+func (c *Config) Setting(name string) *string {
+	if c.Settings == nil {
+		c.Settings = map[string]*string{}
+	}
+	v, ok := c.Settings[name]
+	if !ok {
+		v = new(string)
+		c.Settings[name] = v
+	}
+	return v
+}
+
+// BoolSetting returns the value of a bool setting, see ExtraBool.
+func (c *Config) BoolSetting(name string) *bool {
+	if c.BoolSettings == nil {
+		c.BoolSettings = map[string]*bool{}
+	}
+	v, ok := c.BoolSettings[name]
+	if !ok {
+		v = new(bool)
+		c.BoolSettings[name] = v
+	}
+	return v
+}
+
+// Set sets a setting of a registered provider by name, like its flag.
+func (c *Config) Set(name, value string) error {
+	for _, s := range ProviderSettings(nil) {
+		if s.Name != name {
+			continue
+		}
+		switch v := s.Value(c).(type) {
+		case *string:
+			*v = value
+		case *bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("setting %q: %w", name, err)
+			}
+			*v = b
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting %q", name)
+}
+
+func (c *Config) get(name string) string {
+	return *c.Setting(name)
+}
+
+func (c *Config) enabled(name string) bool {
+	return *c.BoolSetting(name)
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nais/authproxy/internal/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	Register(ProviderSpec{
+		Name:        "test-key",
+		Description: "Pre shared key from an extra setting",
+		Settings:    []Setting{Extra("auth-test-key", "The key"), tokenHeader},
+		New: func(c *Config) (auth.Provider, error) {
+			key := *c.Setting("auth-test-key")
+			if key == "" {
+				return nil, errors.New("auth-test-key is required")
+			}
+			return auth.PreSharedKey(c.get("auth-token-header"), key), nil
+		},
+		Identity: func(*Config) auth.IdentityHeaders {
+			return auth.IdentityHeaders{{Name: "X-Auth-Test", Claim: "sub"}}
+		},
+	})
+	Register(ProviderSpec{
+		Name: "test-forwarding",
+		New:  func(*Config) (auth.Provider, error) { return &forwardingProvider{}, nil },
+	})
+}
+
+// forwardingProvider passes the credential of the caller upstream, like the
+// built-in token providers.
+type forwardingProvider struct {
+	auth.NoAuth
+	policy auth.CredentialPolicy
+}
+
+func (p *forwardingProvider) SetCredentialPolicy(policy auth.CredentialPolicy) {
+	p.policy = policy
+}
+
+func TestRegisteredProvider(t *testing.T) {
+	c := withSettings(&Config{AuthProvider: "Test-Key"}, "auth-token-header", "X-Api-Key")
+	_, err := c.Auth()
+	assert.EqualError(t, err, "auth-test-key is required")
+
+	*c.Setting("auth-test-key") = "FooBar123"
+	p, err := c.Auth()
+	assert.NoError(t, err)
+	assert.IsType(t, &auth.PSK{}, p)
+
+	headers, err := c.Identity()
+	assert.NoError(t, err)
+	assert.Equal(t, "X-Auth-Test", headers[0].Name)
+}
+
+func TestRegisteredProviderCredentialPolicy(t *testing.T) {
+	p, err := (&Config{AuthProvider: "test-forwarding", AuthCredentialPolicy: "remove"}).Auth()
+	assert.NoError(t, err)
+	assert.Equal(t, auth.CredentialsRemove, p.(*forwardingProvider).policy)
+
+	_, err = (&Config{AuthProvider: "no-op", AuthCredentialPolicy: "remove"}).Auth()
+	assert.ErrorContains(t, err, "auth-credential-policy is not supported")
+}
+
+func TestUnknownProvider(t *testing.T) {
+	_, err := (&Config{AuthProvider: "basic"}).Auth()
+	assert.ErrorContains(t, err, "unknown auth-provider")
+}
+
+func TestRegisterTwice(t *testing.T) {
+	assert.PanicsWithValue(t, "config: provider registered twice: jwt", func() {
+		Register(ProviderSpec{Name: "jwt", New: func(c *Config) (auth.Provider, error) { return c.jwt() }})
+	})
+	assert.Panics(t, func() { Register(ProviderSpec{Name: "no-factory"}) })
+	assert.PanicsWithValue(t, "config: setting auth-step-up of step-up differs from the one of jwt", func() {
+		Register(ProviderSpec{
+			Name:     "step-up",
+			Settings: []Setting{Extra("auth-step-up", "Used for auth-provider 'step-up'")},
+			New:      func(c *Config) (auth.Provider, error) { return c.jwt() },
+		})
+	})
+}
+
+func TestProviderSettings(t *testing.T) {
+	seen := map[string]bool{}
+	for _, s := range ProviderSettings(nil) {
+		assert.False(t, seen[s.Name], s.Name)
+		seen[s.Name] = true
+
+		switch s.Value(&Config{}).(type) {
+		case *string, *bool:
+		default:
+			t.Errorf("setting %s is not a string or a bool", s.Name)
+		}
+	}
+	assert.True(t, seen["auth-jwks-url"])
+	assert.True(t, seen["auth-test-key"])
+}
+
+func TestShadowSettings(t *testing.T) {
+	names := map[string]bool{}
+	for _, s := range ProviderSettings(Shadowable) {
+		names[s.Name] = true
+	}
+	assert.True(t, names["auth-jwks-url"])
+	// shared with 'jwt'
+	assert.True(t, names["auth-step-up"])
+	assert.False(t, names["azure-app-client-id"])
+	assert.False(t, names["token-x-client-id"])
+	assert.NotContains(t, ProviderNames(Shadowable), "'azure'")
+}
+
+func TestWriteProviderHelp(t *testing.T) {
+	var b strings.Builder
+	WriteProviderHelp(&b)
+	for _, s := range []string{"\n  jwt\n", "--auth-jwks-url (AUTH_JWKS_URL)", "\n  test-key\n", "--auth-test-key (AUTH_TEST_KEY)"} {
+		assert.Contains(t, b.String(), s)
+	}
+}
+
+func TestProviderNames(t *testing.T) {
+	assert.Equal(t, "'jwt', 'tokenx' or 'idporten'", ProviderNames(func(p ProviderSpec) bool { return p.ExchangesToken }))
+	assert.Equal(t, "'iap'", ProviderNames(func(p ProviderSpec) bool { return p.Name == "iap" }))
+}
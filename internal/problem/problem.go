@@ -0,0 +1,200 @@
+package problem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/munnerz/goautoneg"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ContentTypeProblem = "application/problem+json"
+	ContentTypeJSON    = "application/json"
+	ContentTypeHTML    = "text/html"
+	ContentTypeText    = "text/plain"
+)
+
+// offers are the content types we can render, the first one is used for
+// clients that accept anything.
+var offers = []string{ContentTypeText, ContentTypeProblem, ContentTypeJSON, ContentTypeHTML}
+
+// Problem is an RFC 7807 problem details object, extended with a stable error
+// code and the correlation ID of the request.
+type Problem struct {
+	Type          string `json:"type"`
+	Title         string `json:"title"`
+	Status        int    `json:"status"`
+	Detail        string `json:"detail,omitempty"`
+	Code          string `json:"code"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// Renderer writes problems as problem+json, HTML or plain text depending on
+// the Accept header of the request.
+type Renderer struct {
+	templates map[string]*template.Template
+	logger    log.FieldLogger
+}
+
+type rendererKey struct{}
+
+// WithRenderer returns a copy of ctx carrying the renderer Write uses for the
+// request.
+func WithRenderer(ctx context.Context, rr *Renderer) context.Context {
+	return context.WithValue(ctx, rendererKey{}, rr)
+}
+
+// Write renders a problem with the renderer of the request, see
+// WithRenderer. Requests without one get the built-in templates.
+func Write(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	rr, ok := r.Context().Value(rendererKey{}).(*Renderer)
+	if !ok || rr == nil {
+		rr = &Renderer{}
+	}
+	rr.Write(w, r, status, code, detail)
+}
+
+// New creates a renderer using the HTML templates in dir, if set. A template
+// named after the status code, i.e. '401.html', is preferred over the
+// catch-all 'error.html'. Templates are executed with a Problem.
+func New(dir string) (*Renderer, error) {
+	rr := &Renderer{templates: make(map[string]*template.Template)}
+	if dir == "" {
+		return rr, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.html templates found in %s", dir)
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(file)
+		t, err := template.New(name).Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("parsing template %s: %w", name, err)
+		}
+		rr.templates[name] = t
+	}
+	return rr, nil
+}
+
+// WithLogger sets the logger errors writing responses are logged to, the
+// standard logger is used otherwise.
+func (rr *Renderer) WithLogger(l log.FieldLogger) *Renderer {
+	rr.logger = l
+	return rr
+}
+
+func (rr *Renderer) log() log.FieldLogger {
+	if rr.logger == nil {
+		return log.StandardLogger()
+	}
+	return rr.logger
+}
+
+func (rr *Renderer) Write(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	p := Problem{
+		Type:          "about:blank",
+		Title:         statusText(status),
+		Status:        status,
+		Detail:        detail,
+		Code:          code,
+		CorrelationID: middleware.GetReqID(r.Context()),
+	}
+
+	contentType := goautoneg.Negotiate(r.Header.Get("Accept"), offers)
+	var body []byte
+	var err error
+	switch contentType {
+	case ContentTypeProblem, ContentTypeJSON:
+		contentType = ContentTypeProblem
+		body, err = json.Marshal(p)
+	case ContentTypeHTML:
+		body, err = rr.html(p)
+	default:
+		contentType = ContentTypeText
+		body = []byte(text(p))
+	}
+	if err != nil {
+		rr.log().Warnf("rendering error response: %v", err)
+		contentType = ContentTypeText
+		body = []byte(text(p))
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Del("Content-Length")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		rr.log().Debugf("writing error response: %v", err)
+	}
+}
+
+func (rr *Renderer) html(p Problem) ([]byte, error) {
+	t, ok := rr.templates[strconv.Itoa(p.Status)+".html"]
+	if !ok {
+		t, ok = rr.templates["error.html"]
+	}
+	if !ok {
+		t = defaultTemplate
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func text(p Problem) string {
+	s := p.Title
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	if p.CorrelationID != "" {
+		s += " (correlation id: " + p.CorrelationID + ")"
+	}
+	return s + "\n"
+}
+
+func statusText(status int) string {
+	if status == StatusClientClosedRequest {
+		return "Client Closed Request"
+	}
+	return http.StatusText(status)
+}
+
+// StatusClientClosedRequest is the non-standard status used when the client
+// goes away before the upstream responds.
+const StatusClientClosedRequest = 499
+
+var defaultTemplate = template.Must(template.New("error.html").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>{{ .Status }} {{ .Title }}</title>
+</head>
+<body>
+  <h1>{{ .Status }} {{ .Title }}</h1>
+  {{ if .Detail }}<p>{{ .Detail }}</p>{{ end }}
+  {{ if .CorrelationID }}<p><small>Correlation ID: {{ .CorrelationID }}</small></p>{{ end }}
+</body>
+</html>
+`))
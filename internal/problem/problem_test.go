@@ -0,0 +1,139 @@
+package problem
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRendererNegotiation(t *testing.T) {
+	renderer, err := New("")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		contains    string
+	}{
+		{
+			name:        "no accept header",
+			contentType: "text/plain; charset=utf-8",
+			contains:    "Unauthorized: token expired (correlation id: abc-123)",
+		},
+		{
+			name:        "anything",
+			accept:      "*/*",
+			contentType: "text/plain; charset=utf-8",
+			contains:    "Unauthorized: token expired",
+		},
+		{
+			name:        "problem json",
+			accept:      "application/problem+json",
+			contentType: "application/problem+json; charset=utf-8",
+			contains:    `"code":"token_expired"`,
+		},
+		{
+			name:        "json",
+			accept:      "application/json, text/plain;q=0.5",
+			contentType: "application/problem+json; charset=utf-8",
+			contains:    `"correlation_id":"abc-123"`,
+		},
+		{
+			name:        "browser",
+			accept:      "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			contentType: "text/html; charset=utf-8",
+			contains:    "<h1>401 Unauthorized</h1>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			renderer.Write(rr, request(tt.accept), http.StatusUnauthorized, "token_expired", "token expired")
+
+			assert.Equal(t, http.StatusUnauthorized, rr.Code)
+			assert.Equal(t, tt.contentType, rr.Header().Get("Content-Type"))
+			assert.Contains(t, rr.Body.String(), tt.contains)
+		})
+	}
+}
+
+func TestRendererProblemJSON(t *testing.T) {
+	renderer, err := New("")
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	renderer.Write(rr, request("application/problem+json"), http.StatusBadGateway, "upstream_unavailable", "upstream unavailable")
+
+	var p Problem
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &p))
+	assert.Equal(t, Problem{
+		Type:          "about:blank",
+		Title:         "Bad Gateway",
+		Status:        http.StatusBadGateway,
+		Detail:        "upstream unavailable",
+		Code:          "upstream_unavailable",
+		CorrelationID: "abc-123",
+	}, p)
+}
+
+func TestRendererTemplates(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "error.html"), []byte(`<p>generic {{ .Code }}</p>`), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "403.html"), []byte(`<p>no access {{ .CorrelationID }}</p>`), 0o600))
+
+	renderer, err := New(dir)
+	assert.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	renderer.Write(rr, request("text/html"), http.StatusForbidden, "forbidden", "forbidden")
+	assert.Equal(t, "<p>no access abc-123</p>", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	renderer.Write(rr, request("text/html"), http.StatusUnauthorized, "token_expired", "token expired")
+	assert.Equal(t, "<p>generic token_expired</p>", rr.Body.String())
+}
+
+func TestWriteRendererOfRequest(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "error.html"), []byte(`<p>custom {{ .Code }}</p>`), 0o600))
+	renderer, err := New(dir)
+	assert.NoError(t, err)
+
+	r := request("text/html")
+	rr := httptest.NewRecorder()
+	Write(rr, r.WithContext(WithRenderer(r.Context(), renderer)), http.StatusForbidden, "forbidden", "")
+	assert.Equal(t, "<p>custom forbidden</p>", rr.Body.String())
+
+	// requests without a renderer get the built-in templates
+	rr = httptest.NewRecorder()
+	Write(rr, r, http.StatusForbidden, "forbidden", "")
+	assert.Contains(t, rr.Body.String(), "<h1>403 Forbidden</h1>")
+}
+
+func TestNewInvalidTemplates(t *testing.T) {
+	_, err := New(t.TempDir())
+	assert.Error(t, err)
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "error.html"), []byte(`{{ .Broken `), 0o600))
+	_, err = New(dir)
+	assert.Error(t, err)
+}
+
+func request(accept string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	ctx := context.WithValue(r.Context(), middleware.RequestIDKey, "abc-123")
+	return r.WithContext(ctx)
+}
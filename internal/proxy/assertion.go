@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+)
+
+// ClientAssertionType is the client_assertion_type for private_key_jwt
+// client authentication (RFC 7523 section 2.2).
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionLifetime is how long a client assertion is valid, it is only
+// used for a single token request.
+const clientAssertionLifetime = time.Minute
+
+// ClientAuth authenticates the proxy as an OAuth2 client at a token endpoint.
+type ClientAuth interface {
+	// params returns the client secret and any extra parameters of a token
+	// request.
+	params(clientID, tokenURL string) (string, url.Values, error)
+}
+
+var (
+	_ ClientAuth = clientSecret("")
+	_ ClientAuth = &PrivateKeyJWT{}
+)
+
+type clientSecret string
+
+// ClientSecret authenticates with a client secret, client_secret_basic or
+// client_secret_post depending on what the token endpoint accepts.
+func ClientSecret(secret string) ClientAuth {
+	return clientSecret(secret)
+}
+
+func (s clientSecret) params(string, string) (string, url.Values, error) {
+	return string(s), nil, nil
+}
+
+// PrivateKeyJWT authenticates with a JWT signed by the private key of the
+// client, private_key_jwt in OpenID Connect Core section 9.
+type PrivateKeyJWT struct {
+	Key jwk.Key
+	// Audience of the assertion, the token endpoint if empty. Some
+	// authorization servers expect their issuer instead.
+	Audience string
+}
+
+func PrivateKey(key jwk.Key) *PrivateKeyJWT {
+	return &PrivateKeyJWT{Key: key}
+}
+
+func (p *PrivateKeyJWT) params(clientID, tokenURL string) (string, url.Values, error) {
+	aud := p.Audience
+	if aud == "" {
+		aud = tokenURL
+	}
+	assertion, err := p.assertion(clientID, aud, time.Now())
+	if err != nil {
+		return "", nil, err
+	}
+	return "", url.Values{
+		"client_assertion_type": {ClientAssertionType},
+		"client_assertion":      {assertion},
+	}, nil
+}
+
+func (p *PrivateKeyJWT) assertion(clientID, aud string, now time.Time) (string, error) {
+	t, err := jwt.NewBuilder().
+		Issuer(clientID).
+		Subject(clientID).
+		Audience([]string{aud}).
+		JwtID(uuid.NewString()).
+		IssuedAt(now).
+		NotBefore(now).
+		Expiration(now.Add(clientAssertionLifetime)).
+		Build()
+	if err != nil {
+		return "", err
+	}
+	return sign(t, p.Key)
+}
+
+// sign signs the token with the algorithm of the key.
+func sign(t jwt.Token, key jwk.Key) (string, error) {
+	alg, ok := key.Algorithm().(jwa.SignatureAlgorithm)
+	if !ok {
+		return "", fmt.Errorf("key %q has no signing algorithm", key.KeyID())
+	}
+	b, err := jwt.Sign(t, jwt.WithKey(alg, key))
+	if err != nil {
+		return "", fmt.Errorf("signing token: %w", err)
+	}
+	return string(b), nil
+}
+
+// ParseSigningKey parses a private key as a JWK or PEM. A PEM key gets a key
+// ID derived from the RFC 7638 thumbprint, and keys without an "alg" get the
+// usual algorithm for their type.
+func ParseSigningKey(b []byte) (jwk.Key, error) {
+	b = bytes.TrimSpace(b)
+	isPEM := bytes.HasPrefix(b, []byte("-----BEGIN"))
+	set, err := jwk.Parse(b, jwk.WithPEM(isPEM))
+	if err != nil {
+		return nil, err
+	}
+	if set.Len() != 1 {
+		return nil, fmt.Errorf("expected a single key, found %d", set.Len())
+	}
+
+	key, _ := set.Key(0)
+	private, err := jwk.IsPrivateKey(key)
+	if err != nil || !private {
+		return nil, errors.New("signing key must be a private key")
+	}
+	if key.KeyID() == "" {
+		if err := jwk.AssignKeyID(key); err != nil {
+			return nil, fmt.Errorf("assigning key id: %w", err)
+		}
+	}
+	if key.Algorithm().String() == "" {
+		alg, err := defaultAlgorithm(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := key.Set(jwk.AlgorithmKey, alg); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func defaultAlgorithm(key jwk.Key) (jwa.SignatureAlgorithm, error) {
+	switch key := key.(type) {
+	case jwk.RSAPrivateKey:
+		return jwa.RS256, nil
+	case jwk.ECDSAPrivateKey:
+		switch key.Crv() {
+		case jwa.P256:
+			return jwa.ES256, nil
+		case jwa.P384:
+			return jwa.ES384, nil
+		case jwa.P521:
+			return jwa.ES512, nil
+		}
+	case jwk.OKPPrivateKey:
+		if key.Crv() == jwa.Ed25519 {
+			return jwa.EdDSA, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %s", key.KeyType())
+}
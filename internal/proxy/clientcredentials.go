@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultRefreshBefore is how long before it expires a cached upstream token
+// is refreshed.
+const DefaultRefreshBefore = time.Minute
+
+var _ Credential = &ClientCredentials{}
+
+// ClientCredentials sets an access token from the OAuth2 client credentials
+// grant (RFC 6749 section 4.4) on upstream requests. The token is cached and
+// refreshed before it expires, concurrent requests share a single refresh.
+type ClientCredentials struct {
+	TokenURL string
+	ClientID string
+	Scopes   []string
+	// RefreshBefore is how long before it expires the token is refreshed.
+	RefreshBefore time.Duration
+
+	auth   ClientAuth
+	client *http.Client
+
+	mu        sync.Mutex
+	token     *oauth2.Token
+	refreshes singleflight.Group
+}
+
+func OAuth2ClientCredentials(tokenURL, clientID string, auth ClientAuth, scopes ...string) *ClientCredentials {
+	return &ClientCredentials{
+		TokenURL:      tokenURL,
+		ClientID:      clientID,
+		Scopes:        scopes,
+		RefreshBefore: DefaultRefreshBefore,
+		auth:          auth,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *ClientCredentials) WithHTTPClient(client *http.Client) *ClientCredentials {
+	c.client = client
+	return c
+}
+
+func (c *ClientCredentials) Apply(r *http.Request) error {
+	token, err := c.Token(r.Context())
+	if err != nil {
+		return err
+	}
+	token.SetAuthHeader(r)
+	return nil
+}
+
+// Token returns the cached token, fetching a new one when it is about to
+// expire. If that fails the cached token is used as long as it is valid.
+func (c *ClientCredentials) Token(ctx context.Context) (*oauth2.Token, error) {
+	c.mu.Lock()
+	cached := c.token
+	c.mu.Unlock()
+	// a token without expiry is valid until the upstream rejects it
+	if cached != nil && (cached.Expiry.IsZero() || time.Until(cached.Expiry) > c.RefreshBefore) {
+		return cached, nil
+	}
+
+	v, err, _ := c.refreshes.Do("token", func() (any, error) {
+		// a single caller going away must not fail the shared refresh
+		return c.fetch(context.WithoutCancel(ctx))
+	})
+	if err != nil {
+		if cached != nil && cached.Valid() {
+			log.Warnf("client credentials: keeping cached token: %v", err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	return v.(*oauth2.Token), nil
+}
+
+func (c *ClientCredentials) fetch(ctx context.Context) (*oauth2.Token, error) {
+	secret, params, err := c.auth.params(c.ClientID, c.TokenURL)
+	if err != nil {
+		return nil, fmt.Errorf("client authentication: %w", err)
+	}
+	config := &clientcredentials.Config{
+		ClientID:       c.ClientID,
+		ClientSecret:   secret,
+		TokenURL:       c.TokenURL,
+		Scopes:         c.Scopes,
+		EndpointParams: params,
+	}
+	if secret == "" {
+		// the client ID is only sent in the body without a secret
+		config.AuthStyle = oauth2.AuthStyleInParams
+	}
+
+	token, err := config.Token(context.WithValue(ctx, oauth2.HTTPClient, c.client))
+	if err != nil {
+		return nil, fmt.Errorf("fetching client credentials token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("fetching client credentials token: no access token in response")
+	}
+
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+	return token, nil
+}
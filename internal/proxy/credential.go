@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// Credential authenticates the proxy to the upstream, in place of the
+// credential of the caller.
+type Credential interface {
+	// Apply sets the credential on an upstream request. An error fails the
+	// request with a bad gateway.
+	Apply(r *http.Request) error
+}
+
+var _ Credential = &StaticCredential{}
+
+// StaticCredential sets a fixed header value, e.g. an API key of the
+// upstream.
+type StaticCredential struct {
+	Header string
+	Value  string
+}
+
+func Static(header, value string) *StaticCredential {
+	return &StaticCredential{
+		Header: header,
+		Value:  value,
+	}
+}
+
+func (c *StaticCredential) Apply(r *http.Request) error {
+	r.Header.Set(c.Header, c.Value)
+	return nil
+}
+
+// credentialTransport applies the credential to every upstream request.
+type credentialTransport struct {
+	credential Credential
+	next       http.RoundTripper
+}
+
+func (t *credentialTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	r = r.Clone(r.Context())
+	if err := t.credential.Apply(r); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(r)
+}
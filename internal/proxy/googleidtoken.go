@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+)
+
+// DefaultMetadataHost is the GCE metadata server, GCE_METADATA_HOST overrides
+// it like in the Google client libraries.
+const DefaultMetadataHost = "metadata.google.internal"
+
+var _ Credential = &GoogleIDToken{}
+
+// GoogleIDToken sets a Google-signed ID token for the audience as bearer
+// token on upstream requests, i.e. to call a Cloud Run service or an app
+// behind IAP. Tokens are cached and refreshed before they expire.
+type GoogleIDToken struct {
+	Audience string
+	source   oauth2.TokenSource
+}
+
+// GoogleIDTokens uses the token source, see MetadataIDTokens and
+// ServiceAccountIDTokens. The source must put the ID token in AccessToken.
+func GoogleIDTokens(audience string, source oauth2.TokenSource) *GoogleIDToken {
+	return &GoogleIDToken{
+		Audience: audience,
+		source:   oauth2.ReuseTokenSourceWithExpiry(nil, source, DefaultRefreshBefore),
+	}
+}
+
+func (g *GoogleIDToken) Apply(r *http.Request) error {
+	token, err := g.source.Token()
+	if err != nil {
+		return fmt.Errorf("fetching google id token: %w", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	return nil
+}
+
+// ServiceAccountIDTokens signs ID tokens with the key of a service account.
+func ServiceAccountIDTokens(ctx context.Context, credentialsFile, audience string) (oauth2.TokenSource, error) {
+	return idtoken.NewTokenSource(ctx, audience, option.WithAuthCredentialsFile(option.ServiceAccount, credentialsFile))
+}
+
+var _ oauth2.TokenSource = &MetadataIDTokenSource{}
+
+// MetadataIDTokenSource gets ID tokens for the service account of the
+// instance from the metadata server.
+type MetadataIDTokenSource struct {
+	// Host of the metadata server, i.e. a local stand-in in tests.
+	Host     string
+	Audience string
+	client   *http.Client
+}
+
+func MetadataIDTokens(audience string) *MetadataIDTokenSource {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = DefaultMetadataHost
+	}
+	return &MetadataIDTokenSource{
+		Host:     host,
+		Audience: audience,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *MetadataIDTokenSource) WithHTTPClient(client *http.Client) *MetadataIDTokenSource {
+	s.client = client
+	return s
+}
+
+func (s *MetadataIDTokenSource) Token() (*oauth2.Token, error) {
+	u := url.URL{
+		Scheme:   "http",
+		Host:     s.Host,
+		Path:     "/computeMetadata/v1/instance/service-accounts/default/identity",
+		RawQuery: url.Values{"audience": {s.Audience}, "format": {"full"}}.Encode(),
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("metadata server: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("metadata server: reading response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata server: unexpected status %d", res.StatusCode)
+	}
+
+	raw := strings.TrimSpace(string(body))
+	if raw == "" {
+		return nil, errors.New("metadata server: empty id token")
+	}
+	// the token is only read for its expiry, the upstream verifies it
+	t, err := jwt.ParseString(raw, jwt.WithVerify(false), jwt.WithValidate(false))
+	if err != nil {
+		return nil, fmt.Errorf("metadata server: parsing id token: %w", err)
+	}
+	return &oauth2.Token{
+		AccessToken: raw,
+		TokenType:   "Bearer",
+		Expiry:      t.Expiration(),
+	}, nil
+}
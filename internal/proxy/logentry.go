@@ -7,22 +7,24 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/nais/authproxy/internal/auth"
 	log "github.com/sirupsen/logrus"
 )
 
-var logger *requestLogger
-
-type LogEntryMiddleware struct{}
+// LogEntryMiddleware logs every request and response, and passes the
+// request logger on to the auth providers.
+type LogEntryMiddleware struct {
+	logger *requestLogger
+}
 
 // LogEntry is copied verbatim from httplog package to replace with our own requestLogger implementation.
-func LogEntry() LogEntryMiddleware {
-	logger = &requestLogger{Logger: log.StandardLogger()}
-	return LogEntryMiddleware{}
+func LogEntry(logger *log.Logger) LogEntryMiddleware {
+	return LogEntryMiddleware{logger: &requestLogger{Logger: logger}}
 }
 
 func (l *LogEntryMiddleware) Handler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		entry := logger.NewLogEntry(r)
+		entry := l.logger.NewLogEntry(r)
 		entry.WithRequestLogFields(r).Infof("%s - %s", r.Method, r.URL.Path)
 
 		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
@@ -31,11 +33,14 @@ func (l *LogEntryMiddleware) Handler(next http.Handler) http.Handler {
 			entry.Write(ww.Status(), ww.BytesWritten(), ww.Header(), time.Since(t1), nil)
 		}()
 
-		next.ServeHTTP(ww, middleware.WithLogEntry(r, entry))
+		r = middleware.WithLogEntry(r, entry)
+		next.ServeHTTP(ww, r.WithContext(auth.WithLogger(r.Context(), entry.Logger)))
 	}
 	return http.HandlerFunc(fn)
 }
 
+// LogEntryFrom returns the logger of a request, with the fields of the
+// request on the standard logger if the middleware didn't run.
 func LogEntryFrom(r *http.Request) *log.Entry {
 	ctx := r.Context()
 	val := ctx.Value(middleware.LogEntryCtxKey)
@@ -44,8 +49,8 @@ func LogEntryFrom(r *http.Request) *log.Entry {
 		return entry.Logger
 	}
 
-	entry = logger.NewLogEntry(r)
-	return entry.Logger
+	logger := &requestLogger{Logger: log.StandardLogger()}
+	return logger.NewLogEntry(r).Logger
 }
 
 type requestLogger struct {
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/nais/authproxy/internal/auth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultIdentityTokenHeader is the upstream header with the minted
+	// identity token.
+	DefaultIdentityTokenHeader = "X-Auth-Identity"
+	DefaultIdentityTokenIssuer = "authproxy"
+	// DefaultIdentityTokenLifetime is short, the token is minted for every
+	// request.
+	DefaultIdentityTokenLifetime = 5 * time.Minute
+	// JWKSPath is where the public keys of minted tokens are served.
+	JWKSPath = "/.well-known/jwks.json"
+)
+
+var _ Credential = &Minter{}
+
+// Minter signs a short-lived JWT with the normalized principal of every
+// authenticated request, so upstreams get the same identity whatever
+// provider authenticated the caller. The first key signs, the others are
+// only published so tokens signed by a previous or next key can be verified
+// while keys are rotated.
+type Minter struct {
+	Header   string
+	Issuer   string
+	Audience string
+	Lifetime time.Duration
+
+	keys []jwk.Key
+	jwks []byte
+}
+
+func Mint(keys ...jwk.Key) (*Minter, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	public := jwk.NewSet()
+	for _, key := range keys {
+		if key.KeyID() == "" {
+			return nil, errors.New("signing keys must have a key id")
+		}
+		if _, ok := public.LookupKeyID(key.KeyID()); ok {
+			return nil, fmt.Errorf("duplicate key id %q", key.KeyID())
+		}
+		pk, err := key.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := pk.Set(jwk.KeyUsageKey, jwk.ForSignature); err != nil {
+			return nil, err
+		}
+		if err := public.AddKey(pk); err != nil {
+			return nil, err
+		}
+	}
+	jwks, err := json.Marshal(public)
+	if err != nil {
+		return nil, err
+	}
+	return &Minter{
+		Header:   DefaultIdentityTokenHeader,
+		Issuer:   DefaultIdentityTokenIssuer,
+		Lifetime: DefaultIdentityTokenLifetime,
+		keys:     keys,
+		jwks:     jwks,
+	}, nil
+}
+
+// Apply sets the minted token for authenticated requests. The header is
+// always removed first, so clients can't set it.
+func (m *Minter) Apply(r *http.Request) error {
+	r.Header.Del(m.Header)
+	principal, ok := auth.PrincipalFrom(r.Context())
+	if !ok {
+		return nil
+	}
+	token, err := m.mint(principal, time.Now())
+	if err != nil {
+		return err
+	}
+	r.Header.Set(m.Header, token)
+	return nil
+}
+
+func (m *Minter) mint(p *auth.Principal, now time.Time) (string, error) {
+	b := jwt.NewBuilder().
+		Issuer(m.Issuer).
+		Subject(p.Subject).
+		JwtID(uuid.NewString()).
+		IssuedAt(now).
+		NotBefore(now).
+		Expiration(now.Add(m.Lifetime)).
+		Claim("provider", p.Provider)
+	if m.Audience != "" {
+		b = b.Audience([]string{m.Audience})
+	}
+	if p.Provider == "key" && p.Subject != "" {
+		b = b.Claim("key_name", p.Subject)
+	}
+	if groups := groupsOf(p); len(groups) > 0 {
+		b = b.Claim("groups", groups)
+	}
+
+	t, err := b.Build()
+	if err != nil {
+		return "", err
+	}
+	return sign(t, m.keys[0])
+}
+
+// groupsOf returns the string values of the "groups" claim.
+func groupsOf(p *auth.Principal) []string {
+	var groups []string
+	switch v := p.Claims["groups"].(type) {
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	case []string:
+		groups = v
+	}
+	return groups
+}
+
+// JWKS serves the public keys of minted tokens.
+func (m *Minter) JWKS() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if _, err := w.Write(m.jwks); err != nil {
+			log.Debugf("writing jwks: %v", err)
+		}
+	})
+}
@@ -7,14 +7,19 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strings"
+
+	"github.com/nais/authproxy/internal/auth"
+	"github.com/nais/authproxy/internal/problem"
 )
 
 type ReverseProxy struct {
 	*httputil.ReverseProxy
+	identityHeaders auth.IdentityHeaders
 }
 
 func New(scheme, upstreamHost string) *ReverseProxy {
-	rp := &httputil.ReverseProxy{
+	p := &ReverseProxy{}
+	p.ReverseProxy = &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
 			// Instruct http.ReverseProxy to not modify X-Forwarded-For header
 			// r.Header["X-Forwarded-For"] = nil
@@ -23,25 +28,41 @@ func New(scheme, upstreamHost string) *ReverseProxy {
 			r.URL.Scheme = strings.ToLower(scheme)
 			r.Host = upstreamHost
 
-			// TODO: get token from context and pass through if we need this functionality
-			//accessToken, ok := mv.AccessTokenFrom(r.Context())
-			/*if ok {
-				r.Header.Set("authorization", "Bearer "+accessToken)
-			}*/
+			p.identityHeaders.Apply(r)
 		},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
 			logger := LogEntryFrom(r)
 
 			if errors.Is(err, context.Canceled) {
-				w.WriteHeader(499)
+				problem.Write(w, r, problem.StatusClientClosedRequest, "client_closed_request", "")
 			} else {
 				logger.Warnf("reverseproxy: proxy error: %+v", err)
-				w.WriteHeader(http.StatusBadGateway)
+				problem.Write(w, r, http.StatusBadGateway, "upstream_unavailable", "upstream unavailable")
 			}
 		},
 		ErrorLog: log.New(logrusErrorWriter{}, "reverseproxy: ", 0),
 	}
-	return &ReverseProxy{rp}
+	return p
+}
+
+// WithCredential authenticates upstream requests with the credential. The
+// credential of the caller should be removed by the auth provider. Several
+// credentials can be added, they are applied in order.
+func (rp *ReverseProxy) WithCredential(c Credential) *ReverseProxy {
+	next := rp.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	rp.Transport = &credentialTransport{credential: c, next: next}
+	return rp
+}
+
+// WithIdentityHeaders passes the identity of authenticated requests upstream
+// in the given headers. The headers are always removed from the incoming
+// request.
+func (rp *ReverseProxy) WithIdentityHeaders(headers auth.IdentityHeaders) *ReverseProxy {
+	rp.identityHeaders = headers
+	return rp
 }
 
 func (rp *ReverseProxy) Handle() http.HandlerFunc {
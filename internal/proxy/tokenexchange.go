@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nais/authproxy/internal/auth"
+	"golang.org/x/sync/singleflight"
+)
+
+// RFC 8693 token exchange parameters.
+const (
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	TokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// maxExchangedTokens bounds the cache. When it is full, expired tokens are
+// swept, then the tokens that expire first are evicted.
+const maxExchangedTokens = 1000
+
+var _ Credential = &TokenExchange{}
+
+// TokenExchange exchanges the verified token of the caller for a token with
+// the audience of the upstream (RFC 8693), as done by TokenX. Exchanged
+// tokens are cached per subject token until they are about to expire, tokens
+// without "expires_in" aren't cached.
+type TokenExchange struct {
+	TokenURL string
+	ClientID string
+	// Audience is the upstream, i.e. "cluster:namespace:app" for TokenX.
+	Audience string
+	// SubjectTokenType is the type of the token of the caller.
+	SubjectTokenType string
+	// RefreshBefore is how long before it expires a cached token is
+	// exchanged again.
+	RefreshBefore time.Duration
+
+	auth   ClientAuth
+	client *http.Client
+
+	mu        sync.Mutex
+	tokens    map[[sha256.Size]byte]exchangedToken
+	exchanges singleflight.Group
+}
+
+type exchangedToken struct {
+	accessToken string
+	expiry      time.Time
+}
+
+func OAuth2TokenExchange(tokenURL, clientID, audience string, auth ClientAuth) *TokenExchange {
+	return &TokenExchange{
+		TokenURL:         tokenURL,
+		ClientID:         clientID,
+		Audience:         audience,
+		SubjectTokenType: TokenTypeJWT,
+		RefreshBefore:    DefaultRefreshBefore,
+		auth:             auth,
+		client:           &http.Client{Timeout: 10 * time.Second},
+		tokens:           make(map[[sha256.Size]byte]exchangedToken),
+	}
+}
+
+func (e *TokenExchange) WithHTTPClient(client *http.Client) *TokenExchange {
+	e.client = client
+	return e
+}
+
+// Apply sets the exchanged token of the caller. Anonymous requests are passed
+// upstream without a token.
+func (e *TokenExchange) Apply(r *http.Request) error {
+	principal, ok := auth.PrincipalFrom(r.Context())
+	if !ok {
+		return nil
+	}
+	if principal.Token == "" {
+		return fmt.Errorf("token exchange: auth provider %q has no token to exchange", principal.Provider)
+	}
+
+	token, err := e.Token(r.Context(), principal.Token)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Token returns the exchanged token for the subject token. Concurrent
+// requests with the same subject token share a single exchange.
+func (e *TokenExchange) Token(ctx context.Context, subjectToken string) (string, error) {
+	// the cache is keyed by a hash, so it doesn't hold on to caller tokens
+	key := sha256.Sum256([]byte(subjectToken))
+
+	e.mu.Lock()
+	cached, ok := e.tokens[key]
+	e.mu.Unlock()
+	if ok && time.Until(cached.expiry) > e.RefreshBefore {
+		return cached.accessToken, nil
+	}
+
+	v, err, _ := e.exchanges.Do(string(key[:]), func() (any, error) {
+		// a single caller going away must not fail the shared exchange
+		return e.exchange(context.WithoutCancel(ctx), subjectToken)
+	})
+	if err != nil {
+		return "", err
+	}
+	token := v.(exchangedToken)
+	if token.expiry.IsZero() {
+		return token.accessToken, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, cached := e.tokens[key]; !cached && len(e.tokens) >= maxExchangedTokens {
+		e.sweep(time.Now())
+		for len(e.tokens) >= maxExchangedTokens {
+			e.evict()
+		}
+	}
+	e.tokens[key] = token
+	return token.accessToken, nil
+}
+
+// sweep removes expired tokens, mu must be held.
+func (e *TokenExchange) sweep(now time.Time) {
+	for key, token := range e.tokens {
+		if !token.expiry.After(now) {
+			delete(e.tokens, key)
+		}
+	}
+}
+
+// evict removes the token that expires first, mu must be held.
+func (e *TokenExchange) evict() {
+	var first [sha256.Size]byte
+	var expiry time.Time
+	for key, token := range e.tokens {
+		if expiry.IsZero() || token.expiry.Before(expiry) {
+			first, expiry = key, token.expiry
+		}
+	}
+	delete(e.tokens, first)
+}
+
+func (e *TokenExchange) exchange(ctx context.Context, subjectToken string) (exchangedToken, error) {
+	secret, params, err := e.auth.params(e.ClientID, e.TokenURL)
+	if err != nil {
+		return exchangedToken{}, fmt.Errorf("client authentication: %w", err)
+	}
+	form := url.Values{
+		"grant_type":         {GrantTypeTokenExchange},
+		"subject_token":      {subjectToken},
+		"subject_token_type": {e.SubjectTokenType},
+		"audience":           {e.Audience},
+	}
+	for k, v := range params {
+		form[k] = v
+	}
+	if secret == "" {
+		form.Set("client_id", e.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return exchangedToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if secret != "" {
+		req.SetBasicAuth(url.QueryEscape(e.ClientID), url.QueryEscape(secret))
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return exchangedToken{}, fmt.Errorf("token exchange: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return exchangedToken{}, fmt.Errorf("token exchange: reading response: %w", err)
+	}
+
+	var tr struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil && res.StatusCode == http.StatusOK {
+		return exchangedToken{}, fmt.Errorf("token exchange: decoding response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		if tr.Error != "" {
+			return exchangedToken{}, fmt.Errorf("token exchange: %s: %s", tr.Error, tr.ErrorDescription)
+		}
+		return exchangedToken{}, fmt.Errorf("token exchange: unexpected status %d", res.StatusCode)
+	}
+	if tr.AccessToken == "" {
+		return exchangedToken{}, errors.New("token exchange: no access token in response")
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "Bearer") && !strings.EqualFold(tr.TokenType, "N_A") {
+		return exchangedToken{}, fmt.Errorf("token exchange: unsupported token type %q", tr.TokenType)
+	}
+
+	token := exchangedToken{accessToken: tr.AccessToken}
+	if tr.ExpiresIn > 0 {
+		token.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
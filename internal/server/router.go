@@ -4,20 +4,59 @@ import (
 	"fmt"
 	"net/http"
 
-	"authproxy/internal/config"
-	"authproxy/internal/proxy"
 	"github.com/go-chi/chi/v5"
 	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/nais/authproxy/internal/auth"
+	"github.com/nais/authproxy/internal/config"
+	"github.com/nais/authproxy/internal/problem"
+	"github.com/nais/authproxy/internal/proxy"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
-func Router(cfg *config.Config) chi.Router {
-	rp := proxy.New(cfg.UpstreamScheme, cfg.UpstreamHost)
+// Router returns the handler of the proxy. It fails if the configuration is
+// invalid, so misconfigurations are caught at startup.
+func Router(cfg *config.Config) (chi.Router, error) {
+	identity, err := cfg.Identity()
+	if err != nil {
+		return nil, err
+	}
+	rp := proxy.New(cfg.UpstreamScheme, cfg.UpstreamHost).WithIdentityHeaders(identity)
+	credential, err := cfg.Upstream()
+	if err != nil {
+		return nil, err
+	}
+	if credential != nil {
+		rp.WithCredential(credential)
+	}
+	minter, err := cfg.Minter()
+	if err != nil {
+		return nil, err
+	}
+	if minter != nil {
+		rp.WithCredential(minter)
+	}
+
+	renderer, err := problem.New(cfg.ErrorTemplateDir)
+	if err != nil {
+		return nil, fmt.Errorf("loading error templates: %w", err)
+	}
+	metrics, err := auth.NewMetrics(prometheus.DefaultRegisterer)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticate, err := requireAuth(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	r := chi.NewRouter()
-	logger := proxy.LogEntry()
+	logger := proxy.LogEntry(log.StandardLogger())
+	r.Use(chimiddleware.RequestID)
 	r.Use(logger.Handler)
 	r.Use(chimiddleware.Recoverer)
+	r.Use(withContext(renderer, metrics))
 
 	r.HandleFunc("/isalive", func(writer http.ResponseWriter, _ *http.Request) {
 		_, err := fmt.Fprintf(writer, "ok\n")
@@ -25,19 +64,30 @@ func Router(cfg *config.Config) chi.Router {
 			log.Error(err)
 		}
 	})
-	r.Handle("/*", requireAuth(cfg, rp.Handle()))
-	return r
+	if minter != nil {
+		r.Handle(proxy.JWKSPath, minter.JWKS())
+	}
+	r.Handle("/*", authenticate(rp.Handle()))
+	return r, nil
 }
 
-// fail fast if auth is not configured correctly
-func requireAuth(cfg *config.Config, handler http.Handler) http.Handler {
-	provider, err := cfg.Auth()
-	if err != nil {
-		log.Fatal(err)
+// withContext passes the error renderer and the metrics to the providers and
+// the proxy with every request.
+func withContext(renderer *problem.Renderer, metrics *auth.Metrics) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := problem.WithRenderer(r.Context(), renderer)
+			next.ServeHTTP(w, r.WithContext(auth.WithMetrics(ctx, metrics)))
+		})
 	}
-	h, err := provider.Handler()
+}
+
+// requireAuth sets up the auth provider, which fails if it is not configured
+// correctly, i.e. if the keys can't be fetched.
+func requireAuth(cfg *config.Config) (auth.Handler, error) {
+	provider, err := cfg.Auth()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return h(handler)
+	return provider.Handler()
 }
@@ -1,21 +1,38 @@
 package server
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"authproxy/internal/config"
+	"github.com/nais/authproxy/internal/config"
 
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestRouter(t *testing.T) {
 	cfg := config.DefaultConfig()
 	cfg.AuthProvider = "key"
-	cfg.AuthPreSharedKey = "test"
-	cfg.AuthTokenHeader = "Authorization"
+	*cfg.Setting("auth-pre-shared-key") = "test"
+	*cfg.Setting("auth-token-header") = "Authorization"
 	cfg.UpstreamScheme = "http"
 	cfg.LogLevel = "debug"
 
@@ -28,7 +45,7 @@ func TestRouter(t *testing.T) {
 	assert.NoError(t, err)
 	cfg.UpstreamHost = u.Host
 
-	r := Router(cfg)
+	r := router(t, cfg)
 	s := httptest.NewServer(r)
 	defer s.Close()
 
@@ -71,3 +88,590 @@ func req(url string, header ...string) (*http.Request, error) {
 	}
 	return req, nil
 }
+
+func TestRouterIdentityHeaders(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.AuthProvider = "key"
+	*cfg.Setting("auth-pre-shared-keys") = "billing=test"
+	*cfg.Setting("auth-token-header") = "Authorization"
+	cfg.AuthOptional = true
+	cfg.IdentityHeaders = "X-Auth-Request-User=sub"
+	cfg.UpstreamScheme = "http"
+
+	var user []string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = r.Header.Values("X-Auth-Request-User")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+
+	u, err := url.Parse(proxyServer.URL)
+	assert.NoError(t, err)
+	cfg.UpstreamHost = u.Host
+
+	s := httptest.NewServer(router(t, cfg))
+	defer s.Close()
+
+	tests := []struct {
+		name    string
+		headers []string
+		user    []string
+	}{
+		{
+			name:    "authenticated",
+			headers: []string{"Authorization", "Bearer test", "X-Auth-Request-User", "mallory"},
+			user:    []string{"billing"},
+		},
+		{
+			name:    "spoofed header on anonymous request is removed",
+			headers: []string{"X-Auth-Request-User", "mallory"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := req(s.URL, tt.headers...)
+			assert.NoError(t, err)
+			got, err := s.Client().Do(r)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, got.StatusCode)
+			assert.Equal(t, tt.user, user)
+		})
+	}
+}
+
+func TestRouterUpstreamCredential(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.AuthProvider = "key"
+	*cfg.Setting("auth-pre-shared-key") = "test"
+	*cfg.Setting("auth-token-header") = "X-Api-Key"
+	cfg.AuthCredentialPolicy = "replace"
+	cfg.UpstreamCredential = "Bearer upstream"
+	cfg.UpstreamScheme = "http"
+
+	var apiKey, authorization string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey = r.Header.Get("X-Api-Key")
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+
+	u, err := url.Parse(proxyServer.URL)
+	assert.NoError(t, err)
+	cfg.UpstreamHost = u.Host
+
+	s := httptest.NewServer(router(t, cfg))
+	defer s.Close()
+
+	r, err := req(s.URL, "X-Api-Key", "test", "Authorization", "Bearer caller")
+	assert.NoError(t, err)
+	got, err := s.Client().Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, got.StatusCode)
+	assert.Empty(t, apiKey)
+	assert.Equal(t, "Bearer upstream", authorization)
+}
+
+func TestRouterClientCredentials(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "client.pem")
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	var fetches atomic.Int32
+	var tokenURL string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "api://upstream/.default", r.PostForm.Get("scope"))
+
+		switch r.PostForm.Get("client_assertion_type") {
+		case "":
+			id, secret, ok := r.BasicAuth()
+			if !ok || id != "proxy" || secret != "s3cret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		default:
+			assertion, err := jwt.ParseString(r.PostForm.Get("client_assertion"), jwt.WithKey(jwa.ES256, &privateKey.PublicKey), jwt.WithAudience(tokenURL))
+			if err != nil || assertion.Issuer() != "proxy" || assertion.Subject() != "proxy" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		// concurrent requests must share this fetch
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"upstream-%d","token_type":"Bearer","expires_in":3600}`, fetches.Load())
+	}))
+	defer tokenServer.Close()
+	tokenURL = tokenServer.URL
+
+	var mu sync.Mutex
+	var authorizations []string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+	u, err := url.Parse(proxyServer.URL)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		modify func(cfg *config.Config)
+	}{
+		{
+			name:   "client secret",
+			modify: func(cfg *config.Config) { cfg.UpstreamClientSecret = "s3cret" },
+		},
+		{
+			name:   "private key jwt",
+			modify: func(cfg *config.Config) { cfg.UpstreamClientKeyFile = keyFile },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetches.Store(0)
+			authorizations = nil
+
+			cfg := config.DefaultConfig()
+			cfg.AuthProvider = "key"
+			*cfg.Setting("auth-pre-shared-key") = "test"
+			*cfg.Setting("auth-token-header") = "Authorization"
+			cfg.UpstreamScheme = "http"
+			cfg.UpstreamHost = u.Host
+			cfg.UpstreamTokenUrl = tokenURL
+			cfg.UpstreamClientId = "proxy"
+			cfg.UpstreamScopes = "api://upstream/.default"
+			tt.modify(cfg)
+
+			s := httptest.NewServer(router(t, cfg))
+			defer s.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r, err := req(s.URL, "Authorization", "Bearer test")
+					assert.NoError(t, err)
+					got, err := s.Client().Do(r)
+					assert.NoError(t, err)
+					assert.Equal(t, http.StatusOK, got.StatusCode)
+				}()
+			}
+			wg.Wait()
+
+			assert.Equal(t, int32(1), fetches.Load())
+			assert.Len(t, authorizations, 10)
+			for _, authorization := range authorizations {
+				assert.Equal(t, "Bearer upstream-1", authorization)
+			}
+		})
+	}
+}
+
+func TestRouterTokenExchange(t *testing.T) {
+	signingKey, jwks := newSigningKey(t)
+	clientKey, _ := newSigningKey(t)
+	clientKeyJSON, err := json.Marshal(clientKey)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "client.json")
+	assert.NoError(t, os.WriteFile(keyFile, clientKeyJSON, 0o600))
+
+	var exchanges atomic.Int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanges.Add(1)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:token-exchange", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "urn:ietf:params:oauth:token-type:jwt", r.PostForm.Get("subject_token_type"))
+		assert.Equal(t, "cluster:team:upstream", r.PostForm.Get("audience"))
+		assert.Equal(t, "proxy", r.PostForm.Get("client_id"))
+		assert.Equal(t, "urn:ietf:params:oauth:client-assertion-type:jwt-bearer", r.PostForm.Get("client_assertion_type"))
+
+		subject, err := jwt.ParseString(r.PostForm.Get("subject_token"), jwt.WithKeySet(jwks))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprint(w, `{"error":"invalid_request","error_description":"invalid subject token"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"exchanged-%s-%d","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","token_type":"Bearer","expires_in":300}`, subject.Subject(), exchanges.Load())
+	}))
+	defer tokenServer.Close()
+
+	var authorization string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+	u, err := url.Parse(proxyServer.URL)
+	assert.NoError(t, err)
+
+	public, err := jwk.PublicSetOf(jwks)
+	assert.NoError(t, err)
+	publicJSON, err := json.Marshal(public)
+	assert.NoError(t, err)
+
+	cfg := config.DefaultConfig()
+	cfg.AuthProvider = "jwt"
+	*cfg.Setting("auth-jwks") = string(publicJSON)
+	*cfg.Setting("auth-required-claims") = "aud=authproxy"
+	cfg.AuthOptional = true
+	cfg.UpstreamScheme = "http"
+	cfg.UpstreamHost = u.Host
+	cfg.UpstreamTokenUrl = tokenServer.URL
+	cfg.UpstreamGrant = "token_exchange"
+	cfg.UpstreamClientId = "proxy"
+	cfg.UpstreamClientKeyFile = keyFile
+	cfg.UpstreamAudience = "cluster:team:upstream"
+
+	s := httptest.NewServer(router(t, cfg))
+	defer s.Close()
+
+	alice := signedToken(t, signingKey, "alice")
+	bob := signedToken(t, signingKey, "bob")
+
+	tests := []struct {
+		name          string
+		headers       []string
+		authorization string
+		exchanges     int32
+	}{
+		{
+			name:          "token is exchanged",
+			headers:       []string{"Authorization", "Bearer " + alice},
+			authorization: "Bearer exchanged-alice-1",
+			exchanges:     1,
+		},
+		{
+			name:          "exchanged token is cached",
+			headers:       []string{"Authorization", "Bearer " + alice},
+			authorization: "Bearer exchanged-alice-1",
+			exchanges:     1,
+		},
+		{
+			name:          "other caller",
+			headers:       []string{"Authorization", "Bearer " + bob},
+			authorization: "Bearer exchanged-bob-2",
+			exchanges:     2,
+		},
+		{
+			name:      "anonymous request gets no token",
+			exchanges: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := req(s.URL, tt.headers...)
+			assert.NoError(t, err)
+			got, err := s.Client().Do(r)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, got.StatusCode)
+			assert.Equal(t, tt.authorization, authorization)
+			assert.Equal(t, tt.exchanges, exchanges.Load())
+		})
+	}
+}
+
+func newSigningKey(t *testing.T) (jwk.Key, jwk.Set) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	key, err := jwk.FromRaw(privateKey)
+	assert.NoError(t, err)
+	assert.NoError(t, key.Set(jwk.AlgorithmKey, jwa.ES256))
+	assert.NoError(t, jwk.AssignKeyID(key))
+	set := jwk.NewSet()
+	assert.NoError(t, set.AddKey(key))
+	return key, set
+}
+
+func signedToken(t *testing.T, key jwk.Key, subject string) string {
+	token, err := jwt.NewBuilder().
+		Subject(subject).
+		Audience([]string{"authproxy"}).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(time.Hour)).
+		Build()
+	assert.NoError(t, err)
+	b, err := jwt.Sign(token, jwt.WithKey(jwa.ES256, key))
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestRouterIdentityToken(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"current.json", "next.json"} {
+		key, _ := newSigningKey(t)
+		b, err := json.Marshal(key)
+		assert.NoError(t, err)
+		file := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(file, b, 0o600))
+		files = append(files, file)
+	}
+
+	var identity []string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = r.Header.Values("X-Auth-Identity")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+	u, err := url.Parse(proxyServer.URL)
+	assert.NoError(t, err)
+
+	cfg := config.DefaultConfig()
+	cfg.AuthProvider = "key"
+	*cfg.Setting("auth-pre-shared-keys") = "billing=test"
+	*cfg.Setting("auth-token-header") = "Authorization"
+	cfg.AuthOptional = true
+	cfg.UpstreamScheme = "http"
+	cfg.UpstreamHost = u.Host
+	cfg.UpstreamJwtKeyFiles = strings.Join(files, ",")
+	cfg.UpstreamJwtAudience = "upstream"
+
+	s := httptest.NewServer(router(t, cfg))
+	defer s.Close()
+
+	res, err := s.Client().Get(s.URL + "/.well-known/jwks.json")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	jwks, err := jwk.ParseReader(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, jwks.Len())
+	for i := 0; i < jwks.Len(); i++ {
+		key, _ := jwks.Key(i)
+		isPrivate, err := jwk.IsPrivateKey(key)
+		assert.NoError(t, err)
+		assert.False(t, isPrivate)
+	}
+
+	r, err := req(s.URL, "Authorization", "Bearer test", "X-Auth-Identity", "spoofed")
+	assert.NoError(t, err)
+	got, err := s.Client().Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, got.StatusCode)
+	assert.Len(t, identity, 1)
+
+	token, err := jwt.ParseString(identity[0], jwt.WithKeySet(jwks), jwt.WithValidate(true), jwt.WithIssuer("authproxy"), jwt.WithAudience("upstream"))
+	assert.NoError(t, err)
+	assert.Equal(t, "billing", token.Subject())
+	provider, _ := token.Get("provider")
+	assert.Equal(t, "key", provider)
+	keyName, _ := token.Get("key_name")
+	assert.Equal(t, "billing", keyName)
+
+	// anonymous requests get no identity token
+	r, err = req(s.URL, "X-Auth-Identity", "spoofed")
+	assert.NoError(t, err)
+	got, err = s.Client().Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, got.StatusCode)
+	assert.Empty(t, identity)
+}
+
+func TestRouterGoogleIDToken(t *testing.T) {
+	key, _ := newSigningKey(t)
+	idToken := signedToken(t, key, "proxy@project.iam.gserviceaccount.com")
+
+	var fetches atomic.Int32
+	metadataServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/identity" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		assert.Equal(t, "https://upstream.a.run.app", r.URL.Query().Get("audience"))
+		_, _ = fmt.Fprint(w, idToken)
+	}))
+	defer metadataServer.Close()
+	metadata, err := url.Parse(metadataServer.URL)
+	assert.NoError(t, err)
+	t.Setenv("GCE_METADATA_HOST", metadata.Host)
+
+	var authorization string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+	u, err := url.Parse(proxyServer.URL)
+	assert.NoError(t, err)
+
+	cfg := config.DefaultConfig()
+	cfg.AuthProvider = "key"
+	*cfg.Setting("auth-pre-shared-key") = "test"
+	*cfg.Setting("auth-token-header") = "X-Api-Key"
+	cfg.UpstreamScheme = "http"
+	cfg.UpstreamHost = u.Host
+	cfg.UpstreamGoogleAudience = "https://upstream.a.run.app"
+
+	s := httptest.NewServer(router(t, cfg))
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		r, err := req(s.URL, "X-Api-Key", "test", "Authorization", "Bearer caller")
+		assert.NoError(t, err)
+		got, err := s.Client().Do(r)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, got.StatusCode)
+		assert.Equal(t, "Bearer "+idToken, authorization)
+	}
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+func TestRouterAzure(t *testing.T) {
+	key, set := newSigningKey(t)
+	publicKeys, err := jwk.PublicSetOf(set)
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	entra := httptest.NewServer(mux)
+	defer entra.Close()
+	issuer := entra.URL + "/tenant/v2.0"
+	mux.HandleFunc("/tenant/v2.0/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": entra.URL + "/tenant/keys"})
+	})
+	mux.HandleFunc("/tenant/keys", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(publicKeys)
+	})
+
+	var navIdent, oid string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		navIdent, oid = r.Header.Get("X-Auth-Navident"), r.Header.Get("X-Auth-Oid")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+	u, err := url.Parse(proxyServer.URL)
+	assert.NoError(t, err)
+
+	cfg := config.DefaultConfig()
+	cfg.AuthProvider = "azure"
+	*cfg.Setting("azure-app-well-known-url") = issuer + "/.well-known/openid-configuration"
+	*cfg.Setting("azure-app-client-id") = "client"
+	*cfg.Setting("azure-app-tenant-id") = "tenant"
+	*cfg.Setting("auth-azure-allowed-groups") = "group1"
+	cfg.UpstreamScheme = "http"
+	cfg.UpstreamHost = u.Host
+
+	s := httptest.NewServer(router(t, cfg))
+	defer s.Close()
+
+	token, err := jwt.NewBuilder().
+		Issuer(issuer).
+		Subject("alice").
+		Audience([]string{"client"}).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(time.Hour)).
+		Claim("tid", "tenant").
+		Claim("oid", "5678").
+		Claim("NAVident", "Z123456").
+		Claim("groups", []string{"group1"}).
+		Build()
+	assert.NoError(t, err)
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.ES256, key))
+	assert.NoError(t, err)
+
+	r, err := req(s.URL, "Authorization", "Bearer "+string(signed), "X-Auth-Navident", "mallory")
+	assert.NoError(t, err)
+	got, err := s.Client().Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, got.StatusCode)
+	assert.Equal(t, "Z123456", navIdent)
+	assert.Equal(t, "5678", oid)
+}
+
+func TestRouterIDPorten(t *testing.T) {
+	key, set := newSigningKey(t)
+	publicKeys, err := jwk.PublicSetOf(set)
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	idporten := httptest.NewServer(mux)
+	defer idporten.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": idporten.URL + "/", "jwks_uri": idporten.URL + "/jwks.json"})
+	})
+	mux.HandleFunc("/jwks.json", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(publicKeys)
+	})
+
+	var pid string
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pid = r.Header.Get("X-Fnr")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+	u, err := url.Parse(proxyServer.URL)
+	assert.NoError(t, err)
+
+	cfg := config.DefaultConfig()
+	cfg.AuthProvider = "idporten"
+	*cfg.Setting("idporten-well-known-url") = idporten.URL + "/.well-known/openid-configuration"
+	*cfg.Setting("idporten-audience") = "https://app.example.com"
+	*cfg.Setting("idporten-client-id") = "client"
+	*cfg.Setting("auth-idporten-pid-header") = "X-Fnr"
+	cfg.UpstreamScheme = "http"
+	cfg.UpstreamHost = u.Host
+
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	log.SetLevel(log.DebugLevel)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetLevel(log.InfoLevel)
+
+	s := httptest.NewServer(router(t, cfg))
+	defer s.Close()
+
+	token, err := jwt.NewBuilder().
+		Issuer(idporten.URL+"/").
+		Subject("pairwise").
+		Audience([]string{"https://app.example.com"}).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(time.Hour)).
+		Claim("client_id", "client").
+		Claim("acr", "idporten-loa-high").
+		Claim("pid", "12345678910").
+		Build()
+	assert.NoError(t, err)
+	signed, err := jwt.Sign(token, jwt.WithKey(jwa.ES256, key))
+	assert.NoError(t, err)
+
+	r, err := req(s.URL, "Authorization", "Bearer "+string(signed), "X-Fnr", "10987654321")
+	assert.NoError(t, err)
+	got, err := s.Client().Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, got.StatusCode)
+	assert.Equal(t, "12345678910", pid)
+	assert.NotEmpty(t, logs.String())
+	assert.NotContains(t, logs.String(), "12345678910")
+}
+
+func router(t *testing.T, cfg *config.Config) http.Handler {
+	r, err := Router(cfg)
+	assert.NoError(t, err)
+	return r
+}
+
+func TestRouterInvalidConfig(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.AuthProvider = "key"
+	_, err := Router(cfg)
+	assert.ErrorContains(t, err, "auth-pre-shared-key")
+
+	cfg = config.DefaultConfig()
+	cfg.AuthProvider = "no-op"
+	cfg.IdentityHeaders = "X-Auth-Request-User"
+	_, err = Router(cfg)
+	assert.ErrorContains(t, err, "identity-headers")
+}
@@ -0,0 +1,141 @@
+// Package authproxy provides the auth providers of authproxy as HTTP
+// middleware, for Go services that authenticate requests in-process instead
+// of behind the proxy.
+//
+//	authenticate, err := authproxy.JWT("https://issuer.example.com/jwks",
+//		authproxy.WithIssuer("https://issuer.example.com"),
+//		authproxy.WithAudience("my-api"),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	http.Handle("/", authenticate(handler))
+//
+// Handlers read the verified identity with PrincipalFrom.
+package authproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/nais/authproxy/internal/auth"
+	"github.com/nais/authproxy/internal/problem"
+)
+
+// Middleware authenticates requests before they reach the next handler.
+// Rejected requests get a problem details response with a WWW-Authenticate
+// challenge.
+type Middleware func(next http.Handler) http.Handler
+
+// Principal is the verified identity of an authenticated request.
+type Principal = auth.Principal
+
+// PrincipalFrom returns the principal of an authenticated request, false for
+// anonymous requests let through by WithOptional.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	return auth.PrincipalFrom(ctx)
+}
+
+// JWT verifies OAuth2 bearer JWTs against the keys at the JWKS URL. The URL
+// can be empty if the keys are given with WithKeys, WithKeyFile or
+// WithDiscovery. The keys are fetched before JWT returns.
+func JWT(jwksURL string, opts ...Option) (Middleware, error) {
+	o, err := newOptions("JWT", opts, optIssuer, optAudience, optRequiredClaim, optAllowedClaim, optScopes,
+		optAlgorithms, optDiscovery, optKeys, optTokenSources, optRealm, optCredentials, optOptional, optLogger,
+		optRegisterer, optErrorTemplates)
+	if err != nil {
+		return nil, err
+	}
+	p, err := auth.JWT("Authorization", jwksURL, o.claims)
+	if err != nil {
+		return nil, err
+	}
+	if o.algorithms != nil {
+		p.Algorithms = o.algorithms
+	}
+	if o.wellKnownURL != "" {
+		p.WithDiscovery(o.wellKnownURL)
+	}
+	p.WithKeySources(o.keySources...)
+	p.WithTokenSources(o.tokenSources...)
+	p.Allowed = o.allowed
+	p.Scopes = o.scopes
+	p.Realm = o.realm
+	p.Credentials = o.credentials
+	return middleware(p, o)
+}
+
+// IAP verifies the signed assertions Google Identity-Aware Proxy adds to
+// requests, for one of the audiences. Google's keys are used unless others
+// are given with WithKeys or WithKeyFile.
+func IAP(audiences []string, opts ...Option) (Middleware, error) {
+	o, err := newOptions("IAP", opts, optAllowedEmails, optAllowedDomains, optKeys, optRealm, optCredentials,
+		optOptional, optLogger, optRegisterer, optErrorTemplates)
+	if err != nil {
+		return nil, err
+	}
+	p := auth.IAP(audiences...)
+	p.AllowedEmails = o.allowedEmails
+	p.AllowedDomains = o.allowedDomains
+	p.Realm = o.realm
+	p.Credentials = o.credentials
+	p.WithKeySources(o.keySources...)
+	return middleware(p, o)
+}
+
+// PreSharedKey checks the header against the keys given with WithKey, at
+// least one is required. The name of the matching key is the subject of the
+// principal.
+func PreSharedKey(header string, opts ...Option) (Middleware, error) {
+	o, err := newOptions("PreSharedKey", opts, optKey, optTokenSources, optRealm, optCredentials, optOptional, optLogger,
+		optRegisterer, optErrorTemplates)
+	if err != nil {
+		return nil, err
+	}
+	p := auth.PreSharedKey(header, "").
+		WithTokenSources(o.tokenSources...).
+		WithRealm(o.realm)
+	for _, k := range o.keys {
+		p.WithNamedKey(k.name, k.key)
+	}
+	if o.credentials != auth.CredentialsDefault {
+		p.WithCredentialPolicy(o.credentials)
+	}
+	return middleware(p, o)
+}
+
+// middleware sets up the provider and passes the logger, metrics and error
+// renderer of the options to it with every request. Nothing is shared with
+// other middleware, unless they are given the same registerer.
+func middleware(p auth.Provider, o *options) (Middleware, error) {
+	if o.optional {
+		p = auth.Optional(p)
+	}
+	metrics, err := auth.NewMetrics(o.registerer)
+	if err != nil {
+		return nil, fmt.Errorf("authproxy: %w", err)
+	}
+	renderer, err := problem.New(o.templateDir)
+	if err != nil {
+		return nil, fmt.Errorf("authproxy: loading error templates: %w", err)
+	}
+	if o.logger != nil {
+		renderer.WithLogger(o.logger)
+	}
+	h, err := p.Handler()
+	if err != nil {
+		return nil, fmt.Errorf("authproxy: %w", err)
+	}
+	return func(next http.Handler) http.Handler {
+		authenticated := h(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := auth.WithMetrics(r.Context(), metrics)
+			ctx = problem.WithRenderer(ctx, renderer)
+			if o.logger != nil {
+				ctx = auth.WithLogger(ctx, o.logger)
+			}
+			authenticated.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}, nil
+}
@@ -0,0 +1,215 @@
+package authproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWT(t *testing.T) {
+	key, public := newKey(t)
+	authenticate, err := JWT("",
+		WithKeys(public),
+		WithIssuer("https://issuer.example.com"),
+		WithAudience("api"),
+		WithAllowedClaim("groups", "admins"),
+	)
+	assert.NoError(t, err)
+
+	var principal *Principal
+	h := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = PrincipalFrom(r.Context())
+	}))
+
+	tests := []struct {
+		name       string
+		groups     []string
+		statusCode int
+	}{
+		{name: "allowed", groups: []string{"users", "admins"}, statusCode: http.StatusOK},
+		{name: "forbidden", groups: []string{"users"}, statusCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal = nil
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+sign(t, key, "https://issuer.example.com", tt.groups))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, r)
+			assert.Equal(t, tt.statusCode, rr.Code)
+			if tt.statusCode == http.StatusOK {
+				assert.Equal(t, "alice", principal.Subject)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Header().Get("WWW-Authenticate"), "Bearer")
+}
+
+func TestPreSharedKey(t *testing.T) {
+	authenticate, err := PreSharedKey("X-Api-Key", WithKey("billing", "s3cret"), WithOptional())
+	assert.NoError(t, err)
+
+	var subject string
+	var apiKey string
+	h := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject = ""
+		if p, ok := PrincipalFrom(r.Context()); ok {
+			subject = p.Subject
+		}
+		apiKey = r.Header.Get("X-Api-Key")
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Api-Key", "s3cret")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "billing", subject)
+	assert.Empty(t, apiKey, "the key is removed by default")
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, subject)
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Api-Key", "wrong")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestOptionErrors(t *testing.T) {
+	_, err := PreSharedKey("X-Api-Key")
+	assert.Error(t, err, "no keys")
+
+	_, err = PreSharedKey("X-Api-Key", WithKey("billing", ""))
+	assert.Error(t, err)
+
+	_, err = PreSharedKey("X-Api-Key", WithKey("billing", "s3cret"), WithAudience("api"))
+	assert.ErrorContains(t, err, "WithAudience does not apply to PreSharedKey")
+
+	_, err = IAP([]string{"/projects/1/apps/app"}, WithScopes("read"))
+	assert.ErrorContains(t, err, "WithScopes does not apply to IAP")
+
+	_, err = JWT("", WithAlgorithms("none"))
+	assert.ErrorContains(t, err, "none")
+
+	_, err = JWT("", WithRequiredClaim("iss", "https://issuer.example.com"))
+	assert.ErrorContains(t, err, "WithIssuer")
+
+	_, err = JWT("")
+	assert.Error(t, err, "no keys")
+}
+
+func TestWithLogger(t *testing.T) {
+	_, public := newKey(t)
+	var logs strings.Builder
+	logger := log.New()
+	logger.SetOutput(&logs)
+	logger.SetLevel(log.DebugLevel)
+
+	authenticate, err := JWT("", WithKeys(public), WithLogger(logger.WithField("component", "api")))
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer invalid")
+	rr := httptest.NewRecorder()
+	authenticate(http.NotFoundHandler()).ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, logs.String(), "rejecting request")
+	assert.Contains(t, logs.String(), "component=api")
+}
+
+func newKey(t *testing.T) (jwk.Key, []byte) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	key, err := jwk.FromRaw(privateKey)
+	assert.NoError(t, err)
+	assert.NoError(t, key.Set(jwk.AlgorithmKey, jwa.ES256))
+	assert.NoError(t, jwk.AssignKeyID(key))
+	public, err := key.PublicKey()
+	assert.NoError(t, err)
+	b, err := json.Marshal(public)
+	assert.NoError(t, err)
+	return key, b
+}
+
+func sign(t *testing.T, key jwk.Key, issuer string, groups []string) string {
+	token, err := jwt.NewBuilder().
+		Issuer(issuer).
+		Subject("alice").
+		Audience([]string{"api"}).
+		IssuedAt(time.Now()).
+		Expiration(time.Now().Add(time.Hour)).
+		Claim("groups", groups).
+		Build()
+	assert.NoError(t, err)
+	b, err := jwt.Sign(token, jwt.WithKey(jwa.ES256, key))
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestWithRegisterer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	billing, err := PreSharedKey("X-Api-Key", WithKey("billing", "s3cret"), WithRegisterer(reg))
+	assert.NoError(t, err)
+	reports, err := PreSharedKey("X-Api-Key", WithKey("reports", "s3cret"), WithRegisterer(reg))
+	assert.NoError(t, err, "handlers share the metrics of a registry")
+	other, err := PreSharedKey("X-Api-Key", WithKey("other", "s3cret"))
+	assert.NoError(t, err)
+
+	for _, authenticate := range []Middleware{billing, reports, other} {
+		rr := httptest.NewRecorder()
+		authenticate(http.NotFoundHandler()).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	var rejections float64
+	for _, f := range families {
+		if f.GetName() == "authproxy_auth_rejections_total" {
+			for _, m := range f.GetMetric() {
+				rejections += m.GetCounter().GetValue()
+			}
+		}
+	}
+	assert.Equal(t, 2.0, rejections, "only the handlers using the registry count in it")
+}
+
+func TestWithErrorTemplates(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "401.html"), []byte(`<p>please log in</p>`), 0o600))
+
+	authenticate, err := PreSharedKey("X-Api-Key", WithKey("billing", "s3cret"), WithErrorTemplates(dir))
+	assert.NoError(t, err)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "text/html")
+	rr := httptest.NewRecorder()
+	authenticate(http.NotFoundHandler()).ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "<p>please log in</p>", rr.Body.String())
+
+	_, err = PreSharedKey("X-Api-Key", WithKey("billing", "s3cret"), WithErrorTemplates(t.TempDir()))
+	assert.ErrorContains(t, err, "no *.html templates")
+}
@@ -0,0 +1,301 @@
+package authproxy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/nais/authproxy/internal/auth"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Option configures a provider. Passing an option that doesn't apply to the
+// provider is an error, so a setting is never silently ignored.
+type Option func(*options) error
+
+// option names, to check that the options apply to the provider
+const (
+	optIssuer         = "WithIssuer"
+	optAudience       = "WithAudience"
+	optRequiredClaim  = "WithRequiredClaim"
+	optAllowedClaim   = "WithAllowedClaim"
+	optScopes         = "WithScopes"
+	optAlgorithms     = "WithAlgorithms"
+	optDiscovery      = "WithDiscovery"
+	optKeys           = "WithKeys"
+	optAllowedEmails  = "WithAllowedEmails"
+	optAllowedDomains = "WithAllowedDomains"
+	optKey            = "WithKey"
+	optTokenSources   = "WithTokenSources"
+	optRealm          = "WithRealm"
+	optCredentials    = "WithCredentialPolicy"
+	optOptional       = "WithOptional"
+	optLogger         = "WithLogger"
+	optRegisterer     = "WithRegisterer"
+	optErrorTemplates = "WithErrorTemplates"
+)
+
+type options struct {
+	used           []string
+	claims         map[string]any
+	allowed        []auth.ClaimRule
+	scopes         []string
+	algorithms     []jwa.SignatureAlgorithm
+	wellKnownURL   string
+	keySources     []auth.KeySource
+	allowedEmails  []string
+	allowedDomains []string
+	keys           []namedKey
+	tokenSources   []auth.TokenSource
+	realm          string
+	credentials    auth.CredentialPolicy
+	optional       bool
+	logger         log.FieldLogger
+	registerer     prometheus.Registerer
+	templateDir    string
+}
+
+type namedKey struct {
+	name, key string
+}
+
+func newOptions(provider string, opts []Option, supported ...string) (*options, error) {
+	o := &options{claims: map[string]any{}}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, fmt.Errorf("authproxy: %w", err)
+		}
+	}
+	for _, name := range o.used {
+		if !slices.Contains(supported, name) {
+			return nil, fmt.Errorf("authproxy: %s does not apply to %s", name, provider)
+		}
+	}
+	return o, nil
+}
+
+func (o *options) use(name string) {
+	o.used = append(o.used, name)
+}
+
+// WithIssuer requires the "iss" claim, tokens from other issuers are invalid.
+func WithIssuer(issuer string) Option {
+	return func(o *options) error {
+		o.use(optIssuer)
+		o.claims["iss"] = issuer
+		return nil
+	}
+}
+
+// WithAudience requires the audience in the "aud" claim, tokens for other
+// audiences are invalid.
+func WithAudience(audience string) Option {
+	return func(o *options) error {
+		o.use(optAudience)
+		o.claims["aud"] = audience
+		return nil
+	}
+}
+
+// WithRequiredClaim requires a claim with the value, tokens without it are
+// forbidden.
+func WithRequiredClaim(name string, value any) Option {
+	return func(o *options) error {
+		o.use(optRequiredClaim)
+		if name == "iss" || name == "aud" {
+			return fmt.Errorf("use WithIssuer or WithAudience for %q", name)
+		}
+		o.claims[name] = value
+		return nil
+	}
+}
+
+// WithAllowedClaim only allows tokens where the claim, or an element of a
+// list claim, matches one of the values. A "*" in a value matches any
+// characters and nested claims are given as a dotted path, i.e.
+// "consumer.ID". Other tokens are forbidden.
+func WithAllowedClaim(name string, values ...string) Option {
+	return func(o *options) error {
+		o.use(optAllowedClaim)
+		if len(values) == 0 {
+			return fmt.Errorf("no values allowed for claim %q", name)
+		}
+		o.allowed = append(o.allowed, auth.ClaimRule{Claim: name, Values: values})
+		return nil
+	}
+}
+
+// WithScopes requires every scope in the "scope" or "scp" claim, tokens
+// missing one are forbidden.
+func WithScopes(scopes ...string) Option {
+	return func(o *options) error {
+		o.use(optScopes)
+		o.scopes = append(o.scopes, scopes...)
+		return nil
+	}
+}
+
+// WithAlgorithms replaces the allowlist of signing algorithms, i.e. "RS256".
+func WithAlgorithms(algorithms ...string) Option {
+	return func(o *options) error {
+		o.use(optAlgorithms)
+		o.algorithms = nil
+		for _, name := range algorithms {
+			var alg jwa.SignatureAlgorithm
+			if err := alg.Accept(name); err != nil || alg == jwa.NoSignature {
+				return fmt.Errorf("unsupported signing algorithm %q", name)
+			}
+			o.algorithms = append(o.algorithms, alg)
+		}
+		if len(o.algorithms) == 0 {
+			return errors.New("no signing algorithms allowed")
+		}
+		return nil
+	}
+}
+
+// WithDiscovery gets the JWKS URL and the issuer from an OpenID Connect or
+// OAuth2 authorization server metadata URL.
+func WithDiscovery(wellKnownURL string) Option {
+	return func(o *options) error {
+		o.use(optDiscovery)
+		o.wellKnownURL = wellKnownURL
+		return nil
+	}
+}
+
+// WithKeys adds public keys, a JWKS document or PEM encoded keys.
+func WithKeys(keys []byte) Option {
+	return func(o *options) error {
+		o.use(optKeys)
+		s, err := auth.ParseStaticKeys(keys)
+		if err != nil {
+			return err
+		}
+		o.keySources = append(o.keySources, s)
+		return nil
+	}
+}
+
+// WithKeyFile adds the public keys in a JWKS or PEM file, which is reloaded
+// when it changes.
+func WithKeyFile(path string) Option {
+	return func(o *options) error {
+		o.use(optKeys)
+		s, err := auth.FileKeys(path)
+		if err != nil {
+			return err
+		}
+		o.keySources = append(o.keySources, s)
+		return nil
+	}
+}
+
+// WithAllowedEmails only allows these users through IAP.
+func WithAllowedEmails(emails ...string) Option {
+	return func(o *options) error {
+		o.use(optAllowedEmails)
+		o.allowedEmails = append(o.allowedEmails, emails...)
+		return nil
+	}
+}
+
+// WithAllowedDomains only allows users of these Google Workspace domains
+// through IAP.
+func WithAllowedDomains(domains ...string) Option {
+	return func(o *options) error {
+		o.use(optAllowedDomains)
+		o.allowedDomains = append(o.allowedDomains, domains...)
+		return nil
+	}
+}
+
+// WithKey adds a named pre shared key, the name is the subject of requests
+// with the key.
+func WithKey(name, key string) Option {
+	return func(o *options) error {
+		o.use(optKey)
+		if name == "" || key == "" {
+			return errors.New("pre shared keys need a name and a key")
+		}
+		o.keys = append(o.keys, namedKey{name: name, key: key})
+		return nil
+	}
+}
+
+// WithTokenSources sets where to look for the credential, in order.
+func WithTokenSources(sources ...TokenSource) Option {
+	return func(o *options) error {
+		o.use(optTokenSources)
+		o.tokenSources = append(o.tokenSources, sources...)
+		return nil
+	}
+}
+
+// WithRealm sets the realm of WWW-Authenticate challenges.
+func WithRealm(realm string) Option {
+	return func(o *options) error {
+		o.use(optRealm)
+		o.realm = realm
+		return nil
+	}
+}
+
+// WithCredentialPolicy sets whether the credential is removed from requests
+// before they reach the next handler.
+func WithCredentialPolicy(policy CredentialPolicy) Option {
+	return func(o *options) error {
+		o.use(optCredentials)
+		if policy != CredentialsKeep && policy != CredentialsRemove {
+			return fmt.Errorf("unsupported credential policy %q", policy)
+		}
+		o.credentials = policy
+		return nil
+	}
+}
+
+// WithOptional lets requests without any credentials through as anonymous.
+// Invalid credentials are still rejected.
+func WithOptional() Option {
+	return func(o *options) error {
+		o.use(optOptional)
+		o.optional = true
+		return nil
+	}
+}
+
+// WithLogger sets the logger for rejected requests and key reloads, instead
+// of the standard logrus logger.
+func WithLogger(logger log.FieldLogger) Option {
+	return func(o *options) error {
+		o.use(optLogger)
+		o.logger = logger
+		return nil
+	}
+}
+
+// WithRegisterer registers the metrics of the provider with reg, i.e.
+// prometheus.DefaultRegisterer. Without it the metrics aren't exported.
+// Handlers sharing a registerer share the metrics.
+func WithRegisterer(reg prometheus.Registerer) Option {
+	return func(o *options) error {
+		o.use(optRegisterer)
+		o.registerer = reg
+		return nil
+	}
+}
+
+// WithErrorTemplates renders the HTML error pages with the templates in dir,
+// i.e. '401.html' or the catch-all 'error.html', instead of the built-in one.
+func WithErrorTemplates(dir string) Option {
+	return func(o *options) error {
+		o.use(optErrorTemplates)
+		if dir == "" {
+			return errors.New("WithErrorTemplates requires a directory")
+		}
+		o.templateDir = dir
+		return nil
+	}
+}
@@ -0,0 +1,37 @@
+package authproxy
+
+import "github.com/nais/authproxy/internal/auth"
+
+// TokenSource is where a credential is read from.
+type TokenSource = auth.TokenSource
+
+// CredentialPolicy is what happens to the credential of an authenticated
+// request.
+type CredentialPolicy = auth.CredentialPolicy
+
+const (
+	CredentialsKeep   = auth.CredentialsKeep
+	CredentialsRemove = auth.CredentialsRemove
+)
+
+// Header reads the credential from a header, after the scheme if one is
+// given, i.e. "Bearer".
+func Header(name, scheme string) TokenSource {
+	return auth.Header(name, scheme)
+}
+
+// Cookie reads the credential from a cookie.
+func Cookie(name string) TokenSource {
+	return auth.Cookie(name)
+}
+
+// Query reads the credential from a query parameter.
+func Query(name string) TokenSource {
+	return auth.Query(name)
+}
+
+// WebSocketProtocol reads the credential from the Sec-WebSocket-Protocol
+// header, from the entry with the prefix.
+func WebSocketProtocol(prefix string) TokenSource {
+	return auth.WebSocketProtocol(prefix)
+}